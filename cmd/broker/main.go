@@ -18,7 +18,9 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -59,6 +61,12 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(addr, expvar.Handler()))
+		}()
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -68,11 +76,19 @@ func main() {
 	}
 	defer store.Close()
 
-	broker, err := mqtt.NewBroker(ctx, store, mqtt.NewAuthenticator(store))
+	auth, err := mqtt.AuthenticatorFromEnv(ctx, store)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	broker, err := mqtt.NewBroker(ctx, store, auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go broker.PublishStats(ctx, mqtt.StatsInterval())
+	go broker.ReapStaleClients(ctx)
+
 	go func() {
 		for {
 			conn, err := listener.Accept()
@@ -84,7 +100,7 @@ func main() {
 		}
 	}()
 
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 	<-sigCh
 }
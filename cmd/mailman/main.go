@@ -18,9 +18,12 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -28,40 +31,91 @@ import (
 	"github.com/dimkr/yodi/pkg/store"
 )
 
+// popRetryDelay is the delay before popping a message again, after a failure
+const popRetryDelay = time.Second
+
 func main() {
 	log.SetLevel(log.WarnLevel)
 	log.SetReportCaller(true)
 	log.SetFormatter(&log.JSONFormatter{})
 
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(addr, expvar.Handler()))
+		}()
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go func() {
-		store, err := store.NewRedisStore(ctx)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer store.Close()
+	store, err := store.NewRedisStore(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
 
-		broker, err := mqtt.NewBroker(ctx, store, mqtt.NewAuthenticator(store))
-		if err != nil {
-			log.Fatal(err)
-		}
+	broker, err := mqtt.NewBroker(ctx, store, mqtt.NewAuthenticator(store))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go broker.PublishStats(ctx, mqtt.StatsInterval())
+	go broker.RequeueOrphanedMessages(ctx)
+
+	consumer, err := broker.NewMessageConsumer(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
 
 		for {
-			queuedMessage, err := broker.PopQueuedMessage(ctx)
+			consumedMessage, err := consumer.Pop(ctx)
 			if err != nil {
-				log.Fatal(err)
+				if ctx.Err() != nil {
+					return
+				}
+
+				log.WithError(err).Warn("Failed to pop a message")
+
+				select {
+				case <-ctx.Done():
+					return
+
+				case <-time.After(popRetryDelay):
+				}
+				continue
 			}
 
-			err = broker.QueueMessageForSubscribers(queuedMessage)
-			if err != nil {
-				log.Fatal(err)
+			if err := broker.QueueMessageForSubscribers(consumedMessage.QueuedMessage); err != nil {
+				log.WithError(err).Warn("Failed to queue a message for subscribers")
+
+				// the message stays in the processing list, and it's
+				// requeued when the consumer is closed
+				if err := consumer.Nack(ctx, consumedMessage); err != nil && ctx.Err() == nil {
+					log.WithError(err).Warn("Failed to return a message to the queue")
+				}
+				continue
+			}
+
+			if err := consumer.Ack(ctx, consumedMessage); err != nil {
+				log.WithError(err).Warn("Failed to acknowledge a message")
 			}
 		}
 	}()
 
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 	<-sigCh
+
+	cancel()
+	<-done
+
+	// messages this consumer has not acknowledged are processed by others
+	if err := consumer.Close(context.Background()); err != nil {
+		log.WithError(err).Warn("Failed to close the message consumer")
+	}
 }
@@ -0,0 +1,323 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/mqtt"
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+func adminError(err error) error {
+	if errors.Is(err, store.ErrNoKey) {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	return err
+}
+
+// audit records an action performed through the admin API
+func audit(c echo.Context, action mqtt.AuditAction, target string) {
+	event := mqtt.AuditEvent{
+		Action:     action,
+		RemoteAddr: c.RealIP(),
+		Target:     target,
+		Allowed:    true,
+	}
+
+	if identity := currentOperator(c); identity != nil {
+		event.Operator = identity.Username
+	}
+
+	broker.Audit(c.Request().Context(), &event)
+}
+
+func handleListDeadLetters(c echo.Context) error {
+	deadLetters, err := broker.ListDeadLetters(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, deadLetters)
+}
+
+func handleRequeueDeadLetter(c echo.Context) error {
+	if err := broker.RequeueDeadLetter(c.Request().Context(), c.Param("id")); err != nil {
+		return adminError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func handlePurgeDeadLetter(c echo.Context) error {
+	if err := broker.PurgeDeadLetter(c.Request().Context(), c.Param("id")); err != nil {
+		return adminError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func handlePurgeDeadLetters(c echo.Context) error {
+	if err := broker.PurgeDeadLetters(c.Request().Context()); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type explainACLRequest struct {
+	ACL      mqtt.ACL       `json:"acl"`
+	Username string         `json:"username"`
+	ClientID string         `json:"client_id"`
+	Action   mqtt.ACLAction `json:"action"`
+	Topic    string         `json:"topic"`
+	QoS      mqtt.QoS       `json:"qos"`
+}
+
+func handleExplainACL(c echo.Context) error {
+	var req explainACLRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if req.Topic == "" || (req.Action != mqtt.PublishAction && req.Action != mqtt.SubscribeAction) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid action or topic")
+	}
+
+	acl := req.ACL
+	if acl == nil {
+		if req.Username == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "either an ACL or a username must be specified")
+		}
+
+		user, err := mqtt.LoadUser(c.Request().Context(), dataStore, req.Username)
+		if err != nil {
+			return adminError(err)
+		}
+
+		user, err = mqtt.ResolveRoles(c.Request().Context(), dataStore, user)
+		if err != nil {
+			return adminError(err)
+		}
+
+		acl = user.ACL
+	}
+
+	return c.JSON(http.StatusOK, acl.Explain(req.Action, req.Topic, req.QoS, req.ClientID, req.Username))
+}
+
+func handleListRoles(c echo.Context) error {
+	roles, err := mqtt.ListRoles(c.Request().Context(), dataStore)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, roles)
+}
+
+func handleGetRole(c echo.Context) error {
+	role, err := mqtt.LoadRole(c.Request().Context(), dataStore, c.Param("name"))
+	if err != nil {
+		return adminError(err)
+	}
+
+	return c.JSON(http.StatusOK, role)
+}
+
+func handlePutRole(c echo.Context) error {
+	var role mqtt.Role
+	if err := c.Bind(&role); err != nil {
+		return err
+	}
+
+	if err := role.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := mqtt.SaveRole(c.Request().Context(), dataStore, c.Param("name"), &role); err != nil {
+		return err
+	}
+
+	audit(c, mqtt.AuditRoleSaved, c.Param("name"))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func handleDeleteRole(c echo.Context) error {
+	if err := mqtt.DeleteRole(c.Request().Context(), dataStore, c.Param("name")); err != nil {
+		if errors.Is(err, mqtt.ErrRoleInUse) {
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		return adminError(err)
+	}
+
+	audit(c, mqtt.AuditRoleDeleted, c.Param("name"))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func handleListLockouts(c echo.Context) error {
+	lockouts, err := mqtt.ListLockouts(c.Request().Context(), dataStore)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, lockouts)
+}
+
+func handleClearUserLockout(c echo.Context) error {
+	if err := mqtt.ClearUserLockout(c.Request().Context(), dataStore, c.Param("username")); err != nil {
+		return adminError(err)
+	}
+
+	audit(c, mqtt.AuditLockoutCleared, c.Param("username"))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func handleClearOperatorLockout(c echo.Context) error {
+	if err := mqtt.ClearOperatorLockout(c.Request().Context(), dataStore, c.Param("username")); err != nil {
+		return adminError(err)
+	}
+
+	audit(c, mqtt.AuditLockoutCleared, c.Param("username"))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func handleClearIPLockout(c echo.Context) error {
+	if err := mqtt.ClearIPLockout(c.Request().Context(), dataStore, c.Param("ip")); err != nil {
+		return adminError(err)
+	}
+
+	audit(c, mqtt.AuditLockoutCleared, c.Param("ip"))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// handleListAuditEvents returns audit events, filtered by the username,
+// client_id, operator, action, since, until (RFC 3339), denied and limit query
+// parameters
+func handleListAuditEvents(c echo.Context) error {
+	filter := mqtt.AuditFilter{
+		Username: c.QueryParam("username"),
+		ClientID: c.QueryParam("client_id"),
+		Operator: c.QueryParam("operator"),
+		Action:   mqtt.AuditAction(c.QueryParam("action")),
+	}
+
+	var err error
+
+	if s := c.QueryParam("since"); s != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid since")
+		}
+	}
+
+	if s := c.QueryParam("until"); s != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid until")
+		}
+	}
+
+	if s := c.QueryParam("denied"); s != "" {
+		if filter.Denied, err = strconv.ParseBool(s); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid denied")
+		}
+	}
+
+	if s := c.QueryParam("limit"); s != "" {
+		if filter.Limit, err = strconv.Atoi(s); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
+		}
+	}
+
+	events, err := mqtt.ListAuditEvents(c.Request().Context(), dataStore, &filter)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, events)
+}
+
+// registerAdminAPI registers the admin API, which is available to operators;
+// viewers may only read, operators may also manage devices and API keys and
+// read the audit log and dead letters, which contain message payloads, and
+// admins may also manage roles and operators; logins are rate-limited by
+// limiter
+func registerAdminAPI(e *echo.Echo, limiter *rateLimiter) {
+	e.POST("/api/login", handleLogin, limiter.middleware)
+
+	api := adminAPI{group: e.Group("/api", operatorAuth)}
+
+	viewer, operator, admin := mqtt.OperatorRoleViewer, mqtt.OperatorRoleOperator, mqtt.OperatorRoleAdmin
+
+	api.add(http.MethodPost, "/logout", viewer, handleLogout)
+
+	api.add(http.MethodGet, "/metrics", viewer, echo.WrapHandler(expvar.Handler()))
+
+	api.add(http.MethodPost, "/acl/explain", viewer, handleExplainACL)
+
+	api.add(http.MethodGet, "/users", viewer, handleListUsers)
+	api.add(http.MethodPost, "/users", operator, handleCreateUser)
+	api.add(http.MethodGet, "/users/:username", viewer, handleGetUser)
+	api.add(http.MethodPut, "/users/:username", operator, handlePutUser)
+	api.add(http.MethodDelete, "/users/:username", operator, handleDeleteUser)
+	api.add(http.MethodPost, "/users/:username/rotate", operator, handleRotateCredentials)
+
+	api.add(http.MethodGet, "/rotations", viewer, handleListRotations)
+	api.add(http.MethodPost, "/rotations", operator, handleRotateAllCredentials)
+	api.add(http.MethodGet, "/rotations/jobs/:id", viewer, handleGetRotationJob)
+	api.add(http.MethodGet, "/rotations/:username", viewer, handleGetRotation)
+
+	api.add(http.MethodGet, "/enrollment/tokens", viewer, handleListEnrollmentTokens)
+	api.add(http.MethodPost, "/enrollment/tokens", operator, handleCreateEnrollmentToken)
+	api.add(http.MethodDelete, "/enrollment/tokens/:id", operator, handleRevokeEnrollmentToken)
+	api.add(http.MethodGet, "/enrollments", viewer, handleListEnrollments)
+
+	api.add(http.MethodGet, "/roles", viewer, handleListRoles)
+	api.add(http.MethodGet, "/roles/:name", viewer, handleGetRole)
+	api.add(http.MethodPut, "/roles/:name", admin, handlePutRole)
+	api.add(http.MethodDelete, "/roles/:name", admin, handleDeleteRole)
+
+	api.add(http.MethodGet, "/audit", operator, handleListAuditEvents)
+
+	api.add(http.MethodGet, "/lockouts", viewer, handleListLockouts)
+	api.add(http.MethodDelete, "/lockouts/users/:username", operator, handleClearUserLockout)
+	api.add(http.MethodDelete, "/lockouts/operators/:username", admin, handleClearOperatorLockout)
+	api.add(http.MethodDelete, "/lockouts/ips/:ip", operator, handleClearIPLockout)
+
+	api.add(http.MethodGet, "/deadletters", operator, handleListDeadLetters)
+	api.add(http.MethodPost, "/deadletters/:id/requeue", operator, handleRequeueDeadLetter)
+	api.add(http.MethodDelete, "/deadletters/:id", operator, handlePurgeDeadLetter)
+	api.add(http.MethodDelete, "/deadletters", operator, handlePurgeDeadLetters)
+
+	api.add(http.MethodGet, "/keys", viewer, handleListAPIKeys)
+	api.add(http.MethodPost, "/keys", operator, handleCreateAPIKey)
+	api.add(http.MethodDelete, "/keys/:id", operator, handleRevokeAPIKey)
+
+	api.add(http.MethodGet, "/operators", admin, handleListOperators)
+	api.add(http.MethodGet, "/operators/:username", admin, handleGetOperator)
+	api.add(http.MethodPut, "/operators/:username", admin, handlePutOperator)
+	api.add(http.MethodDelete, "/operators/:username", admin, handleDeleteOperator)
+}
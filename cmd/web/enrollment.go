@@ -0,0 +1,125 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/mqtt"
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+type createEnrollmentTokenRequest struct {
+	Role    string `json:"role"`
+	MaxUses int64  `json:"max_uses"`
+	TTL     int64  `json:"ttl"`
+}
+
+type createEnrollmentTokenResponse struct {
+	Token string `json:"token"`
+	*mqtt.EnrollmentToken
+}
+
+type enrollRequest struct {
+	Token string `json:"token"`
+}
+
+func handleCreateEnrollmentToken(c echo.Context) error {
+	req := createEnrollmentTokenRequest{MaxUses: 1}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+
+	if req.Role != "" {
+		if _, err := mqtt.LoadRole(ctx, dataStore, req.Role); err != nil {
+			if errors.Is(err, store.ErrNoKey) {
+				return echo.NewHTTPError(http.StatusBadRequest, "unknown role: "+req.Role)
+			}
+			return err
+		}
+	}
+
+	if req.MaxUses <= 0 || req.TTL <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "max_uses and ttl must be positive")
+	}
+
+	token, enrollmentToken, err := mqtt.CreateEnrollmentToken(ctx, dataStore, req.Role, req.MaxUses, time.Duration(req.TTL)*time.Second)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, &createEnrollmentTokenResponse{Token: token, EnrollmentToken: enrollmentToken})
+}
+
+func handleListEnrollmentTokens(c echo.Context) error {
+	tokens, err := mqtt.ListEnrollmentTokens(c.Request().Context(), dataStore)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, tokens)
+}
+
+func handleRevokeEnrollmentToken(c echo.Context) error {
+	if err := mqtt.RevokeEnrollmentToken(c.Request().Context(), dataStore, c.Param("id")); err != nil {
+		return adminError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func handleListEnrollments(c echo.Context) error {
+	enrollments, err := mqtt.ListEnrollments(c.Request().Context(), dataStore)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, enrollments)
+}
+
+// handleEnroll creates a user for a device that presents an enrollment token
+func handleEnroll(c echo.Context) error {
+	var req enrollRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	event := mqtt.AuditEvent{Action: mqtt.AuditEnroll, RemoteAddr: c.RealIP()}
+
+	device, err := mqtt.EnrollDevice(c.Request().Context(), dataStore, req.Token, c.RealIP())
+	if err != nil {
+		event.Reason = err.Error()
+		broker.AuditUnauthenticated(c.Request().Context(), &event)
+
+		if errors.Is(err, mqtt.ErrInvalidEnrollmentToken) {
+			return echo.NewHTTPError(http.StatusForbidden, err.Error())
+		}
+		return err
+	}
+
+	event.Username = device.Username
+	event.ClientID = device.ClientID
+	event.Allowed = true
+	broker.Audit(c.Request().Context(), &event)
+
+	return c.JSON(http.StatusCreated, device)
+}
@@ -18,7 +18,8 @@ package main
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -32,8 +33,9 @@ import (
 )
 
 var (
-	upgrader = websocket.Upgrader{Subprotocols: []string{mqtt.WebSocketProtocol}}
-	broker   *mqtt.Broker
+	upgrader  = websocket.Upgrader{Subprotocols: []string{mqtt.WebSocketProtocol}}
+	broker    *mqtt.Broker
+	dataStore store.Store
 )
 
 func handleHealthCheck(c echo.Context) error {
@@ -63,6 +65,43 @@ func handleMQTT(c echo.Context) error {
 	return nil
 }
 
+// ipExtractorFromEnv returns a function that extracts the client address of a
+// request, from X-Forwarded-For only if the request comes from one of the
+// proxies specified by the TRUSTED_PROXIES environment variable, a
+// comma-separated list of addresses or CIDR ranges
+func ipExtractorFromEnv() (echo.IPExtractor, error) {
+	proxies := os.Getenv("TRUSTED_PROXIES")
+	if proxies == "" {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+
+	for _, proxy := range strings.Split(proxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TRUSTED_PROXIES: %s", proxies)
+		}
+
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
 func main() {
 	log.SetLevel(log.WarnLevel)
 	log.SetReportCaller(true)
@@ -78,12 +117,28 @@ func main() {
 		log.Fatal("e is nil")
 	}
 
+	ipExtractor, err := ipExtractorFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	e.IPExtractor = ipExtractor
+
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
 	e.GET("/", handleHealthCheck)
 	e.GET("/mqtt", handleMQTT)
-	e.Static("/static", "/static")
+	// endpoints that don't require authentication are rate-limited
+	limiter, err := rateLimiterFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	e.POST("/enroll", handleEnroll, limiter.middleware)
+	e.POST("/rotate", handleRedeemRotation, limiter.middleware)
+	e.Group("/static", operatorAuth).Static("/", "/static")
+
+	registerAdminAPI(e, limiter)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -93,32 +148,31 @@ func main() {
 		log.Fatal(err)
 	}
 	defer store.Close()
+	dataStore = store
 
-	auth := mqtt.NewAuthenticator(store)
-
-	authMiddleware := middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{
-		Validator: func(username, password string, c echo.Context) (bool, error) {
-			_, err := auth.AuthenticateUser(c.Request().Context(), username, password)
-			if err != nil {
-				if !errors.Is(err, mqtt.ErrBadCredentials) {
-					log.WithError(err).Error("authentication failed")
-					return false, err
-				}
-				return false, nil
-			}
-			return true, nil
-		},
-		Skipper: func(c echo.Context) bool {
-			return !strings.HasPrefix(c.Request().URL.Path, "/static")
-		},
-	})
-	e.Use(authMiddleware)
+	if os.Getenv("ADMIN_TOKEN") != "" {
+		log.Warn("ADMIN_TOKEN is no longer supported; use operator accounts")
+	}
+
+	if username, password := os.Getenv("ADMIN_USERNAME"), os.Getenv("ADMIN_PASSWORD"); username != "" && password != "" {
+		if err := mqtt.BootstrapOperator(ctx, store, username, password); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	auth, err := mqtt.AuthenticatorFromEnv(ctx, store)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	broker, err = mqtt.NewBroker(ctx, store, auth)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	go broker.PublishStats(ctx, mqtt.StatsInterval())
+	go broker.ReapStaleClients(ctx)
+
 	if err := e.Start(":" + port); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,362 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/mqtt"
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const operatorContextKey = "operator"
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	Token string `json:"token"`
+	*mqtt.OperatorSession
+}
+
+type createAPIKeyRequest struct {
+	Name string            `json:"name"`
+	Role mqtt.OperatorRole `json:"role"`
+	TTL  int64             `json:"ttl"`
+}
+
+type createAPIKeyResponse struct {
+	Key string `json:"key"`
+	*mqtt.APIKey
+}
+
+// adminAPI registers admin API routes; each route requires a minimal operator
+// role
+type adminAPI struct {
+	group *echo.Group
+}
+
+func (a *adminAPI) add(method, path string, role mqtt.OperatorRole, h echo.HandlerFunc) {
+	a.group.Add(method, path, h, requireOperatorRole(role))
+}
+
+// currentOperator returns the operator that performs a request
+func currentOperator(c echo.Context) *mqtt.OperatorIdentity {
+	identity, _ := c.Get(operatorContextKey).(*mqtt.OperatorIdentity)
+	return identity
+}
+
+// authenticateOperator authenticates an operator using a bearer token (an API
+// key or a session token) or basic authentication; MQTT users are never
+// considered
+func authenticateOperator(c echo.Context) (*mqtt.OperatorIdentity, error) {
+	ctx := mqtt.WithConnectInfo(c.Request().Context(), mqtt.ConnectInfo{RemoteAddr: c.RealIP()})
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+
+	switch {
+	case strings.HasPrefix(auth, "Bearer "):
+		return mqtt.AuthenticateOperatorToken(ctx, dataStore, strings.TrimPrefix(auth, "Bearer "))
+
+	case strings.HasPrefix(auth, "Basic "):
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+		if err != nil {
+			return nil, mqtt.ErrBadCredentials
+		}
+
+		credentials := strings.SplitN(string(b), ":", 2)
+		if len(credentials) != 2 {
+			return nil, mqtt.ErrBadCredentials
+		}
+
+		return mqtt.AuthenticateOperator(ctx, dataStore, credentials[0], credentials[1])
+
+	default:
+		return nil, mqtt.ErrBadCredentials
+	}
+}
+
+func operatorAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		identity, err := authenticateOperator(c)
+		if err != nil {
+			if !errors.Is(err, mqtt.ErrBadCredentials) {
+				log.WithError(err).Error("operator authentication failed")
+				return err
+			}
+
+			broker.AuditUnauthenticated(c.Request().Context(), &mqtt.AuditEvent{
+				Action:     mqtt.AuditAdminAccess,
+				RemoteAddr: c.RealIP(),
+				Target:     c.Request().URL.Path,
+				Reason:     err.Error(),
+			})
+
+			// browsers prompt for credentials of operators, e.g. under /static
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="yodi"`)
+			return echo.NewHTTPError(http.StatusUnauthorized)
+		}
+
+		c.Set(operatorContextKey, identity)
+		return next(c)
+	}
+}
+
+func requireOperatorRole(role mqtt.OperatorRole) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity := currentOperator(c)
+			if identity == nil || !identity.Role.Allows(role) {
+				event := mqtt.AuditEvent{
+					Action:     mqtt.AuditAdminAccess,
+					RemoteAddr: c.RealIP(),
+					Target:     c.Request().Method + " " + c.Path(),
+					Reason:     "requires role " + string(role),
+				}
+				if identity != nil {
+					event.Operator = identity.Username
+				}
+				broker.Audit(c.Request().Context(), &event)
+
+				return echo.NewHTTPError(http.StatusForbidden)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// operatorResponse is an operator without its password hash
+type operatorResponse struct {
+	Role mqtt.OperatorRole `json:"role"`
+}
+
+func newOperatorResponse(operator *mqtt.Operator) *operatorResponse {
+	return &operatorResponse{Role: operator.Role}
+}
+
+func handleLogin(c echo.Context) error {
+	var req loginRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	event := mqtt.AuditEvent{Action: mqtt.AuditOperatorLogin, Operator: req.Username, RemoteAddr: c.RealIP()}
+
+	ctx := mqtt.WithConnectInfo(c.Request().Context(), mqtt.ConnectInfo{RemoteAddr: c.RealIP()})
+
+	token, session, err := mqtt.CreateOperatorSession(ctx, dataStore, req.Username, req.Password, mqtt.OperatorSessionTTL())
+	if err != nil {
+		event.Reason = err.Error()
+		broker.AuditUnauthenticated(c.Request().Context(), &event)
+
+		if errors.Is(err, mqtt.ErrBadCredentials) {
+			return echo.NewHTTPError(http.StatusUnauthorized)
+		}
+		return err
+	}
+
+	event.Allowed = true
+	broker.Audit(c.Request().Context(), &event)
+
+	return c.JSON(http.StatusCreated, &loginResponse{Token: token, OperatorSession: session})
+}
+
+func handleLogout(c echo.Context) error {
+	identity := currentOperator(c)
+	if identity.SessionID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "not a session")
+	}
+
+	if err := mqtt.RevokeOperatorSession(c.Request().Context(), dataStore, identity.SessionID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func handleListOperators(c echo.Context) error {
+	operators, err := mqtt.ListOperators(c.Request().Context(), dataStore)
+	if err != nil {
+		return err
+	}
+
+	resp := make(map[string]*operatorResponse, len(operators))
+	for username, operator := range operators {
+		resp[username] = newOperatorResponse(operator)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func handleGetOperator(c echo.Context) error {
+	operator, err := mqtt.LoadOperator(c.Request().Context(), dataStore, c.Param("username"))
+	if err != nil {
+		return adminError(err)
+	}
+
+	return c.JSON(http.StatusOK, newOperatorResponse(operator))
+}
+
+// handlePutOperator adds or replaces an operator; if the password is omitted,
+// the password of the existing operator is kept
+func handlePutOperator(c echo.Context) error {
+	var operator mqtt.Operator
+	if err := c.Bind(&operator); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	username := c.Param("username")
+
+	if err := operator.Role.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	switch {
+	case operator.Password == "":
+		existing, err := mqtt.LoadOperator(ctx, dataStore, username)
+		if err != nil {
+			if errors.Is(err, store.ErrNoKey) {
+				return echo.NewHTTPError(http.StatusBadRequest, "empty password")
+			}
+			return err
+		}
+
+		operator.Password = existing.Password
+
+	case mqtt.IsPasswordHash(operator.Password):
+		if err := mqtt.ValidatePasswordHash(operator.Password); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid password hash: "+err.Error())
+		}
+
+	default:
+		hash, err := mqtt.HashPassword(operator.Password, mqtt.DefaultPasswordAlgorithm)
+		if err != nil {
+			return err
+		}
+
+		operator.Password = hash
+	}
+
+	if err := mqtt.SaveOperator(ctx, dataStore, username, &operator); err != nil {
+		return err
+	}
+
+	audit(c, mqtt.AuditOperatorSaved, username)
+
+	return c.JSON(http.StatusOK, newOperatorResponse(&operator))
+}
+
+func handleDeleteOperator(c echo.Context) error {
+	username := c.Param("username")
+
+	if username == currentOperator(c).Username {
+		return echo.NewHTTPError(http.StatusBadRequest, "operators cannot delete themselves")
+	}
+
+	if err := mqtt.DeleteOperator(c.Request().Context(), dataStore, username); err != nil {
+		return adminError(err)
+	}
+
+	audit(c, mqtt.AuditOperatorDeleted, username)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// handleListAPIKeys returns the API keys of the current operator, or all API
+// keys if the operator is an admin
+func handleListAPIKeys(c echo.Context) error {
+	apiKeys, err := mqtt.ListAPIKeys(c.Request().Context(), dataStore)
+	if err != nil {
+		return err
+	}
+
+	identity := currentOperator(c)
+	if identity.Role.Allows(mqtt.OperatorRoleAdmin) {
+		return c.JSON(http.StatusOK, apiKeys)
+	}
+
+	own := make([]*mqtt.APIKey, 0, len(apiKeys))
+	for _, apiKey := range apiKeys {
+		if apiKey.Operator == identity.Username {
+			own = append(own, apiKey)
+		}
+	}
+
+	return c.JSON(http.StatusOK, own)
+}
+
+// handleCreateAPIKey creates an API key for the current operator, with the
+// operator's role by default
+func handleCreateAPIKey(c echo.Context) error {
+	identity := currentOperator(c)
+
+	req := createAPIKeyRequest{Role: identity.Role}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if req.TTL < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "ttl must not be negative")
+	}
+
+	// a key created using another key cannot exceed that key's role
+	if err := req.Role.Validate(); err != nil || !identity.Role.Allows(req.Role) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid role")
+	}
+
+	key, apiKey, err := mqtt.CreateAPIKey(c.Request().Context(), dataStore, identity.Username, req.Name, req.Role, time.Duration(req.TTL)*time.Second)
+	if err != nil {
+		return err
+	}
+
+	audit(c, mqtt.AuditAPIKeyCreated, apiKey.ID)
+
+	return c.JSON(http.StatusCreated, &createAPIKeyResponse{Key: key, APIKey: apiKey})
+}
+
+// handleRevokeAPIKey revokes an API key of the current operator, or any API key
+// if the operator is an admin
+func handleRevokeAPIKey(c echo.Context) error {
+	ctx := c.Request().Context()
+	identity := currentOperator(c)
+
+	apiKey, err := mqtt.GetAPIKey(ctx, dataStore, c.Param("id"))
+	if err != nil {
+		return adminError(err)
+	}
+
+	if apiKey.Operator != identity.Username && !identity.Role.Allows(mqtt.OperatorRoleAdmin) {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	if err := mqtt.RevokeAPIKey(ctx, dataStore, apiKey.ID); err != nil {
+		return adminError(err)
+	}
+
+	audit(c, mqtt.AuditAPIKeyRevoked, apiKey.ID)
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,121 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultRateLimit = 30
+
+	// maxRateLimitBuckets limits the number of addresses tracked at once
+	maxRateLimitBuckets = 65536
+)
+
+type rateLimitBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the rate of requests from each address, using a token
+// bucket per address
+type rateLimiter struct {
+	lock    sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*rateLimitBucket
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: make(map[string]*rateLimitBucket),
+	}
+}
+
+// rateLimiterFromEnv returns a rate limiter that allows RATE_LIMIT requests per
+// minute from each address
+func rateLimiterFromEnv() (*rateLimiter, error) {
+	perMinute := defaultRateLimit
+	if s := os.Getenv("RATE_LIMIT"); s != "" {
+		var err error
+		perMinute, err = strconv.Atoi(s)
+		if err != nil || perMinute <= 0 {
+			return nil, fmt.Errorf("Invalid RATE_LIMIT: %s", s)
+		}
+	}
+
+	return newRateLimiter(perMinute), nil
+}
+
+// allow takes a token from the bucket of an address, or returns the time until
+// the next token if the bucket is empty
+func (l *rateLimiter) allow(addr string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	bucket, ok := l.buckets[addr]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.forgetFull(now)
+		}
+
+		bucket = &rateLimitBucket{tokens: l.burst, last: now}
+		l.buckets[addr] = bucket
+	}
+
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+// forgetFull removes the buckets of addresses that have not sent requests for
+// long enough to refill them
+func (l *rateLimiter) forgetFull(now time.Time) {
+	for addr, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, addr)
+		}
+	}
+}
+
+func (l *rateLimiter) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if ok, wait := l.allow(c.RealIP(), time.Now()); !ok {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return echo.NewHTTPError(http.StatusTooManyRequests)
+		}
+
+		return next(c)
+	}
+}
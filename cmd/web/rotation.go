@@ -0,0 +1,156 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/mqtt"
+	"github.com/labstack/echo/v4"
+)
+
+const defaultRotationGrace = 7 * 24 * 60 * 60
+
+type rotateCredentialsRequest struct {
+	Grace           int64 `json:"grace"`
+	KeepOldPassword bool  `json:"keep_old_password"`
+}
+
+type rotateAllCredentialsRequest struct {
+	Usernames       []string `json:"usernames"`
+	Grace           int64    `json:"grace"`
+	KeepOldPassword bool     `json:"keep_old_password"`
+}
+
+type redeemRotationRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Nonce    string `json:"nonce"`
+}
+
+type redeemRotationResponse struct {
+	Password string `json:"password"`
+}
+
+func handleRotateCredentials(c echo.Context) error {
+	req := rotateCredentialsRequest{Grace: defaultRotationGrace}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if req.Grace <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "grace must be positive")
+	}
+
+	username := c.Param("username")
+
+	rotation, err := broker.RotateCredentials(c.Request().Context(), username, time.Duration(req.Grace)*time.Second, req.KeepOldPassword)
+	if err != nil {
+		if errors.Is(err, mqtt.ErrNoDeviceClientID) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return adminError(err)
+	}
+
+	audit(c, mqtt.AuditRotate, username)
+
+	return c.JSON(http.StatusCreated, rotation)
+}
+
+// handleRotateAllCredentials starts a job that rotates the credentials of the
+// specified devices, or all devices if no usernames are specified
+func handleRotateAllCredentials(c echo.Context) error {
+	req := rotateAllCredentialsRequest{Grace: defaultRotationGrace}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if req.Grace <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "grace must be positive")
+	}
+
+	event := mqtt.AuditEvent{Action: mqtt.AuditRotate, RemoteAddr: c.RealIP()}
+	if identity := currentOperator(c); identity != nil {
+		event.Operator = identity.Username
+	}
+
+	job, err := broker.StartRotationJob(c.Request().Context(), req.Usernames, time.Duration(req.Grace)*time.Second, req.KeepOldPassword, event)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, job)
+}
+
+func handleGetRotationJob(c echo.Context) error {
+	job, err := mqtt.GetRotationJob(c.Request().Context(), dataStore, c.Param("id"))
+	if err != nil {
+		return adminError(err)
+	}
+
+	return c.JSON(http.StatusOK, job)
+}
+
+func handleListRotations(c echo.Context) error {
+	rotations, err := mqtt.ListRotations(c.Request().Context(), dataStore)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, rotations)
+}
+
+func handleGetRotation(c echo.Context) error {
+	rotation, err := mqtt.GetRotation(c.Request().Context(), dataStore, c.Param("username"))
+	if err != nil {
+		return adminError(err)
+	}
+
+	return c.JSON(http.StatusOK, rotation)
+}
+
+// handleRedeemRotation issues a new password for a device that presents its
+// current password and the nonce it has received in a rotate_credentials
+// command
+func handleRedeemRotation(c echo.Context) error {
+	var req redeemRotationRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	event := mqtt.AuditEvent{Action: mqtt.AuditRotationRedeemed, Username: req.Username, RemoteAddr: c.RealIP()}
+
+	ctx := mqtt.WithConnectInfo(c.Request().Context(), mqtt.ConnectInfo{RemoteAddr: c.RealIP()})
+
+	password, err := mqtt.RedeemRotation(ctx, dataStore, req.Username, req.Password, req.Nonce)
+	if err != nil {
+		event.Reason = err.Error()
+		broker.AuditUnauthenticated(c.Request().Context(), &event)
+
+		if errors.Is(err, mqtt.ErrBadCredentials) {
+			return echo.NewHTTPError(http.StatusUnauthorized)
+		}
+		return err
+	}
+
+	event.Allowed = true
+	broker.Audit(c.Request().Context(), &event)
+
+	return c.JSON(http.StatusOK, &redeemRotationResponse{Password: password})
+}
@@ -0,0 +1,194 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/mqtt"
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+type createUserRequest struct {
+	Username string `json:"username"`
+	mqtt.User
+}
+
+// userResponse is a user without its password hashes; it has no password
+// field, so a response can be sent back without replacing the password
+type userResponse struct {
+	ACL              mqtt.ACL         `json:"acl"`
+	Roles            []string         `json:"roles,omitempty"`
+	RotationDeadline *time.Time       `json:"rotation_deadline,omitempty"`
+	ClientIDs        []string         `json:"client_ids,omitempty"`
+	Limits           mqtt.QueueLimits `json:"limits,omitempty"`
+}
+
+func newUserResponse(user *mqtt.User) *userResponse {
+	return &userResponse{
+		ACL:              user.ACL,
+		Roles:            user.Roles,
+		RotationDeadline: user.RotationDeadline,
+		ClientIDs:        user.ClientIDs,
+		Limits:           user.Limits,
+	}
+}
+
+// prepareUser validates a user and hashes its password; if the password is
+// omitted, the password of the existing user is kept, with its pending
+// credential rotation
+func prepareUser(ctx context.Context, username string, user *mqtt.User, existing *mqtt.User) error {
+	if username == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "empty username")
+	}
+
+	if err := user.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	for _, name := range user.Roles {
+		if _, err := mqtt.LoadRole(ctx, dataStore, name); err != nil {
+			if errors.Is(err, store.ErrNoKey) {
+				return echo.NewHTTPError(http.StatusBadRequest, "unknown role: "+name)
+			}
+			return err
+		}
+	}
+
+	// rotation can be started only through the rotation API
+	user.NextPassword = ""
+	user.RotationDeadline = nil
+
+	switch {
+	case user.Password == "" && existing != nil:
+		user.Password = existing.Password
+		user.NextPassword = existing.NextPassword
+		user.RotationDeadline = existing.RotationDeadline
+
+	case user.Password == "":
+		return echo.NewHTTPError(http.StatusBadRequest, "empty password")
+
+	case mqtt.IsPasswordHash(user.Password):
+		if err := mqtt.ValidatePasswordHash(user.Password); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid password hash: "+err.Error())
+		}
+
+	default:
+		hash, err := mqtt.HashPassword(user.Password, mqtt.DefaultPasswordAlgorithm)
+		if err != nil {
+			return err
+		}
+
+		user.Password = hash
+	}
+
+	return nil
+}
+
+func handleListUsers(c echo.Context) error {
+	users, err := mqtt.ListUsers(c.Request().Context(), dataStore)
+	if err != nil {
+		return err
+	}
+
+	resp := make(map[string]*userResponse, len(users))
+	for username, user := range users {
+		resp[username] = newUserResponse(user)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func handleGetUser(c echo.Context) error {
+	user, err := mqtt.LoadUser(c.Request().Context(), dataStore, c.Param("username"))
+	if err != nil {
+		return adminError(err)
+	}
+
+	return c.JSON(http.StatusOK, newUserResponse(user))
+}
+
+func handleCreateUser(c echo.Context) error {
+	var req createUserRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+
+	if _, err := mqtt.LoadUser(ctx, dataStore, req.Username); err == nil {
+		return echo.NewHTTPError(http.StatusConflict, "user already exists")
+	} else if !errors.Is(err, store.ErrNoKey) {
+		return err
+	}
+
+	if err := prepareUser(ctx, req.Username, &req.User, nil); err != nil {
+		return err
+	}
+
+	if err := mqtt.SaveUser(ctx, dataStore, req.Username, &req.User); err != nil {
+		return err
+	}
+
+	audit(c, mqtt.AuditUserSaved, req.Username)
+
+	return c.JSON(http.StatusCreated, newUserResponse(&req.User))
+}
+
+func handlePutUser(c echo.Context) error {
+	var user mqtt.User
+	if err := c.Bind(&user); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	username := c.Param("username")
+
+	existing, err := mqtt.LoadUser(ctx, dataStore, username)
+	if err != nil {
+		if !errors.Is(err, store.ErrNoKey) {
+			return err
+		}
+		existing = nil
+	}
+
+	if err := prepareUser(ctx, username, &user, existing); err != nil {
+		return err
+	}
+
+	if err := mqtt.SaveUser(ctx, dataStore, username, &user); err != nil {
+		return err
+	}
+
+	audit(c, mqtt.AuditUserSaved, username)
+
+	return c.JSON(http.StatusOK, newUserResponse(&user))
+}
+
+func handleDeleteUser(c echo.Context) error {
+	if err := mqtt.DeleteUser(c.Request().Context(), dataStore, c.Param("username")); err != nil {
+		return adminError(err)
+	}
+
+	audit(c, mqtt.AuditUserDeleted, c.Param("username"))
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,115 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/dimkr/yodi/pkg/mqtt"
+	"github.com/dimkr/yodi/pkg/store"
+)
+
+func loadACL(path, username string) (mqtt.ACL, error) {
+	if path != "" {
+		var j []byte
+		var err error
+		if path == "-" {
+			j, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			j, err = ioutil.ReadFile(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var acl mqtt.ACL
+		if err := json.Unmarshal(j, &acl); err != nil {
+			return nil, err
+		}
+
+		return acl, nil
+	}
+
+	if username == "" {
+		return nil, errors.New("either an ACL or a username must be specified")
+	}
+
+	ctx := context.Background()
+
+	store, err := store.NewRedisStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	user, err := mqtt.LoadUser(ctx, store, username)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err = mqtt.ResolveRoles(ctx, store, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return user.ACL, nil
+}
+
+func testACL(args []string) error {
+	flags := flag.NewFlagSet("acl-test", flag.ExitOnError)
+	path := flags.String("f", "", "ACL file (- for stdin); if not specified, the ACL of the user is read from Redis")
+	username := flags.String("u", "", "username")
+	clientID := flags.String("i", "", "client ID")
+	action := flags.String("a", string(mqtt.PublishAction), "action (publish or subscribe)")
+	qos := flags.Uint("q", 0, "QoS level")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s acl-test [-f path] [-u username] [-i client ID] [-a action] [-q QoS] topic\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	acl, err := loadACL(*path, *username)
+	if err != nil {
+		return err
+	}
+
+	decision := acl.Explain(mqtt.ACLAction(*action), flags.Arg(0), mqtt.QoS(*qos), *clientID, *username)
+
+	j, err := json.MarshalIndent(&decision, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(j))
+
+	if !decision.Allowed {
+		os.Exit(1)
+	}
+
+	return nil
+}
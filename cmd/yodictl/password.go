@@ -0,0 +1,62 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dimkr/yodi/pkg/mqtt"
+)
+
+func hashPassword(args []string) error {
+	flags := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	algorithm := flags.String("a", string(mqtt.DefaultPasswordAlgorithm), "algorithm (bcrypt, scrypt or argon2id)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s hash-password [-a algorithm] [password]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var password string
+	switch flags.NArg() {
+	case 0:
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+
+	case 1:
+		password = flags.Arg(0)
+
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	hash, err := mqtt.HashPassword(password, mqtt.PasswordAlgorithm(*algorithm))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hash)
+	return nil
+}
@@ -0,0 +1,287 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ACLEntry defines permissions, the allowed QoS level and the default message
+// TTL (in seconds) for a topic; if Deny is set, the entry forbids the actions
+// it specifies, or all actions if it specifies none
+type ACLEntry struct {
+	Publish   bool   `json:"publish,omitempty"`
+	Subscribe bool   `json:"subscribe,omitempty"`
+	QoS       QoS    `json:"qos,omitempty"`
+	TTL       uint32 `json:"ttl,omitempty"`
+	Deny      bool   `json:"deny,omitempty"`
+}
+
+// ACL maps topics to permissions; a topic may be a pattern that contains the
+// + and # wildcards, and %c or %u, which are replaced with the client ID and
+// the username
+//
+// When multiple entries match a topic, the most specific entry that allows or
+// forbids an action decides: an exact match is more specific than any pattern,
+// and an entry that forbids an action beats an equally specific entry that
+// allows it
+type ACL map[string]ACLEntry
+
+// ACLAction is an action controlled by an ACL
+type ACLAction string
+
+const (
+	// PublishAction is publishing of a message to a topic
+	PublishAction ACLAction = "publish"
+
+	// SubscribeAction is subscription to a topic filter, or delivery of a
+	// message published to a topic
+	SubscribeAction ACLAction = "subscribe"
+)
+
+// ACLDecision explains why an action is allowed or forbidden
+type ACLDecision struct {
+	Allowed bool   `json:"allowed"`
+	Rule    string `json:"rule,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+const (
+	clientIDPlaceholder = "%c"
+	usernamePlaceholder = "%u"
+)
+
+func isPattern(topic string) bool {
+	return isWildcardFilter(topic) || strings.Contains(topic, clientIDPlaceholder) || strings.Contains(topic, usernamePlaceholder)
+}
+
+// expandLevel replaces placeholders in one level of a pattern; a client ID or a
+// username that contains a wildcard or spans multiple levels never matches
+func expandLevel(level, clientID, username string) (string, bool) {
+	for placeholder, value := range map[string]string{clientIDPlaceholder: clientID, usernamePlaceholder: username} {
+		if !strings.Contains(level, placeholder) {
+			continue
+		}
+
+		if value == "" || strings.ContainsAny(value, "/"+singleLevelWildcard+multiLevelWildcard) {
+			return "", false
+		}
+
+		level = strings.ReplaceAll(level, placeholder, value)
+	}
+
+	return level, true
+}
+
+// matchPattern determines whether or not a pattern matches a topic or covers a
+// topic filter that may contain wildcards
+func matchPattern(pattern, topic, clientID, username string) bool {
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range patternLevels {
+		if i == 0 && isReservedTopic(topic) && (level == singleLevelWildcard || level == multiLevelWildcard) {
+			return false
+		}
+
+		if level == multiLevelWildcard {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level == singleLevelWildcard {
+			if topicLevels[i] == multiLevelWildcard {
+				return false
+			}
+			continue
+		}
+
+		expanded, ok := expandLevel(level, clientID, username)
+		if !ok || expanded != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(patternLevels) == len(topicLevels)
+}
+
+// specificity ranks patterns: a level without wildcards is more specific than
+// a single-level wildcard, which is more specific than a multi-level wildcard
+func specificity(pattern string) int {
+	n := 0
+
+	for _, level := range strings.Split(pattern, "/") {
+		switch level {
+		case multiLevelWildcard:
+
+		case singleLevelWildcard:
+			n++
+
+		default:
+			n += 2
+		}
+	}
+
+	return n
+}
+
+const exactMatch = 1 << 16
+
+// Validate determines whether or not all entries of an ACL are valid
+func (acl ACL) Validate() error {
+	for pattern, entry := range acl {
+		if pattern == "" {
+			return errors.New("empty topic")
+		}
+
+		if err := validateTopicFilter(pattern); err != nil {
+			return fmt.Errorf("%s: %w", pattern, err)
+		}
+
+		if entry.QoS > QoS1 {
+			return fmt.Errorf("%s: unsupported QoS level %d", pattern, entry.QoS)
+		}
+
+		if !entry.Publish && !entry.Subscribe && !entry.Deny {
+			return fmt.Errorf("%s: entry allows nothing", pattern)
+		}
+	}
+
+	return nil
+}
+
+// applies determines whether or not an entry allows or forbids an action
+func (e *ACLEntry) applies(action ACLAction) bool {
+	switch action {
+	case PublishAction:
+		return e.Publish || (e.Deny && !e.Subscribe)
+
+	case SubscribeAction:
+		return e.Subscribe || (e.Deny && !e.Publish)
+
+	default:
+		return false
+	}
+}
+
+type aclMatch struct {
+	rule        string
+	entry       ACLEntry
+	specificity int
+}
+
+// matches returns all entries that allow or forbid an action on a topic, the
+// one that decides first
+func (a ACL) matches(action ACLAction, topic, clientID, username string) []aclMatch {
+	matches := make([]aclMatch, 0)
+
+	for rule, entry := range a {
+		if !entry.applies(action) {
+			continue
+		}
+
+		if !isPattern(rule) {
+			if rule == topic {
+				matches = append(matches, aclMatch{rule: rule, entry: entry, specificity: exactMatch})
+			}
+			continue
+		}
+
+		if matchPattern(rule, topic, clientID, username) {
+			matches = append(matches, aclMatch{rule: rule, entry: entry, specificity: specificity(rule)})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].specificity != matches[j].specificity {
+			return matches[i].specificity > matches[j].specificity
+		}
+
+		if matches[i].entry.Deny != matches[j].entry.Deny {
+			return matches[i].entry.Deny
+		}
+
+		return matches[i].rule < matches[j].rule
+	})
+
+	return matches
+}
+
+// Explain determines whether or not a client is allowed to perform an action
+// on a topic, and which entry decides
+func (a ACL) Explain(action ACLAction, topic string, qos QoS, clientID, username string) ACLDecision {
+	if action == PublishAction && isReservedTopic(topic) {
+		return ACLDecision{Reason: fmt.Sprintf("%s is reserved", topic)}
+	}
+
+	matches := a.matches(action, topic, clientID, username)
+	if len(matches) == 0 {
+		return ACLDecision{Reason: fmt.Sprintf("no ACL entry allows to %s %s", action, topic)}
+	}
+
+	match := matches[0]
+
+	if match.entry.Deny {
+		return ACLDecision{Rule: match.rule, Reason: fmt.Sprintf("%s is forbidden by %s", action, match.rule)}
+	}
+
+	if qos > match.entry.QoS {
+		return ACLDecision{Rule: match.rule, Reason: fmt.Sprintf("QoS level %d is forbidden by %s", qos, match.rule)}
+	}
+
+	return ACLDecision{Allowed: true, Rule: match.rule, Reason: fmt.Sprintf("%s is allowed by %s", action, match.rule)}
+}
+
+func (a ACL) authenticate(action ACLAction, topic string, qos QoS, clientID, username string) error {
+	if decision := a.Explain(action, topic, qos, clientID, username); !decision.Allowed {
+		return errors.New(decision.Reason)
+	}
+
+	return nil
+}
+
+// AuthenticatePublish determines whether or not a client is allowed to publish
+// a message; reserved topics like $SYS topics are read-only
+func (a ACL) AuthenticatePublish(topic string, qos QoS, clientID, username string) error {
+	return a.authenticate(PublishAction, topic, qos, clientID, username)
+}
+
+// AuthenticateSubscribe determines whether or not a client is allowed to
+// subscribe to a topic filter, or receive a message published to a topic;
+// subscription to reserved topics like $SYS topics requires an entry that
+// starts with $
+func (a ACL) AuthenticateSubscribe(topic string, qos QoS, clientID, username string) error {
+	return a.authenticate(SubscribeAction, topic, qos, clientID, username)
+}
+
+// TTL returns the default TTL of messages published to a topic, or zero if
+// messages published to this topic never expire
+func (a ACL) TTL(topic, clientID, username string) time.Duration {
+	decision := a.Explain(PublishAction, topic, QoS0, clientID, username)
+	if !decision.Allowed {
+		return 0
+	}
+
+	return time.Duration(a[decision.Rule].TTL) * time.Second
+}
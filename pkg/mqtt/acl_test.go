@@ -0,0 +1,158 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACL_Exact(t *testing.T) {
+	acl := ACL{
+		"/a/b": {Publish: true, QoS: QoS1},
+		"/a/c": {Subscribe: true},
+	}
+
+	assert.Nil(t, acl.AuthenticatePublish("/a/b", QoS1, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticatePublish("/a/c", QoS0, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticatePublish("/a/d", QoS0, "abcd", "user1"))
+
+	assert.Nil(t, acl.AuthenticateSubscribe("/a/c", QoS0, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticateSubscribe("/a/c", QoS1, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticateSubscribe("/a/+", QoS0, "abcd", "user1"))
+}
+
+func TestACL_Placeholders(t *testing.T) {
+	acl := ACL{
+		"/%c/commands": {Subscribe: true, QoS: QoS1},
+		"/%c/results":  {Publish: true, QoS: QoS1, TTL: 60},
+		"/users/%u/#":  {Publish: true},
+	}
+
+	assert.Nil(t, acl.AuthenticateSubscribe("/abcd/commands", QoS1, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticateSubscribe("/efgh/commands", QoS1, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticateSubscribe("/+/commands", QoS1, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticateSubscribe("/%c/commands", QoS1, "abcd", "user1"))
+
+	assert.Nil(t, acl.AuthenticatePublish("/abcd/results", QoS1, "abcd", "user1"))
+	assert.Equal(t, time.Minute, acl.TTL("/abcd/results", "abcd", "user1"))
+	assert.Equal(t, time.Duration(0), acl.TTL("/efgh/results", "abcd", "user1"))
+
+	assert.Nil(t, acl.AuthenticatePublish("/users/user1/a/b", QoS0, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticatePublish("/users/user2/a/b", QoS0, "abcd", "user1"))
+
+	// client IDs that contain wildcards or span multiple levels never match
+	assert.NotNil(t, acl.AuthenticateSubscribe("/+/commands", QoS1, "+", "user1"))
+	assert.NotNil(t, acl.AuthenticateSubscribe("/#", QoS1, "#", "user1"))
+	assert.NotNil(t, acl.AuthenticatePublish("/a/b/results", QoS1, "a/b", "user1"))
+	assert.NotNil(t, acl.AuthenticateSubscribe("//commands", QoS1, "", "user1"))
+}
+
+func TestACL_Wildcards(t *testing.T) {
+	acl := ACL{
+		"/lab/#":     {Subscribe: true},
+		"/lab/+/log": {Subscribe: true, QoS: QoS1},
+		"#":          {Publish: true},
+	}
+
+	assert.Nil(t, acl.AuthenticateSubscribe("/lab/a/b", QoS0, "abcd", "user1"))
+	assert.Nil(t, acl.AuthenticateSubscribe("/lab/#", QoS0, "abcd", "user1"))
+	assert.Nil(t, acl.AuthenticateSubscribe("/lab/+/c", QoS0, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticateSubscribe("/#", QoS0, "abcd", "user1"))
+
+	// the most specific pattern wins
+	assert.Nil(t, acl.AuthenticateSubscribe("/lab/a/log", QoS1, "abcd", "user1"))
+	assert.Nil(t, acl.AuthenticateSubscribe("/lab/+/log", QoS1, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticateSubscribe("/lab/#", QoS1, "abcd", "user1"))
+
+	assert.Nil(t, acl.AuthenticatePublish("/a/b", QoS0, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticatePublish("$SYS/broker/uptime", QoS0, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticateSubscribe("$SYS/#", QoS0, "abcd", "user1"))
+}
+
+func TestACL_Deny(t *testing.T) {
+	acl := ACL{
+		"/lab/#":         {Publish: true, Subscribe: true, QoS: QoS1},
+		"/lab/secrets/#": {Deny: true},
+		"/lab/+/log":     {Deny: true, Publish: true},
+		"/lab/a/log":     {Publish: true},
+	}
+
+	assert.Nil(t, acl.AuthenticateSubscribe("/lab/a", QoS1, "abcd", "user1"))
+	assert.Nil(t, acl.AuthenticatePublish("/lab/a", QoS1, "abcd", "user1"))
+
+	assert.NotNil(t, acl.AuthenticateSubscribe("/lab/secrets/a", QoS0, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticatePublish("/lab/secrets/a", QoS0, "abcd", "user1"))
+	assert.NotNil(t, acl.AuthenticateSubscribe("/lab/secrets/#", QoS0, "abcd", "user1"))
+
+	// the deny entry forbids publishing only
+	assert.NotNil(t, acl.AuthenticatePublish("/lab/b/log", QoS0, "abcd", "user1"))
+	assert.Nil(t, acl.AuthenticateSubscribe("/lab/b/log", QoS0, "abcd", "user1"))
+
+	// an exact match is more specific than a deny pattern
+	assert.Nil(t, acl.AuthenticatePublish("/lab/a/log", QoS0, "abcd", "user1"))
+}
+
+func TestACL_DenyPrecedence(t *testing.T) {
+	acl := ACL{
+		"/lab/+/a": {Subscribe: true},
+		"/lab/a/+": {Deny: true},
+	}
+
+	decision := acl.Explain(SubscribeAction, "/lab/a/a", QoS0, "abcd", "user1")
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "/lab/a/+", decision.Rule)
+
+	decision = acl.Explain(SubscribeAction, "/lab/b/a", QoS0, "abcd", "user1")
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, "/lab/+/a", decision.Rule)
+
+	decision = acl.Explain(SubscribeAction, "/lab/b/a", QoS1, "abcd", "user1")
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "/lab/+/a", decision.Rule)
+
+	decision = acl.Explain(PublishAction, "/lab/b/a", QoS0, "abcd", "user1")
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "", decision.Rule)
+}
+
+func TestACL_Validate(t *testing.T) {
+	assert.Nil(t, ACL{}.Validate())
+	assert.Nil(t, ACL{
+		"/%c/commands": {Subscribe: true, QoS: QoS1},
+		"/lab/+/log":   {Publish: true, TTL: 60},
+		"/lab/#":       {Deny: true},
+	}.Validate())
+
+	assert.NotNil(t, ACL{"": {Publish: true}}.Validate())
+	assert.NotNil(t, ACL{"/lab/#/log": {Publish: true}}.Validate())
+	assert.NotNil(t, ACL{"/lab/a+": {Publish: true}}.Validate())
+	assert.NotNil(t, ACL{"/lab": {Publish: true, QoS: 2}}.Validate())
+	assert.NotNil(t, ACL{"/lab": {}}.Validate())
+}
+
+func TestUser_Validate(t *testing.T) {
+	assert.Nil(t, (&User{ACL: ACL{"/a": {Publish: true}}, ClientIDs: []string{"%u-*"}, Roles: []string{"device"}}).Validate())
+
+	assert.NotNil(t, (&User{ACL: ACL{"/a": {}}}).Validate())
+	assert.NotNil(t, (&User{ClientIDs: []string{""}}).Validate())
+	assert.NotNil(t, (&User{Roles: []string{""}}).Validate())
+	assert.NotNil(t, (&User{Limits: QueueLimits{MaxMessages: -1}}).Validate())
+	assert.NotNil(t, (&User{Limits: QueueLimits{Policy: "drop_all"}}).Validate())
+}
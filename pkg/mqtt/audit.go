@@ -0,0 +1,424 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditAction is an action recorded in the audit log
+type AuditAction string
+
+const (
+	// AuditConnect is an attempt to connect
+	AuditConnect AuditAction = "connect"
+
+	// AuditPublish is an attempt to publish a message; only denials are
+	// recorded
+	AuditPublish AuditAction = "publish"
+
+	// AuditSubscribe is an attempt to subscribe to a topic filter
+	AuditSubscribe AuditAction = "subscribe"
+
+	// AuditRefresh is re-authentication of a connected client after its user
+	// has changed
+	AuditRefresh AuditAction = "refresh"
+
+	// AuditRoleSaved is addition or replacement of a role
+	AuditRoleSaved AuditAction = "role_saved"
+
+	// AuditRoleDeleted is removal of a role
+	AuditRoleDeleted AuditAction = "role_deleted"
+
+	// AuditLockoutCleared is removal of failed authentication attempts
+	AuditLockoutCleared AuditAction = "lockout_cleared"
+
+	// AuditUserSaved is addition or replacement of a user
+	AuditUserSaved AuditAction = "user_saved"
+
+	// AuditUserDeleted is removal of a user
+	AuditUserDeleted AuditAction = "user_deleted"
+
+	// AuditEnroll is an attempt to enroll a device
+	AuditEnroll AuditAction = "enroll"
+
+	// AuditRotate is the start of credential rotation
+	AuditRotate AuditAction = "rotate"
+
+	// AuditRotationRedeemed is an attempt of a device to redeem a rotation
+	// nonce for a new password
+	AuditRotationRedeemed AuditAction = "rotation_redeemed"
+
+	// AuditOperatorLogin is an attempt of an operator to log in
+	AuditOperatorLogin AuditAction = "operator_login"
+
+	// AuditOperatorSaved is addition or replacement of an operator
+	AuditOperatorSaved AuditAction = "operator_saved"
+
+	// AuditOperatorDeleted is removal of an operator
+	AuditOperatorDeleted AuditAction = "operator_deleted"
+
+	// AuditAPIKeyCreated is creation of an API key
+	AuditAPIKeyCreated AuditAction = "api_key_created"
+
+	// AuditAPIKeyRevoked is removal of an API key
+	AuditAPIKeyRevoked AuditAction = "api_key_revoked"
+
+	// AuditAdminAccess is an attempt to access the admin API
+	AuditAdminAccess AuditAction = "admin_access"
+)
+
+// AuditEvent records an attempt to perform an action: who (Username and
+// ClientID, or Operator in the admin API), from where (RemoteAddr), what
+// (Action, on Topic or Target), when (Time) and the decision; Count is the
+// number of similar denied attempts an aggregated event stands for
+type AuditEvent struct {
+	Time       time.Time   `json:"time"`
+	Action     AuditAction `json:"action"`
+	Username   string      `json:"username,omitempty"`
+	ClientID   string      `json:"client_id,omitempty"`
+	Operator   string      `json:"operator,omitempty"`
+	RemoteAddr string      `json:"remote_addr,omitempty"`
+	Topic      string      `json:"topic,omitempty"`
+	Target     string      `json:"target,omitempty"`
+	Allowed    bool        `json:"allowed"`
+	Reason     string      `json:"reason,omitempty"`
+	Count      int         `json:"count,omitempty"`
+}
+
+// AuditSink receives audit events
+type AuditSink interface {
+	Record(context.Context, *AuditEvent) error
+}
+
+// AuditFilter selects audit events
+type AuditFilter struct {
+	Username string
+	ClientID string
+	Operator string
+	Action   AuditAction
+	Since    time.Time
+	Until    time.Time
+	Denied   bool
+	Limit    int
+}
+
+const (
+	auditList = "/audit"
+
+	defaultMaxAuditEvents = 10000
+	defaultAuditLimit     = 100
+
+	// defaultAuditTopic is reserved but outside of $SYS, so subscribing to
+	// it requires an ACL entry for this topic
+	defaultAuditTopic = "$audit/events"
+
+	// auditPageSize is the number of events read from the store at once
+	auditPageSize = 100
+
+	// deniedAuditWindow is the interval at which denied attempts of
+	// unauthenticated sources are aggregated
+	deniedAuditWindow = time.Minute
+
+	// maxDeniedAuditKeys limits the number of sources aggregated at once;
+	// beyond it, denied attempts are recorded one by one
+	maxDeniedAuditKeys = 4096
+)
+
+// deniedAuditKey identifies similar denied attempts
+type deniedAuditKey struct {
+	action     AuditAction
+	remoteAddr string
+	reason     string
+}
+
+type storeAuditSink struct {
+	store     store.Store
+	maxEvents int64
+}
+
+type fileAuditSink struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+type mqttAuditSink struct {
+	broker *Broker
+	topic  string
+}
+
+// NewStoreAuditSink returns a new audit sink that keeps the latest events in
+// the store, where ListAuditEvents can find them
+func NewStoreAuditSink(store store.Store, maxEvents int64) AuditSink {
+	return &storeAuditSink{store: store, maxEvents: maxEvents}
+}
+
+func (s *storeAuditSink) Record(ctx context.Context, event *AuditEvent) error {
+	j, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return s.store.List(auditList).Push(ctx, string(j), s.maxEvents)
+}
+
+// NewFileAuditSink returns a new audit sink that appends events to a file, in
+// JSON lines format
+func NewFileAuditSink(path string) (AuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileAuditSink{file: file}, nil
+}
+
+func (s *fileAuditSink) Record(ctx context.Context, event *AuditEvent) error {
+	j, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err = s.file.Write(append(j, '\n'))
+	return err
+}
+
+// NewMQTTAuditSink returns a new audit sink that publishes events to a topic
+func NewMQTTAuditSink(broker *Broker, topic string) AuditSink {
+	return &mqttAuditSink{broker: broker, topic: topic}
+}
+
+func (s *mqttAuditSink) Record(ctx context.Context, event *AuditEvent) error {
+	j, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return s.broker.QueueMessage(s.topic, string(j), 0, QoS0, 0)
+}
+
+// auditSinksFromEnv returns the audit sinks specified by the AUDIT_SINKS
+// environment variable: a comma-separated list of store (the default), file
+// and mqtt, or none; the store sink keeps AUDIT_MAX_EVENTS events, the file
+// sink appends to AUDIT_FILE and the mqtt sink publishes to AUDIT_TOPIC
+func auditSinksFromEnv(b *Broker) ([]AuditSink, error) {
+	names := os.Getenv("AUDIT_SINKS")
+	if names == "" {
+		names = "store"
+	}
+
+	sinks := make([]AuditSink, 0)
+
+	for _, name := range strings.Split(names, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "none":
+
+		case "store":
+			maxEvents := int64(defaultMaxAuditEvents)
+			if s := os.Getenv("AUDIT_MAX_EVENTS"); s != "" {
+				var err error
+				maxEvents, err = strconv.ParseInt(s, 10, 64)
+				if err != nil || maxEvents <= 0 {
+					return nil, fmt.Errorf("Invalid AUDIT_MAX_EVENTS: %s", s)
+				}
+			}
+
+			sinks = append(sinks, NewStoreAuditSink(b.store, maxEvents))
+
+		case "file":
+			path := os.Getenv("AUDIT_FILE")
+			if path == "" {
+				return nil, errors.New("No audit log file")
+			}
+
+			sink, err := NewFileAuditSink(path)
+			if err != nil {
+				return nil, err
+			}
+
+			sinks = append(sinks, sink)
+
+		case "mqtt":
+			topic := os.Getenv("AUDIT_TOPIC")
+			if topic == "" {
+				topic = defaultAuditTopic
+			}
+
+			sinks = append(sinks, NewMQTTAuditSink(b, topic))
+
+		default:
+			return nil, fmt.Errorf("Unknown audit sink: %s", name)
+		}
+	}
+
+	return sinks, nil
+}
+
+// Audit records an event in all audit sinks
+func (b *Broker) Audit(ctx context.Context, event *AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	for _, sink := range b.auditSinks {
+		if err := sink.Record(ctx, event); err != nil {
+			log.WithError(err).Warn("Failed to record an audit event")
+		}
+	}
+}
+
+// AuditUnauthenticated records an attempt of an unauthenticated source; the
+// first denied attempt is recorded immediately, while similar attempts from the
+// same address are aggregated into one event per deniedAuditWindow, so a flood
+// of attempts doesn't flood the audit log
+func (b *Broker) AuditUnauthenticated(ctx context.Context, event *AuditEvent) {
+	if event.Allowed {
+		b.Audit(ctx, event)
+		return
+	}
+
+	key := deniedAuditKey{action: event.Action, remoteAddr: event.RemoteAddr, reason: event.Reason}
+
+	b.deniedAuditLock.Lock()
+	if pending, ok := b.deniedAudit[key]; ok {
+		pending.Count++
+		b.deniedAuditLock.Unlock()
+		return
+	}
+
+	if len(b.deniedAudit) < maxDeniedAuditKeys {
+		b.deniedAudit[key] = &AuditEvent{
+			Action:     event.Action,
+			RemoteAddr: event.RemoteAddr,
+			Reason:     event.Reason,
+		}
+	}
+	b.deniedAuditLock.Unlock()
+
+	b.Audit(ctx, event)
+}
+
+// flushDeniedAuditEvents periodically records aggregated denied attempts
+func (b *Broker) flushDeniedAuditEvents(ctx context.Context) {
+	ticker := time.NewTicker(deniedAuditWindow)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			b.flushDeniedAudit(ctx)
+		}
+	}
+}
+
+func (b *Broker) flushDeniedAudit(ctx context.Context) {
+	b.deniedAuditLock.Lock()
+	pending := b.deniedAudit
+	b.deniedAudit = make(map[deniedAuditKey]*AuditEvent)
+	b.deniedAuditLock.Unlock()
+
+	for _, event := range pending {
+		if event.Count > 0 {
+			b.Audit(ctx, event)
+		}
+	}
+}
+
+// audit records an action of a client, which is denied if err is not nil
+func (c *Client) audit(action AuditAction, topic string, err error) {
+	event := AuditEvent{
+		Action:     action,
+		Username:   c.username,
+		ClientID:   c.clientID,
+		RemoteAddr: c.remoteAddr,
+		Topic:      topic,
+		Allowed:    err == nil,
+	}
+	if err != nil {
+		event.Reason = err.Error()
+	}
+
+	c.broker.Audit(c.ctx, &event)
+}
+
+func (f *AuditFilter) match(event *AuditEvent) bool {
+	return (f.Username == "" || event.Username == f.Username) &&
+		(f.ClientID == "" || event.ClientID == f.ClientID) &&
+		(f.Operator == "" || event.Operator == f.Operator) &&
+		(f.Action == "" || event.Action == f.Action) &&
+		(f.Since.IsZero() || !event.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || event.Time.Before(f.Until)) &&
+		(!f.Denied || !event.Allowed)
+}
+
+// ListAuditEvents returns the latest events kept in the store that match a
+// filter, newest first
+func ListAuditEvents(ctx context.Context, s store.Store, filter *AuditFilter) ([]*AuditEvent, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+
+	events := make([]*AuditEvent, 0)
+
+	for start := int64(0); len(events) < limit; start += auditPageSize {
+		values, err := s.List(auditList).Range(ctx, start, start+auditPageSize-1)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range values {
+			var event AuditEvent
+			if err := json.Unmarshal([]byte(v), &event); err != nil {
+				log.WithError(err).Warn("Failed to decode an audit event")
+				continue
+			}
+
+			if !filter.match(&event) {
+				continue
+			}
+
+			events = append(events, &event)
+			if len(events) == limit {
+				break
+			}
+		}
+
+		if len(values) < auditPageSize {
+			break
+		}
+	}
+
+	return events, nil
+}
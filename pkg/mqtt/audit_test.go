@@ -0,0 +1,236 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAudit_Connect(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a plaintext password would be upgraded, which triggers a refresh
+	hash, err := HashPassword("password1", DefaultPasswordAlgorithm)
+	assert.Nil(t, err)
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: hash, ACL: ACL{"/%c/commands": {Subscribe: true}}}))
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	c := connectTestClient(t, broker, "abcd", "user1", "password1")
+	defer c.Close()
+
+	assert.Nil(t, c.authenticateSubscribe("/abcd/commands", QoS0))
+	assert.NotNil(t, c.authenticateSubscribe("/efgh/commands", QoS0))
+	assert.NotNil(t, c.authenticatePublish("/abcd/commands", QoS0))
+
+	conn, peer := net.Pipe()
+	go io.Copy(ioutil.Discard, peer)
+
+	other, err := broker.NewClient(conn)
+	assert.Nil(t, err)
+	assert.NotNil(t, other.handleConnect("efgh", "user1", "password2"))
+
+	events, err := ListAuditEvents(ctx, s, &AuditFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(events))
+
+	// newest first
+	assert.Equal(t, AuditConnect, events[0].Action)
+	assert.Equal(t, "efgh", events[0].ClientID)
+	assert.False(t, events[0].Allowed)
+	assert.Equal(t, ErrBadCredentials.Error(), events[0].Reason)
+
+	assert.Equal(t, AuditPublish, events[1].Action)
+	assert.Equal(t, "/abcd/commands", events[1].Topic)
+	assert.False(t, events[1].Allowed)
+
+	assert.Equal(t, AuditConnect, events[4].Action)
+	assert.Equal(t, "user1", events[4].Username)
+	assert.Equal(t, "abcd", events[4].ClientID)
+	assert.Equal(t, "pipe", events[4].RemoteAddr)
+	assert.True(t, events[4].Allowed)
+
+	events, err = ListAuditEvents(ctx, s, &AuditFilter{Action: AuditSubscribe})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+
+	events, err = ListAuditEvents(ctx, s, &AuditFilter{ClientID: "abcd", Denied: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+
+	events, err = ListAuditEvents(ctx, s, &AuditFilter{Limit: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+
+	events, err = ListAuditEvents(ctx, s, &AuditFilter{Since: time.Now()})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(events))
+}
+
+func TestStoreAuditSink_Capped(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := NewStoreAuditSink(s, 3)
+	for _, clientID := range []string{"a", "b", "c", "d"} {
+		assert.Nil(t, sink.Record(ctx, &AuditEvent{Action: AuditConnect, ClientID: clientID}))
+	}
+
+	events, err := ListAuditEvents(ctx, s, &AuditFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, "d", events[0].ClientID)
+	assert.Equal(t, "b", events[2].ClientID)
+}
+
+func TestListAuditEvents_Pages(t *testing.T) {
+	s := store.NewMemoryStore()
+	ctx := context.Background()
+
+	sink := NewStoreAuditSink(s, defaultMaxAuditEvents)
+	for i := 0; i < auditPageSize*2+10; i++ {
+		action := AuditConnect
+		if i%2 == 0 {
+			action = AuditPublish
+		}
+		assert.Nil(t, sink.Record(ctx, &AuditEvent{Action: action, ClientID: fmt.Sprintf("%d", i)}))
+	}
+
+	events, err := ListAuditEvents(ctx, s, &AuditFilter{Action: AuditPublish, Limit: auditPageSize * 2})
+	assert.Nil(t, err)
+	assert.Equal(t, auditPageSize+5, len(events))
+	assert.Equal(t, fmt.Sprintf("%d", auditPageSize*2+8), events[0].ClientID)
+	assert.Equal(t, "0", events[len(events)-1].ClientID)
+
+	events, err = ListAuditEvents(ctx, s, &AuditFilter{Limit: auditPageSize + 1})
+	assert.Nil(t, err)
+	assert.Equal(t, auditPageSize+1, len(events))
+}
+
+func TestAuditUnauthenticated(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		broker.AuditUnauthenticated(ctx, &AuditEvent{Action: AuditEnroll, RemoteAddr: "10.0.0.1", Reason: "invalid enrollment token"})
+	}
+	broker.AuditUnauthenticated(ctx, &AuditEvent{Action: AuditEnroll, RemoteAddr: "10.0.0.2", Reason: "invalid enrollment token"})
+	broker.AuditUnauthenticated(ctx, &AuditEvent{Action: AuditEnroll, RemoteAddr: "10.0.0.1", Allowed: true})
+
+	// only the first denied attempt of each address is recorded immediately
+	events, err := ListAuditEvents(ctx, s, &AuditFilter{Denied: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+
+	broker.flushDeniedAudit(ctx)
+
+	events, err = ListAuditEvents(ctx, s, &AuditFilter{Denied: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, "10.0.0.1", events[0].RemoteAddr)
+	assert.Equal(t, 9, events[0].Count)
+
+	events, err = ListAuditEvents(ctx, s, &AuditFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(events))
+}
+
+func TestFileAuditSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.jsonl")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink, err := NewFileAuditSink(path)
+	assert.Nil(t, err)
+
+	assert.Nil(t, sink.Record(ctx, &AuditEvent{Action: AuditConnect, ClientID: "a", Allowed: true}))
+	assert.Nil(t, sink.Record(ctx, &AuditEvent{Action: AuditPublish, ClientID: "a", Topic: "/b"}))
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	events := make([]AuditEvent, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event AuditEvent
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, AuditConnect, events[0].Action)
+	assert.Equal(t, "/b", events[1].Topic)
+}
+
+func TestMQTTAuditSink(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	sink := NewMQTTAuditSink(broker, defaultAuditTopic)
+	assert.Nil(t, sink.Record(ctx, &AuditEvent{Action: AuditConnect, ClientID: "a"}))
+
+	queuedMessage, err := broker.PopQueuedMessage(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultAuditTopic, queuedMessage.Topic)
+
+	var event AuditEvent
+	assert.Nil(t, json.Unmarshal([]byte(queuedMessage.Message), &event))
+	assert.Equal(t, "a", event.ClientID)
+
+	// the default topic is not covered by typical entries for $SYS topics
+	acl := ACL{"#": {Subscribe: true}, "$SYS/#": {Subscribe: true}}
+	assert.NotNil(t, acl.AuthenticateSubscribe(defaultAuditTopic, QoS0, "a", "a"))
+	assert.NotNil(t, acl.AuthenticatePublish(defaultAuditTopic, QoS0, "a", "a"))
+
+	acl = ACL{defaultAuditTopic: {Subscribe: true}}
+	assert.Nil(t, acl.AuthenticateSubscribe(defaultAuditTopic, QoS0, "a", "a"))
+}
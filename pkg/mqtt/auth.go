@@ -18,12 +18,17 @@ package mqtt
 
 import (
 	"context"
-	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/dimkr/yodi/pkg/env"
 	"github.com/dimkr/yodi/pkg/store"
+	log "github.com/sirupsen/logrus"
 )
 
 type authenticator struct {
@@ -35,84 +40,395 @@ type Authenticator interface {
 	AuthenticateUser(ctx context.Context, username, password string) (*User, error)
 }
 
-// ACL defines permissions and allowed QoS levels for topics
-type ACL map[string]struct {
-	Publish   bool `json:"publish,omitempty"`
-	Subscribe bool `json:"subscribe,omitempty"`
-	QoS       QoS  `json:"qos,omitempty"`
+// User defines MQTT client credentials, the client IDs it may connect with,
+// permissions, roles that grant it more permissions and message queue limits;
+// the password is either hashed using HashPassword, or plaintext, which is
+// replaced with a hash after the first successful authentication
+//
+// During credential rotation, NextPassword is the hash of the new password,
+// which replaces the current one after the first successful authentication
+// with it; the current one is accepted until then, but not after
+// RotationDeadline unless KeepOldPassword is set
+//
+// Authenticators attach a function that authenticates a connected client again
+// after its user has changed, without keeping its password
+type User struct {
+	ACL              ACL         `json:"acl"`
+	Roles            []string    `json:"roles,omitempty"`
+	Password         string      `json:"password"`
+	NextPassword     string      `json:"next_password,omitempty"`
+	RotationDeadline *time.Time  `json:"rotation_deadline,omitempty"`
+	KeepOldPassword  bool        `json:"keep_old_password,omitempty"`
+	ClientIDs        []string    `json:"client_ids,omitempty"`
+	Limits           QueueLimits `json:"limits,omitempty"`
+	refresh          func(context.Context) (*User, error)
 }
 
-// User defines MQTT client credentials and permissions
-type User struct {
-	ACL      ACL    `json:"acl"`
-	Password string `json:"password"`
+// ConnectInfo describes the connection of a client that authenticates
+type ConnectInfo struct {
+	ClientID   string
+	RemoteAddr string
 }
 
-const usersMap = "/users"
+type connectInfoKey struct{}
+
+const (
+	usersMap     = "/users"
+	usersChannel = "/users/changes"
+)
 
 // ErrBadCredentials indicates authentication failure
 var ErrBadCredentials = errors.New("bad credentials")
 
-// AuthenticatePublish determines whether or not a client is allowed to publish
-// a message
-func (a ACL) AuthenticatePublish(topic string, qos QoS) error {
-	topicACL, ok := a[topic]
-	if !ok {
-		return errors.New("no ACL For topic")
+// ErrAuthUnavailable indicates that credentials cannot be checked, because the
+// authentication backend is unavailable; unlike ErrBadCredentials, it's not
+// counted as a failed attempt and it's not cached
+var ErrAuthUnavailable = errors.New("authentication is unavailable")
+
+// Validate determines whether or not a user is valid
+func (u *User) Validate() error {
+	if err := u.ACL.Validate(); err != nil {
+		return fmt.Errorf("invalid ACL: %w", err)
 	}
 
-	if !topicACL.Publish {
-		return errors.New("publishing is forbidden")
+	if err := u.Limits.Validate(); err != nil {
+		return fmt.Errorf("invalid limits: %w", err)
 	}
 
-	if qos > topicACL.QoS {
-		return fmt.Errorf("QoS level for %s is forbidden", topic)
+	for _, pattern := range u.ClientIDs {
+		if pattern == "" {
+			return errors.New("empty client ID")
+		}
+	}
+
+	for _, role := range u.Roles {
+		if role == "" {
+			return errors.New("empty role")
+		}
 	}
 
 	return nil
 }
 
-// AuthenticateSubscribe determines whether or not a client is allowed to
-// subscribe to a topic
-func (a ACL) AuthenticateSubscribe(topic string, qos QoS) error {
-	topicACL, ok := a[topic]
-	if !ok {
-		return errors.New("no ACL For topic")
+// WithConnectInfo returns a copy of a context that carries information about
+// the connection of a client, which is passed to an Authenticator
+func WithConnectInfo(ctx context.Context, info ConnectInfo) context.Context {
+	return context.WithValue(ctx, connectInfoKey{}, info)
+}
+
+// ConnectInfoFromContext returns the connection information carried by a
+// context, or an empty ConnectInfo
+func ConnectInfoFromContext(ctx context.Context) ConnectInfo {
+	info, _ := ctx.Value(connectInfoKey{}).(ConnectInfo)
+	return info
+}
+
+// remoteHost returns the address of a client without its port, which changes
+// when it reconnects
+func remoteHost(info ConnectInfo) string {
+	if host, _, err := net.SplitHostPort(info.RemoteAddr); err == nil {
+		return host
 	}
 
-	if !topicACL.Subscribe {
-		return errors.New("subscription is forbidden")
+	return info.RemoteAddr
+}
+
+// LoadUser returns a user from the user store
+func LoadUser(ctx context.Context, s store.Store, username string) (*User, error) {
+	j, err := s.Map(usersMap).Get(ctx, username)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find user '%s': %w", username, err)
 	}
 
-	if qos > topicACL.QoS {
-		return fmt.Errorf("QoS level for %s is forbidden", topic)
+	var user User
+	if err := json.Unmarshal([]byte(j), &user); err != nil {
+		return nil, fmt.Errorf("Failed to find user '%s': %w", username, err)
 	}
 
-	return nil
+	return &user, nil
+}
+
+// ListUsers returns all users in the user store
+func ListUsers(ctx context.Context, s store.Store) (map[string]*User, error) {
+	users := make(map[string]*User)
+
+	if err := s.Map(usersMap).Scan(ctx, func(ctx context.Context, k, v string) {
+		var user User
+		if err := json.Unmarshal([]byte(v), &user); err != nil {
+			log.WithFields(log.Fields{"username": k}).WithError(err).Warn("Failed to decode a user")
+			return
+		}
+
+		users[k] = &user
+	}); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// SaveUser adds or replaces a user in the user store
+func SaveUser(ctx context.Context, s store.Store, username string, user *User) error {
+	j, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Map(usersMap).Set(ctx, username, string(j)); err != nil {
+		return err
+	}
+
+	return NotifyUserChanged(ctx, s, username)
+}
+
+// DeleteUser removes a user from the user store
+func DeleteUser(ctx context.Context, s store.Store, username string) error {
+	if err := s.Map(usersMap).Remove(ctx, username); err != nil {
+		return err
+	}
+
+	return NotifyUserChanged(ctx, s, username)
+}
+
+// NotifyUserChanged notifies all brokers that a user has changed, or that all
+// users have changed if username is empty; this is required after changes
+// made directly in the user store, to invalidate cached authentication results
+func NotifyUserChanged(ctx context.Context, s store.Store, username string) error {
+	return s.Channel(usersChannel).Publish(ctx, username)
+}
+
+// WatchUsers returns the names of changed users, or an empty string when all
+// users have changed or when changes were missed
+func WatchUsers(ctx context.Context, s store.Store) (<-chan string, error) {
+	return s.Channel(usersChannel).Subscribe(ctx)
 }
 
 func (a *authenticator) AuthenticateUser(ctx context.Context, username, password string) (*User, error) {
-	j, err := a.store.Map(usersMap).Get(ctx, username)
+	user, err := LoadUser(ctx, a.store, username)
 	if err != nil {
 		if errors.Is(err, store.ErrNoKey) {
 			return nil, ErrBadCredentials
 		}
-		return nil, fmt.Errorf("Failed to find user '%s': %w", username, err)
+		return nil, err
 	}
 
-	var user User
-	if err := json.Unmarshal([]byte(j), &user); err != nil {
-		return nil, fmt.Errorf("Failed to find user '%s': %w", username, err)
+	if user.NextPassword != "" {
+		ok, err := VerifyPassword(user.NextPassword, password)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to verify the next password of '%s': %w", username, err)
+		}
+		if ok {
+			// completeRotation replaces the current password with this one
+			next := user.NextPassword
+			a.completeRotation(ctx, username, user)
+			user.refresh = a.refresher(username, next)
+			return ResolveRoles(ctx, a.store, user)
+		}
 	}
 
-	if subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+	if user.passwordRetired(time.Now()) {
 		return nil, ErrBadCredentials
 	}
 
-	return &user, nil
+	ok, err := VerifyPassword(user.Password, password)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to verify the password of '%s': %w", username, err)
+	}
+	if !ok {
+		return nil, ErrBadCredentials
+	}
+
+	hash := user.Password
+	if passwordAlgorithm(user.Password) == "" {
+		hash = a.upgradePassword(ctx, username, user, password)
+	}
+
+	user.refresh = a.refresher(username, hash)
+	return ResolveRoles(ctx, a.store, user)
+}
+
+// passwordRetired determines whether or not the current password of a user is
+// no longer accepted, because the deadline of credential rotation has passed
+func (u *User) passwordRetired(now time.Time) bool {
+	return u.RotationDeadline != nil && !u.KeepOldPassword && now.After(*u.RotationDeadline)
+}
+
+// matchesPassword determines whether or not a stored password is the one a
+// client has authenticated with, given the stored password it matched
+func matchesPassword(stored, matched string) bool {
+	if stored == "" {
+		return false
+	}
+
+	if stored == matched {
+		return true
+	}
+
+	// the password may have been saved again in plaintext, after it was
+	// replaced with a hash
+	if passwordAlgorithm(stored) == "" {
+		ok, err := VerifyPassword(matched, stored)
+		return err == nil && ok
+	}
+
+	return false
+}
+
+// refresher returns a function that authenticates a connected client again,
+// by checking that its user still has the password it matched, which is
+// usually a hash
+func (a *authenticator) refresher(username, matched string) func(context.Context) (*User, error) {
+	return func(ctx context.Context) (*User, error) {
+		user, err := LoadUser(ctx, a.store, username)
+		if err != nil {
+			if errors.Is(err, store.ErrNoKey) {
+				return nil, ErrBadCredentials
+			}
+			return nil, err
+		}
+
+		if !matchesPassword(user.NextPassword, matched) && (user.passwordRetired(time.Now()) || !matchesPassword(user.Password, matched)) {
+			return nil, ErrBadCredentials
+		}
+
+		user.refresh = a.refresher(username, matched)
+		return ResolveRoles(ctx, a.store, user)
+	}
+}
+
+// upgradePassword replaces a plaintext password with a hash, and returns the
+// stored password; the hash is saved only if the password hasn't changed since
+// it was verified
+func (a *authenticator) upgradePassword(ctx context.Context, username string, user *User, password string) string {
+	hash, err := HashPassword(password, DefaultPasswordAlgorithm)
+	if err != nil {
+		log.WithError(err).Warn("Failed to hash a password")
+		return user.Password
+	}
+
+	upgraded := false
+	if err := a.store.Transaction(ctx, []string{usersMap}, func(ctx context.Context, tx store.Tx) error {
+		storedUser, err := LoadUser(ctx, a.store, username)
+		if err != nil {
+			return err
+		}
+
+		if storedUser.Password != user.Password {
+			return nil
+		}
+
+		storedUser.Password = hash
+
+		j, err := json.Marshal(storedUser)
+		if err != nil {
+			return err
+		}
+
+		tx.MapSet(usersMap, username, string(j))
+		upgraded = true
+		return nil
+	}); err != nil {
+		log.WithError(err).Warn("Failed to upgrade a password")
+		return user.Password
+	}
+
+	if !upgraded {
+		// the password has changed, and it's upgraded by the next
+		// authentication if it's still plaintext
+		return user.Password
+	}
+
+	if err := NotifyUserChanged(ctx, a.store, username); err != nil {
+		log.WithFields(log.Fields{"username": username}).WithError(err).Warn("Failed to notify about an upgraded password")
+	}
+
+	log.WithFields(log.Fields{"username": username}).Info("Upgraded a plaintext password")
+	return hash
 }
 
 // NewAuthenticator returns a new authenticator
 func NewAuthenticator(store store.Store) Authenticator {
 	return &authenticator{store: store}
 }
+
+func authenticatorFromName(store store.Store, name string) (Authenticator, error) {
+	switch name {
+	case "users":
+		return NewAuthenticator(store), nil
+
+	case "jwt":
+		config, err := JWTConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+
+		return NewJWTAuthenticator(store, *config), nil
+
+	case "webhook":
+		config, err := WebhookConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+
+		return NewWebhookAuthenticator(store, *config), nil
+
+	default:
+		return nil, fmt.Errorf("Unknown authenticator: %s", name)
+	}
+}
+
+// AuthenticatorFromEnv returns the authenticator specified by the AUTHENTICATOR
+// environment variable: a comma-separated list of authenticators to try in
+// order, out of users (the default), jwt and webhook; results are cached for
+// AUTH_CACHE_TTL seconds if successful, or AUTH_CACHE_NEGATIVE_TTL seconds if
+// not, and successful results are reused for AUTH_CACHE_MAX_STALENESS more
+// seconds while an authenticator is unavailable (by default, clients are
+// rejected); users and addresses are locked out after repeated failed attempts
+func AuthenticatorFromEnv(ctx context.Context, store store.Store) (Authenticator, error) {
+	names := os.Getenv("AUTHENTICATOR")
+	if names == "" {
+		names = "users"
+	}
+
+	authenticators := make([]Authenticator, 0)
+	for _, name := range strings.Split(names, ",") {
+		auth, err := authenticatorFromName(store, strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+
+		authenticators = append(authenticators, auth)
+	}
+
+	auth := authenticators[0]
+	if len(authenticators) > 1 {
+		auth = NewChainAuthenticator(authenticators...)
+	}
+
+	var config AuthCacheConfig
+	var err error
+
+	config.TTL, err = env.Seconds("AUTH_CACHE_TTL", defaultAuthCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	config.NegativeTTL, err = env.Seconds("AUTH_CACHE_NEGATIVE_TTL", defaultAuthCacheNegativeTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	config.MaxStaleness, err = env.Seconds("AUTH_CACHE_MAX_STALENESS", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.TTL > 0 || config.NegativeTTL > 0 {
+		auth, err = NewCachingAuthenticator(ctx, store, auth, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewLockoutAuthenticator(store, auth), nil
+}
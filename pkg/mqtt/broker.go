@@ -19,9 +19,13 @@ package mqtt
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"math"
 	"net"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/dimkr/yodi/pkg/store"
@@ -30,9 +34,21 @@ import (
 
 // Broker is an MQTT broker
 type Broker struct {
-	store store.Store
-	ctx   context.Context
-	auth  Authenticator
+	store                      store.Store
+	ctx                        context.Context
+	auth                       Authenticator
+	sharedSubscriptionStrategy SharedSubscriptionStrategy
+	id                         string
+	startTime                  time.Time
+	metrics                    *expvar.Map
+	flushedMetricsLock         sync.Mutex
+	flushedMetrics             map[string]int64
+	connectedLock              sync.Mutex
+	connected                  map[string]map[*Client]struct{}
+	auditSinks                 []AuditSink
+	deniedAuditLock            sync.Mutex
+	deniedAudit                map[deniedAuditKey]*AuditEvent
+	deadLetterLimits           deadLetterLimits
 }
 
 const (
@@ -42,11 +58,48 @@ const (
 	clientSubscriptionsSetFmt    = "/client/%s/subscriptions"
 	clientMessageQueueFmt        = "/client/%s/messages"
 	clientMessageNotificationFmt = "/client/%s/notify"
+	wildcardFiltersSet           = "/filters"
 )
 
 // NewBroker creates a new MQTT broker
 func NewBroker(ctx context.Context, store store.Store, auth Authenticator) (*Broker, error) {
-	return &Broker{store: store, ctx: ctx, auth: auth}, nil
+	changes, err := WatchUsers(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Broker{
+		store:                      store,
+		ctx:                        ctx,
+		auth:                       auth,
+		sharedSubscriptionStrategy: getSharedSubscriptionStrategy(),
+		id:                         id,
+		startTime:                  time.Now(),
+		metrics:                    new(expvar.Map).Init(),
+		flushedMetrics:             make(map[string]int64),
+		connected:                  make(map[string]map[*Client]struct{}),
+		deniedAudit:                make(map[deniedAuditKey]*AuditEvent),
+	}
+
+	b.auditSinks, err = auditSinksFromEnv(b)
+	if err != nil {
+		return nil, err
+	}
+
+	b.deadLetterLimits, err = deadLetterLimitsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	go b.watchUsers(changes)
+	go b.flushDeniedAuditEvents(ctx)
+
+	return b, nil
 }
 
 // NewClient creates a new MQTT client connected to a broker
@@ -54,62 +107,327 @@ func (b *Broker) NewClient(conn net.Conn) (*Client, error) {
 	return NewClient(b.ctx, conn, b)
 }
 
-// AddClient registers an authenticated MQTT client
+// AddClient registers an authenticated MQTT client; if the client is
+// registered already but its session has expired, it's replaced
 func (b *Broker) AddClient(ctx context.Context, clientID string) error {
-	return b.store.Set(clientSet).Add(ctx, clientID)
+	if err := b.store.Set(clientSet).Add(ctx, clientID); err != nil {
+		stale, staleErr := b.isStaleClient(ctx, clientID)
+		if staleErr != nil || !stale {
+			return err
+		}
+
+		log.WithFields(log.Fields{"client_id": clientID}).Warn("Replacing a stale client")
+
+		if err := b.RemoveClient(clientID); err != nil {
+			return err
+		}
+
+		if err := b.store.Set(clientSet).Add(ctx, clientID); err != nil {
+			return err
+		}
+	}
+
+	return b.touchClient(ctx, clientID)
 }
 
-// RemoveClient unregisters an authenticated MQTT client
+// RemoveClient unregisters an authenticated MQTT client; its subscriptions and
+// message queue are removed atomically, then its unacked messages are
+// redistributed to other members of shared subscription groups or moved to
+// the dead letter queue
 func (b *Broker) RemoveClient(clientID string) error {
-	topics, err := b.store.Set(fmt.Sprintf(clientSubscriptionsSetFmt, clientID)).Members(b.ctx)
+	subscriptions := fmt.Sprintf(clientSubscriptionsSetFmt, clientID)
+	messages := fmt.Sprintf(clientMessageQueueFmt, clientID)
+
+	var topics []string
+	var unacked []*QueuedMessage
+
+	// the keys to watch depend on the subscriptions, which may change
+	// before they're watched
+	watchedTopics, err := b.store.Set(subscriptions).Members(b.ctx)
 	if err != nil {
 		return err
 	}
 
-	for _, topic := range topics {
-		b.store.Set(fmt.Sprintf(topicSubscribersSetFmt, topic)).Remove(b.ctx, clientID)
+	for {
+		watch := append([]string{subscriptions, messages}, unsubscribeWatchKeys(watchedTopics)...)
+
+		err := b.store.Transaction(b.ctx, watch, func(ctx context.Context, tx store.Tx) error {
+			var err error
+			topics, err = b.store.Set(subscriptions).Members(ctx)
+			if err != nil {
+				return err
+			}
+
+			if !sameTopics(topics, watchedTopics) {
+				watchedTopics = topics
+				return errSubscriptionsChanged
+			}
+
+			unacked = make([]*QueuedMessage, 0)
+			// messages with QoS 0 that were not delivered are dropped
+			if err := b.ScanQueuedMessagesForClient(ctx, clientID, func(queuedMessage *QueuedMessage) {
+				if queuedMessage.QoS != QoS0 {
+					unacked = append(unacked, queuedMessage)
+				}
+			}); err != nil {
+				return err
+			}
+
+			if err := b.unsubscribe(ctx, tx, clientID, topics); err != nil {
+				return err
+			}
+
+			tx.Destroy(subscriptions)
+			tx.Destroy(messages)
+			tx.Destroy(fmt.Sprintf(clientMessageNotificationFmt, clientID))
+			tx.Destroy(fmt.Sprintf(clientUsageMapFmt, clientID))
+			tx.Destroy(fmt.Sprintf(clientSessionMapFmt, clientID))
+			tx.MapRemove(clientLimitsMap, clientID)
+			tx.SetRemove(clientSet, clientID)
+
+			return nil
+		})
+		if errors.Is(err, errSubscriptionsChanged) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		break
 	}
 
-	if err := b.store.Set(fmt.Sprintf(clientSubscriptionsSetFmt, clientID)).Destroy(b.ctx); err != nil {
-		return err
+	b.countSubscriptions(b.ctx, -int64(len(topics)))
+
+	for _, queuedMessage := range unacked {
+		if queuedMessage.Shared != "" && b.redistributeMessage(b.ctx, queuedMessage) == nil {
+			continue
+		}
+
+		if err := b.deadLetter(b.ctx, clientID, queuedMessage, DeadLetterSessionExpired); err != nil {
+			log.WithFields(queuedMessage.LogFields()).WithFields(log.Fields{"client_id": clientID}).WithError(err).Warn("Failed to move a message to the dead letter queue")
+			b.count(metricDeadLettersFailed, 1)
+		}
 	}
 
-	if err := b.store.Map(fmt.Sprintf(clientMessageQueueFmt, clientID)).Destroy(b.ctx); err != nil {
-		return err
+	return nil
+}
+
+// isSubscribed determines whether or not a client is subscribed to a topic
+func (b *Broker) isSubscribed(ctx context.Context, clientID, topic string) (bool, error) {
+	topics, err := b.store.Set(fmt.Sprintf(clientSubscriptionsSetFmt, clientID)).Members(ctx)
+	if err != nil {
+		return false, err
 	}
 
-	if err := b.store.Queue(fmt.Sprintf(clientMessageNotificationFmt, clientID)).Destroy(b.ctx); err != nil {
-		return err
+	for _, subscribedTopic := range topics {
+		if subscribedTopic == topic {
+			return true, nil
+		}
 	}
 
-	if err := b.store.Set(clientSet).Remove(b.ctx, clientID); err != nil {
+	return false, nil
+}
+
+// Subscribe subscribes an MQTT client to a topic, or to a shared subscription
+// group if the topic is of the form $share/<group>/<filter>
+func (b *Broker) Subscribe(ctx context.Context, clientID, topic string) error {
+	subscriptions := fmt.Sprintf(clientSubscriptionsSetFmt, clientID)
+
+	if err := b.store.Transaction(ctx, []string{subscriptions}, func(ctx context.Context, tx store.Tx) error {
+		subscribed, err := b.isSubscribed(ctx, clientID, topic)
+		if err != nil {
+			return err
+		}
+
+		if subscribed {
+			return fmt.Errorf("already subscribed to %s", topic)
+		}
+
+		tx.SetAdd(subscriptions, topic)
+		tx.SetAdd(subscribersSetKey(topic), clientID)
+
+		filter := topic
+		if group, sharedFilter, ok := parseSharedSubscription(topic); ok {
+			filter = sharedFilter
+
+			// the group may exist already
+			tx.SetAdd(fmt.Sprintf(topicGroupsSetFmt, filter), group)
+		}
+
+		if isWildcardFilter(filter) {
+			// other clients may be subscribed to this filter already
+			tx.SetAdd(wildcardFiltersSet, filter)
+		}
+
+		return nil
+	}); err != nil {
 		return err
 	}
 
+	b.countSubscriptions(ctx, 1)
+
 	return nil
 }
 
-// Subscribe subscribes an MQTT client to a topic
-func (b *Broker) Subscribe(ctx context.Context, clientID, topic string) error {
-	if err := b.store.Set(fmt.Sprintf(clientSubscriptionsSetFmt, clientID)).Add(ctx, topic); err != nil {
+// Unsubscribe unsubscribes an MQTT client from a topic
+func (b *Broker) Unsubscribe(ctx context.Context, clientID, topic string) error {
+	subscriptions := fmt.Sprintf(clientSubscriptionsSetFmt, clientID)
+	watch := append([]string{subscriptions}, unsubscribeWatchKeys([]string{topic})...)
+
+	if err := b.store.Transaction(ctx, watch, func(ctx context.Context, tx store.Tx) error {
+		subscribed, err := b.isSubscribed(ctx, clientID, topic)
+		if err != nil {
+			return err
+		}
+
+		if !subscribed {
+			return fmt.Errorf("not subscribed to %s", topic)
+		}
+
+		tx.SetRemove(subscriptions, topic)
+
+		return b.unsubscribe(ctx, tx, clientID, []string{topic})
+	}); err != nil {
 		return err
 	}
 
-	err := b.store.Set(fmt.Sprintf(topicSubscribersSetFmt, topic)).Add(ctx, clientID)
+	b.countSubscriptions(ctx, -1)
+
+	return nil
+}
+
+// errSubscriptionsChanged is returned when the subscriptions of a client
+// change while it's removed
+var errSubscriptionsChanged = errors.New("subscriptions changed")
+
+func sameTopics(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// unsubscribeWatchKeys returns the keys that determine whether or not shared
+// subscription groups and wildcard filters are left without subscribers, when
+// a client unsubscribes from topics
+func unsubscribeWatchKeys(topics []string) []string {
+	keys := make([]string, 0, len(topics)*3)
+
+	for _, topic := range topics {
+		keys = append(keys, subscribersSetKey(topic))
+
+		filter := topic
+		if _, sharedFilter, ok := parseSharedSubscription(topic); ok {
+			filter = sharedFilter
+		}
+
+		if isWildcardFilter(filter) {
+			keys = append(keys, fmt.Sprintf(topicSubscribersSetFmt, filter), fmt.Sprintf(topicGroupsSetFmt, filter))
+		}
+	}
+
+	return keys
+}
+
+// hasOtherMembers determines whether or not a set has members other than the
+// excluded ones
+func (b *Broker) hasOtherMembers(ctx context.Context, key string, excluded map[string]struct{}) (bool, error) {
+	members, err := b.store.Set(key).Members(ctx)
 	if err != nil {
-		b.store.Set(fmt.Sprintf(clientSubscriptionsSetFmt, clientID)).Remove(ctx, topic)
+		return false, err
 	}
 
-	return err
+	for _, member := range members {
+		if _, ok := excluded[member]; !ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
-// Unsubscribe unsubscribes an MQTT client from a topic
-func (b *Broker) Unsubscribe(ctx context.Context, clientID, topic string) error {
-	if err := b.store.Set(fmt.Sprintf(topicSubscribersSetFmt, topic)).Remove(ctx, clientID); err != nil {
-		return err
+// unsubscribe queues the removal of a client from the subscribers of topics,
+// and the removal of shared subscription groups and wildcard filters left
+// without subscribers
+func (b *Broker) unsubscribe(ctx context.Context, tx store.Tx, clientID string, topics []string) error {
+	client := map[string]struct{}{clientID: {}}
+
+	// the wildcard filters the client unsubscribes from, and the groups
+	// left without members, by filter
+	filters := make(map[string]map[string]struct{})
+	regular := make(map[string]struct{})
+
+	for _, topic := range topics {
+		key := subscribersSetKey(topic)
+		tx.SetRemove(key, clientID)
+
+		group, filter, shared := parseSharedSubscription(topic)
+		if !shared {
+			filter = topic
+			regular[filter] = struct{}{}
+		}
+
+		if _, ok := filters[filter]; !ok {
+			filters[filter] = make(map[string]struct{})
+		}
+
+		if !shared {
+			continue
+		}
+
+		used, err := b.hasOtherMembers(ctx, key, client)
+		if err != nil {
+			return err
+		}
+
+		if !used {
+			tx.SetRemove(fmt.Sprintf(topicGroupsSetFmt, filter), group)
+			tx.Destroy(fmt.Sprintf(groupStateMapFmt, filter, group))
+			filters[filter][group] = struct{}{}
+		}
 	}
 
-	return b.store.Set(fmt.Sprintf(clientSubscriptionsSetFmt, clientID)).Remove(ctx, topic)
+	for filter, removedGroups := range filters {
+		if !isWildcardFilter(filter) {
+			continue
+		}
+
+		excluded := make(map[string]struct{})
+		if _, ok := regular[filter]; ok {
+			excluded = client
+		}
+
+		used, err := b.hasOtherMembers(ctx, fmt.Sprintf(topicSubscribersSetFmt, filter), excluded)
+		if err != nil {
+			return err
+		}
+
+		if !used {
+			used, err = b.hasOtherMembers(ctx, fmt.Sprintf(topicGroupsSetFmt, filter), removedGroups)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !used {
+			tx.SetRemove(wildcardFiltersSet, filter)
+		}
+	}
+
+	return nil
 }
 
 func encodeMessage(queuedMessage *QueuedMessage) (string, error) {
@@ -147,9 +465,14 @@ func (b *Broker) PopQueuedMessage(ctx context.Context) (*QueuedMessage, error) {
 	return b.popMessage(ctx, messageQueue)
 }
 
-// QueueMessage pushes a message into the queue of published messages
-func (b *Broker) QueueMessage(topic string, msg string, messageID uint16, qos QoS) error {
+// QueueMessage pushes a message into the queue of published messages; if ttl
+// is not zero, the message is dropped if not delivered within ttl
+func (b *Broker) QueueMessage(topic string, msg string, messageID uint16, qos QoS, ttl time.Duration) error {
 	queuedMessage := QueuedMessage{ID: messageID, Topic: topic, Message: msg, QoS: qos}
+	if ttl > 0 {
+		expiry := time.Now().Add(ttl)
+		queuedMessage.Expiry = &expiry
+	}
 
 	log.WithFields(queuedMessage.LogFields()).Info("Queueing a message")
 
@@ -168,17 +491,122 @@ func (b *Broker) QueueMessage(topic string, msg string, messageID uint16, qos Qo
 }
 
 // QueueMessageForSubscribers pushes a published message into the message queue
-// of each client subscribed to the topic the message was published to
+// of each client subscribed to the topic the message was published to; if the
+// message cannot be queued for some subscribers, it returns an error and keeps
+// them in the message, so it can be retried without queueing the message
+// twice for others
 func (b *Broker) QueueMessageForSubscribers(queuedMessage *QueuedMessage) error {
-	return b.store.Set(fmt.Sprintf(topicSubscribersSetFmt, queuedMessage.Topic)).Scan(b.ctx, func(ctx context.Context, clientID string) {
-		b.QueueMessageForSubscriber(ctx, clientID, queuedMessage)
-	})
+	if queuedMessage.Expired(time.Now()) {
+		log.WithFields(queuedMessage.LogFields()).Info("Dropping an expired message")
+		b.count(metricMessagesExpired, 1)
+		return nil
+	}
+
+	subscribers, groups := queuedMessage.Subscribers, queuedMessage.Groups
+
+	// the subscribers are resolved before the message is queued for any of
+	// them, so the message can be retried if this fails
+	if len(subscribers) == 0 && len(groups) == 0 {
+		var err error
+		if subscribers, groups, err = b.topicSubscribers(b.ctx, queuedMessage.Topic); err != nil {
+			return err
+		}
+	}
+
+	queuedMessage.Subscribers = nil
+	queuedMessage.Groups = nil
+
+	for _, clientID := range subscribers {
+		if err := b.QueueMessageForSubscriber(b.ctx, clientID, queuedMessage); err != nil && !errors.Is(err, ErrQueueFull) {
+			log.WithFields(queuedMessage.LogFields()).WithFields(log.Fields{"client_id": clientID}).WithError(err).Warn("Failed to queue a message for a subscriber")
+			queuedMessage.Subscribers = append(queuedMessage.Subscribers, clientID)
+		}
+	}
+
+	for _, shared := range groups {
+		if err := b.queueMessageForSharedSubscription(b.ctx, shared, queuedMessage); err != nil && !errors.Is(err, errEmptyGroup) && !errors.Is(err, ErrQueueFull) {
+			log.WithFields(queuedMessage.LogFields()).WithFields(log.Fields{"group": shared}).WithError(err).Warn("Failed to queue a message for a group")
+			queuedMessage.Groups = append(queuedMessage.Groups, shared)
+		}
+	}
+
+	if n := len(queuedMessage.Subscribers) + len(queuedMessage.Groups); n > 0 {
+		b.count(metricMessagesFanoutFailed, 1)
+		return fmt.Errorf("failed to queue a message for %d subscribers", n)
+	}
+
+	return nil
+}
+
+// topicSubscribers returns the clients subscribed to a topic, and the shared
+// subscription groups that should receive messages published to it
+func (b *Broker) topicSubscribers(ctx context.Context, topic string) ([]string, []string, error) {
+	filters, err := b.matchingFilters(ctx, topic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// a client subscribed to multiple matching filters receives one copy
+	subscribers := make(map[string]struct{})
+	groups := make([]string, 0)
+	for _, filter := range filters {
+		if err := b.store.Set(fmt.Sprintf(topicSubscribersSetFmt, filter)).Scan(ctx, func(ctx context.Context, clientID string) {
+			subscribers[clientID] = struct{}{}
+		}); err != nil {
+			return nil, nil, err
+		}
+
+		filterGroups, err := b.store.Set(fmt.Sprintf(topicGroupsSetFmt, filter)).Members(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, group := range filterGroups {
+			groups = append(groups, sharedSubscriptionPrefix+group+"/"+filter)
+		}
+	}
+
+	clientIDs := make([]string, 0, len(subscribers))
+	for clientID := range subscribers {
+		clientIDs = append(clientIDs, clientID)
+	}
+
+	return clientIDs, groups, nil
+}
+
+// matchingFilters returns all topic filters that match a topic
+func (b *Broker) matchingFilters(ctx context.Context, topic string) ([]string, error) {
+	wildcardFilters, err := b.store.Set(wildcardFiltersSet).Members(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filters := []string{topic}
+	for _, filter := range wildcardFilters {
+		if matchTopic(filter, topic) {
+			filters = append(filters, filter)
+		}
+	}
+
+	return filters, nil
 }
 
 // UnqueueMessageForSubscriber removes a published message from the messages
 // queue of a client
 func (b *Broker) UnqueueMessageForSubscriber(ctx context.Context, clientID string, messageID uint16) error {
-	return b.store.Map(fmt.Sprintf(clientMessageQueueFmt, clientID)).Remove(ctx, fmt.Sprintf("%d", messageID))
+	messages := fmt.Sprintf(clientMessageQueueFmt, clientID)
+	k := fmt.Sprintf("%d", messageID)
+
+	return b.store.Transaction(ctx, []string{messages}, func(ctx context.Context, tx store.Tx) error {
+		queuedMessage, err := b.GetQueuedMessageForSubscriber(ctx, clientID, messageID)
+		if err != nil {
+			return err
+		}
+
+		tx.MapRemove(messages, k)
+		updateClientUsage(tx, clientID, -1, -int64(len(queuedMessage.Message)))
+		return nil
+	})
 }
 
 func generateMessageID() uint16 {
@@ -191,6 +619,10 @@ func generateMessageID() uint16 {
 func (b *Broker) QueueMessageForSubscriber(ctx context.Context, clientID string, queuedMessage *QueuedMessage) error {
 	queuedMessageForSubscriber := *queuedMessage
 	queuedMessageForSubscriber.ID = generateMessageID()
+	queuedMessageForSubscriber.QueueTime = time.Now()
+	queuedMessageForSubscriber.Attempts = 0
+	queuedMessageForSubscriber.Subscribers = nil
+	queuedMessageForSubscriber.Groups = nil
 
 	j, err := encodeMessage(&queuedMessageForSubscriber)
 	if err != nil {
@@ -198,18 +630,65 @@ func (b *Broker) QueueMessageForSubscriber(ctx context.Context, clientID string,
 		return err
 	}
 
-	if queuedMessage.QoS != QoS0 {
-		err := b.store.Map(fmt.Sprintf(clientMessageQueueFmt, clientID)).Set(ctx, fmt.Sprintf("%d", queuedMessageForSubscriber.ID), j)
-		if err != nil {
-			log.WithFields(queuedMessage.LogFields()).WithError(err).Warn("failed to add an unacked message")
+	limits, err := b.getClientLimits(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(queuedMessage.Message))
+
+	reserved := !limits.Unlimited()
+	if reserved {
+		if err := b.reserveClientUsage(ctx, clientID, limits, &queuedMessageForSubscriber); err != nil {
+			return err
+		}
+	}
+
+	// the message, the usage counters and the notification are updated
+	// together, so a failure cannot leave them inconsistent; messages with
+	// QoS 0 are kept until delivered, so they can be dropped when the queue
+	// is full
+	err = b.store.Transaction(ctx, nil, func(ctx context.Context, tx store.Tx) error {
+		tx.MapSet(fmt.Sprintf(clientMessageQueueFmt, clientID), fmt.Sprintf("%d", queuedMessageForSubscriber.ID), j)
+		if !reserved {
+			updateClientUsage(tx, clientID, 1, size)
 		}
+		tx.QueuePush(fmt.Sprintf(clientMessageNotificationFmt, clientID), j)
+		return nil
+	})
+	if err != nil && reserved {
+		b.releaseClientUsage(ctx, clientID, size)
+	}
+
+	return err
+}
+
+// GetQueuedMessageForSubscriber returns an unacked message from the message
+// queue of a client
+func (b *Broker) GetQueuedMessageForSubscriber(ctx context.Context, clientID string, messageID uint16) (*QueuedMessage, error) {
+	result, err := b.store.Map(fmt.Sprintf(clientMessageQueueFmt, clientID)).Get(ctx, fmt.Sprintf("%d", messageID))
+	if err != nil {
+		return nil, err
 	}
 
-	return b.store.Queue(fmt.Sprintf(clientMessageNotificationFmt, clientID)).Push(ctx, j)
+	return decodeMessage(result)
+}
+
+// DropExpiredMessageForSubscriber removes an expired message from the message
+// queue of a client
+func (b *Broker) DropExpiredMessageForSubscriber(ctx context.Context, clientID string, queuedMessage *QueuedMessage) error {
+	log.WithFields(queuedMessage.LogFields()).WithFields(log.Fields{"client_id": clientID}).Info("Dropping an expired message")
+	b.count(metricMessagesExpired, 1)
+
+	if queuedMessage.QoS == QoS0 {
+		return nil
+	}
+
+	return b.UnqueueMessageForSubscriber(ctx, clientID, queuedMessage.ID)
 }
 
 // UpdateQueuedMessageForSubscriber updates a message in the message queue of a
-// client
+// client, unless it has been acked or dropped
 func (b *Broker) UpdateQueuedMessageForSubscriber(ctx context.Context, clientID string, queuedMessage *QueuedMessage) error {
 	j, err := encodeMessage(queuedMessage)
 	if err != nil {
@@ -217,7 +696,16 @@ func (b *Broker) UpdateQueuedMessageForSubscriber(ctx context.Context, clientID
 		return err
 	}
 
-	return b.store.Map(fmt.Sprintf(clientMessageQueueFmt, clientID)).Set(ctx, fmt.Sprintf("%d", queuedMessage.ID), j)
+	messages := fmt.Sprintf(clientMessageQueueFmt, clientID)
+
+	return b.store.Transaction(ctx, []string{messages}, func(ctx context.Context, tx store.Tx) error {
+		if _, err := b.GetQueuedMessageForSubscriber(ctx, clientID, queuedMessage.ID); err != nil {
+			return err
+		}
+
+		tx.MapSet(messages, fmt.Sprintf("%d", queuedMessage.ID), j)
+		return nil
+	})
 }
 
 func (b *Broker) notifyClient(ctx context.Context, clientID string, c chan<- *QueuedMessage) {
@@ -234,6 +722,18 @@ func (b *Broker) notifyClient(ctx context.Context, clientID string, c chan<- *Qu
 			continue
 		}
 
+		// messages with QoS 0 are removed from the queue when delivered,
+		// and others when acked; a message that is no longer queued has
+		// been dropped
+		if queuedMessage.QoS == QoS0 {
+			err = b.UnqueueMessageForSubscriber(ctx, clientID, queuedMessage.ID)
+		} else {
+			_, err = b.GetQueuedMessageForSubscriber(ctx, clientID, queuedMessage.ID)
+		}
+		if err != nil {
+			continue
+		}
+
 		c <- queuedMessage
 	}
 }
@@ -18,7 +18,10 @@ package mqtt
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dimkr/yodi/pkg/store"
 	"github.com/stretchr/testify/assert"
@@ -105,7 +108,7 @@ func TestQueueMessage_QoS0(t *testing.T) {
 	topic := "/topic"
 	msg := "{}"
 
-	assert.Nil(t, broker.QueueMessage(topic, msg, 1234, QoS0))
+	assert.Nil(t, broker.QueueMessage(topic, msg, 1234, QoS0, 0))
 
 	queuedMessage, err := broker.PopQueuedMessage(ctx)
 	assert.Nil(t, err)
@@ -148,7 +151,7 @@ func TestQueueMessage_QoS1(t *testing.T) {
 	topic := "/topic"
 	msg := "{}"
 
-	assert.Nil(t, broker.QueueMessage(topic, msg, 1234, QoS1))
+	assert.Nil(t, broker.QueueMessage(topic, msg, 1234, QoS1, 0))
 
 	queuedMessage, err := broker.PopQueuedMessage(ctx)
 	assert.Nil(t, err)
@@ -199,8 +202,8 @@ func TestQueueMessage_QoS1_MessageIDReuse(t *testing.T) {
 	topic := "/topic"
 	msg := "{}"
 
-	assert.Nil(t, broker.QueueMessage(topic, msg, 1234, QoS1))
-	assert.Nil(t, broker.QueueMessage(topic, msg, 1234, QoS1))
+	assert.Nil(t, broker.QueueMessage(topic, msg, 1234, QoS1, 0))
+	assert.Nil(t, broker.QueueMessage(topic, msg, 1234, QoS1, 0))
 
 	assert.Nil(t, broker.Subscribe(ctx, clientID, topic))
 
@@ -227,3 +230,472 @@ func TestQueueMessage_QoS1_MessageIDReuse(t *testing.T) {
 
 	assert.NotEqual(t, secondReceivedMessage.ID, receivedMessage.ID)
 }
+
+func TestSubscribe_Concurrent(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	clientID := "abcd"
+	topic := "/topic"
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	succeeded := 0
+
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if broker.Subscribe(ctx, clientID, topic) == nil {
+				lock.Lock()
+				succeeded++
+				lock.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, 1, succeeded)
+
+	subscribers, err := store.Set(subscribersSetKey(topic)).Members(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{clientID}, subscribers)
+}
+
+func TestRemoveClient_Subscriptions(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	clientID := "abcd"
+
+	assert.Nil(t, broker.AddClient(ctx, clientID))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(t, broker.Subscribe(ctx, clientID, fmt.Sprintf("/topic/%d", i)))
+			assert.Nil(t, broker.Subscribe(ctx, clientID, fmt.Sprintf("$share/group/topic/%d/#", i)))
+		}(i)
+	}
+
+	wg.Wait()
+
+	assert.Nil(t, broker.RemoveClient(clientID))
+
+	for i := 0; i < 8; i++ {
+		for _, topic := range []string{fmt.Sprintf("/topic/%d", i), fmt.Sprintf("$share/group/topic/%d/#", i)} {
+			n, err := store.Set(subscribersSetKey(topic)).Len(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, int64(0), n)
+		}
+	}
+
+	n, err := store.Set(fmt.Sprintf(clientSubscriptionsSetFmt, clientID)).Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	assert.Nil(t, broker.AddClient(ctx, clientID))
+}
+
+func TestRemoveClient_DeadLetter(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	clientID := "abcd"
+	topic := "/topic"
+	msg := "{}"
+
+	assert.Nil(t, broker.AddClient(ctx, clientID))
+	assert.Nil(t, broker.Subscribe(ctx, clientID, topic))
+
+	assert.Nil(t, broker.QueueMessageForSubscribers(&QueuedMessage{Topic: topic, Message: msg, QoS: QoS1}))
+
+	assert.Nil(t, broker.RemoveClient(clientID))
+
+	deadLetters, err := broker.ListDeadLetters(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, clientID, deadLetters[0].ClientID)
+	assert.Equal(t, DeadLetterSessionExpired, deadLetters[0].Reason)
+	assert.Equal(t, msg, deadLetters[0].Message.Message)
+
+	assert.Nil(t, broker.RequeueDeadLetter(ctx, deadLetters[0].ID))
+
+	c := broker.GetMessagesChannelForClient(ctx, clientID)
+	receivedMessage := <-c
+	assert.Equal(t, msg, receivedMessage.Message)
+
+	deadLetters, err = broker.ListDeadLetters(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(deadLetters))
+}
+
+func TestDeadLetterMessage(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	clientID := "abcd"
+	topic := "/topic"
+	msg := "{}"
+
+	assert.Nil(t, broker.Subscribe(ctx, clientID, topic))
+	assert.Nil(t, broker.QueueMessageForSubscribers(&QueuedMessage{Topic: topic, Message: msg, QoS: QoS1}))
+
+	c := broker.GetMessagesChannelForClient(ctx, clientID)
+	receivedMessage := <-c
+	receivedMessage.Attempts = maxDeliveryAttempts
+
+	assert.Nil(t, broker.DeadLetterMessage(ctx, clientID, receivedMessage, DeadLetterMaxAttempts))
+
+	_, err = broker.GetQueuedMessageForSubscriber(ctx, clientID, receivedMessage.ID)
+	assert.NotNil(t, err)
+
+	deadLetters, err := broker.ListDeadLetters(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, maxDeliveryAttempts, deadLetters[0].Attempts)
+
+	assert.Nil(t, broker.PurgeDeadLetter(ctx, deadLetters[0].ID))
+	assert.NotNil(t, broker.PurgeDeadLetter(ctx, deadLetters[0].ID))
+}
+
+func TestRedeliver_DeadLettersFull(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, SaveUser(ctx, s, "user", &User{Password: "password", ACL: ACL{"/topic": {Subscribe: true}}}))
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+	broker.deadLetterLimits.max = 1
+
+	assert.Nil(t, broker.deadLetter(ctx, "efgh", &QueuedMessage{Topic: "/topic", Message: "{}"}, DeadLetterMaxAttempts))
+
+	c := connectTestClient(t, broker, "abcd", "user", "password")
+	defer c.Close()
+
+	assert.Nil(t, broker.Subscribe(ctx, "abcd", "/topic"))
+	assert.Nil(t, broker.QueueMessageForSubscribers(&QueuedMessage{Topic: "/topic", Message: "{}", QoS: QoS1}))
+
+	queuedMessage := <-broker.GetMessagesChannelForClient(ctx, "abcd")
+	queuedMessage.Attempts = maxDeliveryAttempts
+	assert.Nil(t, broker.UpdateQueuedMessageForSubscriber(ctx, "abcd", queuedMessage))
+
+	// the message is dropped when it cannot be moved to the dead letter queue
+	c.redeliver(queuedMessage.ID)
+
+	_, err = broker.GetQueuedMessageForSubscriber(ctx, "abcd", queuedMessage.ID)
+	assert.NotNil(t, err)
+
+	deadLetters, err := broker.ListDeadLetters(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(deadLetters))
+}
+
+func TestQueueMessage_Expired(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	clientID := "abcd"
+	topic := "/topic"
+	msg := "{}"
+
+	assert.Nil(t, broker.QueueMessage(topic, msg, 1234, QoS1, time.Millisecond))
+	assert.Nil(t, broker.QueueMessage(topic, msg, 1235, QoS1, time.Hour))
+
+	assert.Nil(t, broker.Subscribe(ctx, clientID, topic))
+
+	time.Sleep(time.Millisecond * 2)
+
+	for i := 0; i < 2; i++ {
+		queuedMessage, err := broker.PopQueuedMessage(ctx)
+		assert.Nil(t, err)
+		assert.Nil(t, broker.QueueMessageForSubscribers(queuedMessage))
+	}
+
+	queuedMessages := make([]*QueuedMessage, 0)
+	assert.Nil(t, broker.ScanQueuedMessagesForClient(ctx, clientID, func(queuedMessage *QueuedMessage) {
+		queuedMessages = append(queuedMessages, queuedMessage)
+	}))
+
+	assert.Equal(t, 1, len(queuedMessages))
+	assert.False(t, queuedMessages[0].Expired(time.Now()))
+	assert.True(t, queuedMessages[0].Expired(time.Now().Add(time.Hour*2)))
+}
+
+func TestHandlePublish_TTL(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hash, err := HashPassword("password1", DefaultPasswordAlgorithm)
+	assert.Nil(t, err)
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: hash, ACL: ACL{"/%c/log": {Publish: true, TTL: 3600}}}))
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	c := connectTestClient(t, broker, "abcd", "user1", "password1")
+	defer c.Close()
+
+	// the TTL of the publisher replaces the default TTL of the topic
+	now := time.Now()
+	assert.Nil(t, c.handlePublish("$ttl/60//abcd/log", []byte("{}"), 0, QoS0))
+	assert.Nil(t, c.handlePublish("/abcd/log", []byte("{}"), 0, QoS0))
+
+	queuedMessage, err := broker.PopQueuedMessage(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "/abcd/log", queuedMessage.Topic)
+	assert.WithinDuration(t, now.Add(time.Minute), *queuedMessage.Expiry, time.Second*10)
+
+	queuedMessage, err = broker.PopQueuedMessage(ctx)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, now.Add(time.Hour), *queuedMessage.Expiry, time.Second*10)
+
+	// the prefix doesn't bypass the ACL
+	assert.NotNil(t, c.handlePublish("$ttl/60//efgh/log", []byte("{}"), 0, QoS0))
+
+	for _, topic := range []string{"$ttl/0//abcd/log", "$ttl/abc//abcd/log", "$ttl/60"} {
+		assert.NotNil(t, c.handlePublish(topic, []byte("{}"), 0, QoS0), topic)
+	}
+}
+
+func TestQueuedMessage_NoExpiry(t *testing.T) {
+	j, err := encodeMessage(&QueuedMessage{Topic: "/topic"})
+	assert.Nil(t, err)
+	assert.NotContains(t, j, `"exp"`)
+}
+
+func TestSharedSubscription_RoundRobin(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	topic := "/topic"
+	sharedTopic := "$share/workers/" + topic
+
+	assert.Nil(t, broker.Subscribe(ctx, "a", sharedTopic))
+	assert.Nil(t, broker.Subscribe(ctx, "b", sharedTopic))
+	assert.NotNil(t, broker.Subscribe(ctx, "b", sharedTopic))
+
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, broker.QueueMessageForSubscribers(&QueuedMessage{Topic: topic, Message: "{}", QoS: QoS1}))
+	}
+
+	for _, clientID := range []string{"a", "b"} {
+		messages, _, err := broker.GetClientUsage(ctx, clientID)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(2), messages)
+	}
+}
+
+func TestSharedSubscription_Redistribute(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	topic := "/topic"
+	sharedTopic := "$share/workers/" + topic
+
+	assert.Nil(t, broker.AddClient(ctx, "a"))
+	assert.Nil(t, broker.Subscribe(ctx, "a", sharedTopic))
+	assert.Nil(t, broker.AddClient(ctx, "b"))
+	assert.Nil(t, broker.Subscribe(ctx, "b", sharedTopic))
+
+	assert.Nil(t, broker.QueueMessageForSubscribers(&QueuedMessage{Topic: topic, Message: "1", QoS: QoS1}))
+	assert.Nil(t, broker.QueueMessageForSubscribers(&QueuedMessage{Topic: topic, Message: "2", QoS: QoS1}))
+
+	assert.Nil(t, broker.RemoveClient("a"))
+
+	queuedMessages := make([]*QueuedMessage, 0)
+	assert.Nil(t, broker.ScanQueuedMessagesForClient(ctx, "b", func(queuedMessage *QueuedMessage) {
+		queuedMessages = append(queuedMessages, queuedMessage)
+	}))
+	assert.Equal(t, 2, len(queuedMessages))
+
+	assert.Nil(t, broker.RemoveClient("b"))
+
+	deadLetters, err := broker.ListDeadLetters(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(deadLetters))
+}
+
+func TestSubscribe_Wildcard(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	clientID := "abcd"
+	msg := "{}"
+
+	assert.Nil(t, broker.Subscribe(ctx, clientID, "/a/+"))
+	assert.Nil(t, broker.Subscribe(ctx, clientID, "/a/#"))
+	assert.Nil(t, broker.Subscribe(ctx, "efgh", "#"))
+
+	assert.Nil(t, broker.QueueMessageForSubscribers(&QueuedMessage{Topic: "/a/b", Message: msg, QoS: QoS1}))
+	assert.Nil(t, broker.QueueMessageForSubscribers(&QueuedMessage{Topic: "/b/c", Message: msg, QoS: QoS1}))
+	assert.Nil(t, broker.QueueMessageForSubscribers(&QueuedMessage{Topic: "$SYS/broker/uptime", Message: msg, QoS: QoS1}))
+
+	messages, _, err := broker.GetClientUsage(ctx, clientID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), messages)
+
+	messages, _, err = broker.GetClientUsage(ctx, "efgh")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), messages)
+}
+
+func TestPublishStats(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	otherBroker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	assert.Nil(t, broker.AddClient(ctx, "abcd"))
+	assert.Nil(t, broker.Subscribe(ctx, "abcd", "/topic"))
+	assert.Nil(t, otherBroker.Subscribe(ctx, "efgh", "/topic"))
+
+	now := time.Now()
+	broker.publishStats(ctx, now, time.Minute)
+	otherBroker.publishStats(ctx, now, time.Minute)
+
+	stats := make(map[string]string)
+	for i := 0; i < len(sysCounters)+5; i++ {
+		queuedMessage, err := broker.PopQueuedMessage(ctx)
+		assert.Nil(t, err)
+		assert.True(t, isReservedTopic(queuedMessage.Topic))
+		stats[queuedMessage.Topic] = queuedMessage.Message
+	}
+
+	length, err := store.Queue(messageQueue).Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), length)
+
+	assert.Equal(t, Version, stats["$SYS/broker/version"])
+	assert.Equal(t, "1", stats["$SYS/broker/clients/connected"])
+	assert.Equal(t, "2", stats["$SYS/broker/subscriptions/count"])
+}
+
+func TestUnsubscribe_Filters(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	filters := func() []string {
+		members, err := s.Set(wildcardFiltersSet).Members(ctx)
+		assert.Nil(t, err)
+		return members
+	}
+
+	for _, clientID := range []string{"a", "b", "c"} {
+		assert.Nil(t, broker.AddClient(ctx, clientID))
+	}
+
+	assert.Nil(t, broker.Subscribe(ctx, "a", "/a/+"))
+	assert.Nil(t, broker.Subscribe(ctx, "b", "$share/group//a/+"))
+	assert.Nil(t, broker.Subscribe(ctx, "c", "/b/#"))
+	assert.Nil(t, broker.Subscribe(ctx, "c", "$share/group//b/#"))
+	assert.ElementsMatch(t, []string{"/a/+", "/b/#"}, filters())
+
+	// the filter is still used by a group
+	assert.Nil(t, broker.Unsubscribe(ctx, "a", "/a/+"))
+	assert.ElementsMatch(t, []string{"/a/+", "/b/#"}, filters())
+
+	assert.Nil(t, broker.Unsubscribe(ctx, "b", "$share/group//a/+"))
+	assert.ElementsMatch(t, []string{"/b/#"}, filters())
+
+	groups, err := s.Set(fmt.Sprintf(topicGroupsSetFmt, "/a/+")).Members(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, groups)
+
+	// the client is the only subscriber, directly and through a group
+	assert.Nil(t, broker.RemoveClient("c"))
+	assert.Equal(t, []string{}, filters())
+}
+
+func TestPublishStats_Replicas(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	otherBroker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+	otherBroker.startTime = time.Now().Add(-time.Hour)
+
+	// each broker flushes only its own counters
+	broker.count(metricMessagesReceived, 3)
+	otherBroker.count(metricMessagesReceived, 2)
+
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, broker.flushMetrics(ctx))
+		assert.Nil(t, otherBroker.flushMetrics(ctx))
+	}
+
+	assert.Nil(t, broker.registerReplica(ctx, time.Minute))
+	assert.Nil(t, otherBroker.registerReplica(ctx, time.Minute))
+
+	stats, err := broker.GetStats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "5", stats["messages/received"])
+
+	// the uptime is the same, regardless of the publishing replica
+	assert.Contains(t, []string{"3600 seconds", "3601 seconds"}, stats["uptime"])
+}
@@ -0,0 +1,206 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAuthCacheTTL         = time.Second * 30
+	defaultAuthCacheNegativeTTL = time.Second * 5
+
+	maxAuthCacheEntries = 4096
+)
+
+// AuthCacheConfig configures a caching authenticator
+type AuthCacheConfig struct {
+	// TTL is the duration a successful authentication result is reused for
+	TTL time.Duration
+
+	// NegativeTTL is the duration a failed authentication result is reused
+	// for
+	NegativeTTL time.Duration
+
+	// MaxStaleness is the duration an expired successful result is reused
+	// for, while the cached authenticator is unavailable; by default, clients
+	// are rejected instead
+	MaxStaleness time.Duration
+}
+
+type authCacheEntry struct {
+	username string
+	user     *User
+	expiry   time.Time
+}
+
+type cachingAuthenticator struct {
+	next    Authenticator
+	config  AuthCacheConfig
+	lock    sync.Mutex
+	entries map[string]authCacheEntry
+}
+
+// credentialsKey identifies an authentication attempt without keeping the
+// password in memory
+func credentialsKey(username, password string, info ConnectInfo) string {
+	h := sha256.New()
+	for _, s := range []string{username, password, info.ClientID, remoteHost(info)} {
+		io.WriteString(h, strconv.Itoa(len(s)))
+		io.WriteString(h, ":")
+		io.WriteString(h, s)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns a cached result, or an expired successful result that is not
+// too stale if stale is true
+func (a *cachingAuthenticator) get(key string, now time.Time, stale bool) (authCacheEntry, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	entry, ok := a.entries[key]
+	if !ok {
+		return authCacheEntry{}, false
+	}
+
+	expiry := entry.expiry
+	if stale {
+		if entry.user == nil {
+			return authCacheEntry{}, false
+		}
+
+		expiry = expiry.Add(a.config.MaxStaleness)
+	}
+
+	if now.After(expiry) {
+		return authCacheEntry{}, false
+	}
+
+	return entry, true
+}
+
+func (a *cachingAuthenticator) put(key string, entry authCacheEntry, now time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.entries) >= maxAuthCacheEntries {
+		for k, entry := range a.entries {
+			if now.After(entry.expiry.Add(a.config.MaxStaleness)) {
+				delete(a.entries, k)
+			}
+		}
+
+		if len(a.entries) >= maxAuthCacheEntries {
+			return
+		}
+	}
+
+	a.entries[key] = entry
+}
+
+// invalidate removes the cached results of a user, or of all users if username
+// is empty
+func (a *cachingAuthenticator) invalidate(username string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if username == "" {
+		a.entries = make(map[string]authCacheEntry)
+		return
+	}
+
+	for k, entry := range a.entries {
+		if entry.username == username {
+			delete(a.entries, k)
+		}
+	}
+}
+
+func (a *cachingAuthenticator) watch(ctx context.Context, changes <-chan string) {
+	for username := range changes {
+		log.WithFields(log.Fields{"username": username}).Debug("Invalidating cached authentication results")
+		a.invalidate(username)
+	}
+}
+
+func (a *cachingAuthenticator) AuthenticateUser(ctx context.Context, username, password string) (*User, error) {
+	info := ConnectInfoFromContext(ctx)
+	key := credentialsKey(username, password, info)
+	now := time.Now()
+
+	if entry, ok := a.get(key, now, false); ok {
+		if entry.user == nil {
+			return nil, ErrBadCredentials
+		}
+
+		user := *entry.user
+		return &user, nil
+	}
+
+	user, err := a.next.AuthenticateUser(ctx, username, password)
+	if err == nil {
+		if a.config.TTL > 0 {
+			a.put(key, authCacheEntry{username: username, user: user, expiry: now.Add(a.config.TTL)}, now)
+		}
+
+		return user, nil
+	}
+
+	if errors.Is(err, ErrBadCredentials) && a.config.NegativeTTL > 0 {
+		a.put(key, authCacheEntry{username: username, expiry: now.Add(a.config.NegativeTTL)}, now)
+	}
+
+	if errors.Is(err, ErrAuthUnavailable) && a.config.MaxStaleness > 0 {
+		if entry, ok := a.get(key, now, true); ok {
+			log.WithFields(log.Fields{"username": username}).WithError(err).Warn("Using an expired authentication result")
+			user := *entry.user
+			return &user, nil
+		}
+	}
+
+	return nil, err
+}
+
+// NewCachingAuthenticator returns a new authenticator that caches results of
+// another authenticator, until a user changes or they expire
+func NewCachingAuthenticator(ctx context.Context, store store.Store, next Authenticator, config AuthCacheConfig) (Authenticator, error) {
+	a := &cachingAuthenticator{
+		next:    next,
+		config:  config,
+		entries: make(map[string]authCacheEntry),
+	}
+
+	changes, err := WatchUsers(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	go a.watch(ctx, changes)
+
+	return a, nil
+}
@@ -0,0 +1,157 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachingAuthenticator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := &stubAuthenticator{username: "user1", password: "password1"}
+	auth, err := NewCachingAuthenticator(ctx, store.NewMemoryStore(), next, AuthCacheConfig{TTL: time.Millisecond * 100, NegativeTTL: time.Millisecond * 50})
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 1, next.calls)
+
+	for i := 0; i < 3; i++ {
+		_, err = auth.AuthenticateUser(ctx, "user1", "password2")
+		assert.Equal(t, ErrBadCredentials, err)
+	}
+	assert.Equal(t, 2, next.calls)
+
+	// the client's port is ignored
+	_, err = auth.AuthenticateUser(WithConnectInfo(ctx, ConnectInfo{ClientID: "abcd", RemoteAddr: "127.0.0.1:1234"}), "user1", "password1")
+	assert.Nil(t, err)
+	_, err = auth.AuthenticateUser(WithConnectInfo(ctx, ConnectInfo{ClientID: "abcd", RemoteAddr: "127.0.0.1:1235"}), "user1", "password1")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, next.calls)
+
+	time.Sleep(time.Millisecond * 60)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password2")
+	assert.Equal(t, ErrBadCredentials, err)
+	assert.Equal(t, 4, next.calls)
+
+	time.Sleep(time.Millisecond * 60)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, next.calls)
+}
+
+func TestCachingAuthenticator_Invalidation(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: "password1", Roles: []string{"device"}}))
+	assert.Nil(t, SaveRole(ctx, s, "device", &Role{ACL: ACL{"/%c/log": {Publish: true}}}))
+
+	auth, err := NewCachingAuthenticator(ctx, s, NewAuthenticator(s), AuthCacheConfig{TTL: time.Hour, NegativeTTL: time.Hour})
+	assert.Nil(t, err)
+
+	user, err := auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+	assert.Nil(t, user.ACL.AuthenticatePublish("/abcd/log", QoS0, "abcd", "user1"))
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password2")
+	assert.Equal(t, ErrBadCredentials, err)
+
+	// a password change invalidates positive and negative results
+	stored, err := LoadUser(ctx, s, "user1")
+	assert.Nil(t, err)
+	stored.Password = "password2"
+	assert.Nil(t, SaveUser(ctx, s, "user1", stored))
+
+	assert.Eventually(t, func() bool {
+		_, err := auth.AuthenticateUser(ctx, "user1", "password1")
+		return err == ErrBadCredentials
+	}, time.Second*10, time.Millisecond*10)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password2")
+	assert.Nil(t, err)
+
+	// a role change invalidates all results
+	assert.Nil(t, SaveRole(ctx, s, "device", &Role{}))
+
+	assert.Eventually(t, func() bool {
+		user, err := auth.AuthenticateUser(ctx, "user1", "password2")
+		return err == nil && user.ACL.AuthenticatePublish("/abcd/log", QoS0, "abcd", "user1") != nil
+	}, time.Second*10, time.Millisecond*10)
+}
+
+func TestCachingAuthenticator_MaxStaleness(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := &stubAuthenticator{username: "user1", password: "password1"}
+	auth, err := NewCachingAuthenticator(ctx, store.NewMemoryStore(), next, AuthCacheConfig{TTL: time.Millisecond * 50, MaxStaleness: time.Millisecond * 100})
+	assert.Nil(t, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password2")
+	assert.Equal(t, ErrBadCredentials, err)
+
+	next.err = ErrAuthUnavailable
+
+	// an expired result is used while the authenticator is unavailable
+	time.Sleep(time.Millisecond * 75)
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password2")
+	assert.Equal(t, ErrAuthUnavailable, err)
+
+	// the result is too old to be used
+	time.Sleep(time.Millisecond * 100)
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Equal(t, ErrAuthUnavailable, err)
+}
+
+func TestCachingAuthenticator_Unavailable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := &stubAuthenticator{username: "user1", password: "password1"}
+	auth, err := NewCachingAuthenticator(ctx, store.NewMemoryStore(), next, AuthCacheConfig{TTL: time.Millisecond * 50})
+	assert.Nil(t, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+
+	next.err = ErrAuthUnavailable
+
+	// expired results are not used by default
+	time.Sleep(time.Millisecond * 75)
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Equal(t, ErrAuthUnavailable, err)
+}
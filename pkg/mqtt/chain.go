@@ -0,0 +1,59 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type chainAuthenticator struct {
+	authenticators []Authenticator
+}
+
+func (a *chainAuthenticator) AuthenticateUser(ctx context.Context, username, password string) (*User, error) {
+	var firstErr error
+
+	for _, auth := range a.authenticators {
+		user, err := auth.AuthenticateUser(ctx, username, password)
+		if err == nil {
+			return user, nil
+		}
+
+		if !errors.Is(err, ErrBadCredentials) {
+			log.WithFields(log.Fields{"username": username}).WithError(err).Warn("Authentication failed")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return nil, ErrBadCredentials
+}
+
+// NewChainAuthenticator returns a new authenticator that tries several
+// authenticators in order, until one of them accepts the credentials; if none
+// does, it fails with the first error other than ErrBadCredentials, if any
+func NewChainAuthenticator(authenticators ...Authenticator) Authenticator {
+	return &chainAuthenticator{authenticators: authenticators}
+}
@@ -0,0 +1,77 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type stubAuthenticator struct {
+	username string
+	password string
+	err      error
+	calls    int
+}
+
+func (a *stubAuthenticator) AuthenticateUser(ctx context.Context, username, password string) (*User, error) {
+	a.calls++
+
+	if a.err != nil {
+		return nil, a.err
+	}
+
+	if username != a.username || password != a.password {
+		return nil, ErrBadCredentials
+	}
+
+	return &User{ACL: ACL{"/" + username: {Publish: true}}}, nil
+}
+
+func TestChainAuthenticator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := &stubAuthenticator{username: "user1", password: "password1"}
+	second := &stubAuthenticator{username: "user2", password: "password2"}
+	auth := NewChainAuthenticator(first, second)
+
+	user, err := auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+	assert.Nil(t, user.ACL.AuthenticatePublish("/user1", QoS0, "abcd", "user1"))
+	assert.Equal(t, 0, second.calls)
+
+	user, err = auth.AuthenticateUser(ctx, "user2", "password2")
+	assert.Nil(t, err)
+	assert.Nil(t, user.ACL.AuthenticatePublish("/user2", QoS0, "abcd", "user2"))
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password2")
+	assert.Equal(t, ErrBadCredentials, err)
+
+	// an unavailable authenticator doesn't prevent authentication by others
+	unavailable := errors.New("unavailable")
+	first.err = unavailable
+
+	_, err = auth.AuthenticateUser(ctx, "user2", "password2")
+	assert.Nil(t, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Equal(t, unavailable, err)
+}
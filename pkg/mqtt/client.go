@@ -41,9 +41,14 @@ type Client struct {
 	registered           bool
 	broker               *Broker
 	messageQueue         chan *QueuedMessage
+	redeliveries         *redeliveryScheduler
 	lastPingTime         time.Time
 	auth                 Authenticator
+	username             string
+	userLock             sync.RWMutex
 	user                 *User
+	remoteAddr           string
+	conn                 net.Conn
 }
 
 const (
@@ -71,21 +76,49 @@ func NewClient(parent context.Context, conn net.Conn, broker *Broker) (*Client,
 
 	messageQueue := make(chan *QueuedMessage, 1)
 
+	var remoteAddr string
+	if addr := conn.RemoteAddr(); addr != nil {
+		remoteAddr = addr.String()
+	}
+
 	ctx, cancel := context.WithDeadline(parent, t)
 	return &Client{
-		logFields:    log.Fields{},
+		logFields:    log.Fields{"remote_addr": remoteAddr},
 		reader:       conn,
 		writer:       conn,
 		ctx:          ctx,
 		cancel:       cancel,
 		broker:       broker,
 		messageQueue: messageQueue,
+		redeliveries: newRedeliveryScheduler(),
 		auth:         broker.auth,
+		remoteAddr:   remoteAddr,
+		conn:         conn,
 	}, nil
 }
 
+// currentUser returns the user of a client, which may be refreshed while it is
+// connected
+func (c *Client) currentUser() *User {
+	c.userLock.RLock()
+	defer c.userLock.RUnlock()
+
+	return c.user
+}
+
+func (c *Client) setUser(user *User) {
+	c.userLock.Lock()
+	defer c.userLock.Unlock()
+
+	c.user = user
+}
+
 // Close disconnects a client
 func (c *Client) Close() {
+	if c.username != "" {
+		c.broker.removeConnectedClient(c)
+	}
+
 	if c.registered {
 		if err := c.broker.RemoveClient(c.clientID); err != nil {
 			log.WithError(err).Warn("Failed to remove a client")
@@ -105,13 +138,30 @@ func (c *Client) deliverMessages() {
 			return
 
 		case queuedMessage := <-c.messageQueue:
-			// we don't want to requeue the message while we're sending it
+			if queuedMessage.Expired(time.Now()) {
+				c.redeliveries.Cancel(queuedMessage.ID)
+				c.broker.DropExpiredMessageForSubscriber(c.ctx, c.clientID, queuedMessage)
+				continue
+			}
+
+			if err := c.authenticateDelivery(queuedMessage); err != nil {
+				log.WithFields(c.logFields).WithFields(queuedMessage.LogFields()).WithError(err).Warn("Dropping a forbidden message")
+				c.redeliveries.Cancel(queuedMessage.ID)
+				if queuedMessage.QoS != QoS0 {
+					c.broker.UnqueueMessageForSubscriber(c.ctx, c.clientID, queuedMessage.ID)
+				}
+				continue
+			}
+
 			if queuedMessage.QoS != QoS0 {
+				queuedMessage.Attempts++
 				queuedMessage.SendTime = time.Now()
-				queuedMessage.Duplicate = true
+				queuedMessage.Duplicate = queuedMessage.Attempts > 1
 				if err := c.broker.UpdateQueuedMessageForSubscriber(c.ctx, c.clientID, queuedMessage); err != nil {
 					continue
 				}
+
+				c.redeliveries.Schedule(queuedMessage.ID, redeliveryDelay(queuedMessage.Attempts))
 			}
 
 			c.publish(queuedMessage)
@@ -119,9 +169,36 @@ func (c *Client) deliverMessages() {
 	}
 }
 
+func (c *Client) redeliver(messageID uint16) {
+	queuedMessage, err := c.broker.GetQueuedMessageForSubscriber(c.ctx, c.clientID, messageID)
+	if err != nil {
+		// the message has been acked
+		return
+	}
+
+	if queuedMessage.Attempts >= maxDeliveryAttempts {
+		if err := c.broker.DeadLetterMessage(c.ctx, c.clientID, queuedMessage, DeadLetterMaxAttempts); err != nil {
+			// the message is dropped, so it doesn't stay in the queue
+			// forever and count against the limits of the client
+			log.WithFields(c.logFields).WithFields(queuedMessage.LogFields()).WithError(err).Warn("Failed to move a message to the dead letter queue, dropping it")
+
+			if err := c.broker.UnqueueMessageForSubscriber(c.ctx, c.clientID, messageID); err != nil {
+				log.WithFields(c.logFields).WithFields(queuedMessage.LogFields()).WithError(err).Warn("Failed to drop a message")
+				c.redeliveries.Schedule(messageID, redeliveryDelay(queuedMessage.Attempts))
+			}
+		}
+		return
+	}
+
+	c.messageQueue <- queuedMessage
+}
+
 func (c *Client) queueMessages() {
 	messagesChannel := c.broker.GetMessagesChannelForClient(c.ctx, c.clientID)
 
+	redeliveries := make(chan uint16)
+	go c.redeliveries.Run(c.ctx, redeliveries)
+
 	for {
 		select {
 		case <-c.ctx.Done():
@@ -130,14 +207,8 @@ func (c *Client) queueMessages() {
 		case queuedMessage := <-messagesChannel:
 			c.messageQueue <- queuedMessage
 
-		case <-time.After(ackTimeout):
-			now := time.Now()
-
-			c.broker.ScanQueuedMessagesForClient(c.ctx, c.clientID, func(queuedMessage *QueuedMessage) {
-				if !queuedMessage.Duplicate || now.After(queuedMessage.SendTime.Add(ackTimeout)) {
-					c.messageQueue <- queuedMessage
-				}
-			})
+		case messageID := <-redeliveries:
+			c.redeliver(messageID)
 		}
 	}
 }
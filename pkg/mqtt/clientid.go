@@ -0,0 +1,79 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"errors"
+	"strings"
+)
+
+const clientIDWildcard = "*"
+
+// ErrClientIDRejected indicates that a user is not allowed to connect with a
+// client ID
+var ErrClientIDRejected = errors.New("client ID rejected")
+
+// matchClientID determines whether or not a client ID matches a pattern, which
+// may contain %u and the * wildcard, which matches any sequence of characters
+func matchClientID(pattern, clientID, username string) bool {
+	if strings.Contains(pattern, usernamePlaceholder) {
+		// a username that contains a wildcard must not widen the pattern
+		if username == "" || strings.Contains(username, clientIDWildcard) {
+			return false
+		}
+
+		pattern = strings.ReplaceAll(pattern, usernamePlaceholder, username)
+	}
+
+	parts := strings.Split(pattern, clientIDWildcard)
+	if len(parts) == 1 {
+		return pattern == clientID
+	}
+
+	if !strings.HasPrefix(clientID, parts[0]) {
+		return false
+	}
+	clientID = clientID[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(clientID, part)
+		if i == -1 {
+			return false
+		}
+		clientID = clientID[i+len(part):]
+	}
+
+	return strings.HasSuffix(clientID, last)
+}
+
+// AuthenticateClientID determines whether or not a user is allowed to connect
+// with a client ID; a user without a list of allowed client IDs may use any
+// client ID
+func (u *User) AuthenticateClientID(clientID, username string) error {
+	if len(u.ClientIDs) == 0 {
+		return nil
+	}
+
+	for _, pattern := range u.ClientIDs {
+		if matchClientID(pattern, clientID, username) {
+			return nil
+		}
+	}
+
+	return ErrClientIDRejected
+}
@@ -0,0 +1,52 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchClientID(t *testing.T) {
+	assert.True(t, matchClientID("abcd", "abcd", "user1"))
+	assert.False(t, matchClientID("abcd", "abcde", "user1"))
+
+	assert.True(t, matchClientID("%u", "user1", "user1"))
+	assert.True(t, matchClientID("%u-*", "user1-abcd", "user1"))
+	assert.True(t, matchClientID("%u-*", "user1-", "user1"))
+	assert.False(t, matchClientID("%u-*", "user2-abcd", "user1"))
+	assert.False(t, matchClientID("%u-*", "user1-abcd", "*"))
+
+	assert.True(t, matchClientID("*", "abcd", "user1"))
+	assert.True(t, matchClientID("sensor-*-*", "sensor-a-b", "user1"))
+	assert.False(t, matchClientID("sensor-*-*", "sensor-a", "user1"))
+	assert.True(t, matchClientID("*-lab", "a-lab", "user1"))
+	assert.False(t, matchClientID("*-lab", "a-lab2", "user1"))
+	assert.False(t, matchClientID("a*a", "a", "user1"))
+}
+
+func TestUser_AuthenticateClientID(t *testing.T) {
+	user := User{}
+	assert.Nil(t, user.AuthenticateClientID("abcd", "user1"))
+
+	user.ClientIDs = []string{"%u", "%u-*"}
+	assert.Nil(t, user.AuthenticateClientID("user1", "user1"))
+	assert.Nil(t, user.AuthenticateClientID("user1-abcd", "user1"))
+	assert.Equal(t, ErrClientIDRejected, user.AuthenticateClientID("user2", "user1"))
+	assert.Equal(t, ErrClientIDRejected, user.AuthenticateClientID("abcd", "user1"))
+}
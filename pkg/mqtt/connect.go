@@ -66,24 +66,41 @@ const (
 )
 
 func (c *Client) authenticateConnect(clientID, username, password string) error {
-	log.WithFields(c.logFields).Info("Authenticating ", clientID, "@", username, "/", password)
+	log.WithFields(c.logFields).Info("Authenticating ", clientID, "@", username)
 
-	var err error
-	c.user, err = c.auth.AuthenticateUser(c.ctx, username, password)
+	ctx := WithConnectInfo(c.ctx, ConnectInfo{ClientID: clientID, RemoteAddr: c.remoteAddr})
+
+	user, err := c.auth.AuthenticateUser(ctx, username, password)
 	if err != nil {
 		return err
 	}
 
+	if err := user.AuthenticateClientID(clientID, username); err != nil {
+		return err
+	}
+
+	c.setUser(user)
 	return nil
 }
 
 func (c *Client) handleConnect(clientID, username, password string) error {
+	event := AuditEvent{Action: AuditConnect, Username: username, ClientID: clientID, RemoteAddr: c.remoteAddr}
+
 	if err := c.authenticateConnect(clientID, username, password); err != nil {
-		log.WithFields(c.logFields).Info("client has connected")
-		c.writeConnectAck(ConnectionRefusedIdentifierRejected)
+		log.WithFields(c.logFields).WithError(err).Info("client has been refused")
+		event.Reason = err.Error()
+		c.broker.AuditUnauthenticated(c.ctx, &event)
+		if errors.Is(err, ErrAuthUnavailable) {
+			c.writeConnectAck(ConnectionRefusedServerUnavailable)
+		} else {
+			c.writeConnectAck(ConnectionRefusedIdentifierRejected)
+		}
 		return err
 	}
 
+	event.Allowed = true
+	c.broker.Audit(c.ctx, &event)
+
 	if err := c.broker.AddClient(c.ctx, clientID); err != nil {
 		log.WithError(err).Warn("failed to add a client")
 		c.writeConnectAck(ConnectionRefusedServerUnavailable)
@@ -91,14 +108,27 @@ func (c *Client) handleConnect(clientID, username, password string) error {
 	}
 	c.registered = true
 
+	// this removes limits left by a previous session of a user that has
+	// become unlimited
+	if err := c.broker.SetClientLimits(c.ctx, clientID, &c.currentUser().Limits); err != nil {
+		log.WithError(err).Warn("failed to set message queue limits")
+		c.writeConnectAck(ConnectionRefusedServerUnavailable)
+		return err
+	}
+
 	if err := c.writeConnectAck(ConnectionAccepted); err != nil {
 		log.Warn("failed to write connect ack")
 		return err
 	}
 
 	c.clientID = clientID
+	c.username = username
 	c.logFields["client_id"] = clientID
 
+	c.broker.addConnectedClient(c)
+
+	go c.keepAlive()
+
 	log.WithFields(c.logFields).Info("client has connected")
 	return nil
 }
@@ -0,0 +1,221 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageConsumer pops messages from the queue of published messages; each
+// message is kept in a processing list until acknowledged, and requeued if the
+// consumer dies before that
+type MessageConsumer struct {
+	broker *Broker
+	id     string
+}
+
+// ConsumedMessage is a message popped by a MessageConsumer
+type ConsumedMessage struct {
+	*QueuedMessage
+	raw string
+}
+
+const (
+	messageConsumersSet      = "/messages/consumers"
+	messageConsumerMapFmt    = "/messages/consumer/%s"
+	messageConsumerLastSeen  = "last_seen"
+	messageConsumerTTL       = 30 * time.Second
+	messageConsumerNackDelay = time.Second
+)
+
+// NewMessageConsumer registers a consumer of published messages, which stays
+// alive until ctx is canceled
+func (b *Broker) NewMessageConsumer(ctx context.Context) (*MessageConsumer, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &MessageConsumer{broker: b, id: id}
+
+	// the consumer must be alive before it's visible to the reaper
+	if err := c.touch(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := b.store.Set(messageConsumersSet).Add(ctx, id); err != nil {
+		return nil, err
+	}
+
+	go c.keepAlive(ctx)
+
+	return c, nil
+}
+
+func (c *MessageConsumer) touch(ctx context.Context) error {
+	m := c.broker.store.Map(fmt.Sprintf(messageConsumerMapFmt, c.id))
+
+	if err := m.Set(ctx, messageConsumerLastSeen, time.Now().Format(time.RFC3339)); err != nil {
+		return err
+	}
+
+	return m.Expire(ctx, messageConsumerTTL)
+}
+
+func (c *MessageConsumer) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(messageConsumerTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if err := c.touch(ctx); err != nil {
+				log.WithFields(log.Fields{"consumer": c.id}).WithError(err).Warn("Failed to refresh a message consumer")
+			}
+		}
+	}
+}
+
+// Pop pops one message from the queue of published messages
+func (c *MessageConsumer) Pop(ctx context.Context) (*ConsumedMessage, error) {
+	for {
+		raw, err := c.broker.store.Queue(messageQueue).PopReliable(ctx, c.id)
+		if err != nil {
+			return nil, err
+		}
+
+		queuedMessage, err := decodeMessage(raw)
+		if err == nil {
+			return &ConsumedMessage{QueuedMessage: queuedMessage, raw: raw}, nil
+		}
+
+		// a message that cannot be decoded is never going to be processed
+		if err := c.broker.store.Queue(messageQueue).Ack(ctx, c.id, raw); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Ack acknowledges that a message has been processed
+func (c *MessageConsumer) Ack(ctx context.Context, consumedMessage *ConsumedMessage) error {
+	return c.broker.store.Queue(messageQueue).Ack(ctx, c.id, consumedMessage.raw)
+}
+
+// Nack returns a message that could not be processed to the queue, after a
+// delay; after the maximum number of attempts, it's moved to the dead letter
+// queue instead
+func (c *MessageConsumer) Nack(ctx context.Context, consumedMessage *ConsumedMessage) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+
+	case <-time.After(messageConsumerNackDelay):
+	}
+
+	queuedMessage := *consumedMessage.QueuedMessage
+	queuedMessage.Attempts++
+
+	if queuedMessage.Attempts >= maxDeliveryAttempts {
+		if err := c.broker.deadLetterFanout(ctx, &queuedMessage); err != nil {
+			return err
+		}
+
+		return c.Ack(ctx, consumedMessage)
+	}
+
+	j, err := encodeMessage(&queuedMessage)
+	if err != nil {
+		return err
+	}
+
+	// if the consumer dies before the message is acknowledged, it may be
+	// processed twice, but it's never lost
+	if err := c.broker.store.Queue(messageQueue).Push(ctx, j); err != nil {
+		return err
+	}
+
+	return c.Ack(ctx, consumedMessage)
+}
+
+// Close unregisters a consumer and requeues the messages it has not
+// acknowledged
+func (c *MessageConsumer) Close(ctx context.Context) error {
+	if _, err := c.broker.store.Queue(messageQueue).Requeue(ctx, c.id); err != nil {
+		return err
+	}
+
+	if err := c.broker.store.Set(messageConsumersSet).Remove(ctx, c.id); err != nil {
+		return err
+	}
+
+	return c.broker.store.Map(fmt.Sprintf(messageConsumerMapFmt, c.id)).Destroy(ctx)
+}
+
+// requeueOrphanedMessages requeues messages popped by consumers that have died
+func (b *Broker) requeueOrphanedMessages(ctx context.Context) {
+	consumers, err := b.store.Set(messageConsumersSet).Members(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Failed to list message consumers")
+		return
+	}
+
+	for _, id := range consumers {
+		n, err := b.store.Map(fmt.Sprintf(messageConsumerMapFmt, id)).Len(ctx)
+		if err != nil {
+			log.WithError(err).Warn("Failed to check a message consumer")
+			continue
+		}
+
+		if n > 0 {
+			continue
+		}
+
+		requeued, err := b.store.Queue(messageQueue).Requeue(ctx, id)
+		if err != nil {
+			log.WithFields(log.Fields{"consumer": id}).WithError(err).Warn("Failed to requeue messages")
+			continue
+		}
+
+		log.WithFields(log.Fields{"consumer": id, "messages": requeued}).Warn("Requeued messages of a dead consumer")
+
+		b.store.Set(messageConsumersSet).Remove(ctx, id)
+	}
+}
+
+// RequeueOrphanedMessages periodically requeues messages popped by consumers
+// that have died before acknowledging them
+func (b *Broker) RequeueOrphanedMessages(ctx context.Context) {
+	ticker := time.NewTicker(messageConsumerTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			b.requeueOrphanedMessages(ctx)
+		}
+	}
+}
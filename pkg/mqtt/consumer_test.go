@@ -0,0 +1,238 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageConsumer_Ack(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	consumer, err := broker.NewMessageConsumer(ctx)
+	assert.Nil(t, err)
+
+	assert.Nil(t, broker.QueueMessage("/topic", "{}", 0, QoS1, 0))
+
+	consumedMessage, err := consumer.Pop(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "/topic", consumedMessage.Topic)
+
+	assert.Nil(t, consumer.Ack(ctx, consumedMessage))
+	assert.NotNil(t, consumer.Ack(ctx, consumedMessage))
+
+	assert.Nil(t, consumer.Close(ctx))
+
+	n, err := s.Queue(messageQueue).Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestMessageConsumer_Dead(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	consumerCtx, consumerCancel := context.WithCancel(ctx)
+
+	consumer, err := broker.NewMessageConsumer(consumerCtx)
+	assert.Nil(t, err)
+
+	otherConsumer, err := broker.NewMessageConsumer(ctx)
+	assert.Nil(t, err)
+
+	assert.Nil(t, broker.QueueMessage("/topic", "{}", 0, QoS1, 0))
+
+	_, err = consumer.Pop(ctx)
+	assert.Nil(t, err)
+
+	// messages of live consumers are not requeued
+	broker.requeueOrphanedMessages(ctx)
+
+	n, err := s.Queue(messageQueue).Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	// the consumer dies before it acknowledges the message
+	consumerCancel()
+	assert.Nil(t, s.Map(fmt.Sprintf(messageConsumerMapFmt, consumer.id)).Destroy(ctx))
+
+	broker.requeueOrphanedMessages(ctx)
+
+	consumedMessage, err := otherConsumer.Pop(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "/topic", consumedMessage.Topic)
+	assert.Nil(t, otherConsumer.Ack(ctx, consumedMessage))
+
+	consumers, err := s.Set(messageConsumersSet).Members(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{otherConsumer.id}, consumers)
+}
+
+func TestMessageConsumer_Nack(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	consumer, err := broker.NewMessageConsumer(ctx)
+	assert.Nil(t, err)
+
+	assert.Nil(t, broker.QueueMessage("/topic", "{}", 0, QoS1, 0))
+
+	consumedMessage, err := consumer.Pop(ctx)
+	assert.Nil(t, err)
+
+	assert.Nil(t, consumer.Nack(ctx, consumedMessage))
+
+	consumedMessage, err = consumer.Pop(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "/topic", consumedMessage.Topic)
+
+	// the consumer stops before it acknowledges the message
+	assert.Nil(t, consumer.Close(ctx))
+
+	n, err := s.Queue(messageQueue).Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestMessageConsumer_NackSubscribers(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	assert.Nil(t, broker.Subscribe(ctx, "a", "/topic"))
+	assert.Nil(t, broker.Subscribe(ctx, "b", "/topic"))
+
+	consumer, err := broker.NewMessageConsumer(ctx)
+	assert.Nil(t, err)
+
+	assert.Nil(t, broker.QueueMessage("/topic", "{}", 0, QoS0, 0))
+
+	consumedMessage, err := consumer.Pop(ctx)
+	assert.Nil(t, err)
+
+	// the message could not be queued for b
+	consumedMessage.Subscribers = []string{"b"}
+	assert.Nil(t, consumer.Nack(ctx, consumedMessage))
+
+	consumedMessage, err = consumer.Pop(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, consumedMessage.Attempts)
+	assert.Equal(t, []string{"b"}, consumedMessage.Subscribers)
+
+	assert.Nil(t, broker.QueueMessageForSubscribers(consumedMessage.QueuedMessage))
+	assert.Nil(t, consumer.Ack(ctx, consumedMessage))
+
+	for clientID, expected := range map[string]int64{"a": 0, "b": 1} {
+		n, err := s.Queue(fmt.Sprintf(clientMessageNotificationFmt, clientID)).Len(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, n)
+	}
+}
+
+func TestMessageConsumer_NackDeadLetter(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	consumer, err := broker.NewMessageConsumer(ctx)
+	assert.Nil(t, err)
+
+	assert.Nil(t, broker.QueueMessage("/topic", "{}", 0, QoS1, 0))
+
+	consumedMessage, err := consumer.Pop(ctx)
+	assert.Nil(t, err)
+
+	consumedMessage.Attempts = maxDeliveryAttempts - 1
+	consumedMessage.Subscribers = []string{"a"}
+	consumedMessage.Groups = []string{"$share/group/topic"}
+	assert.Nil(t, consumer.Nack(ctx, consumedMessage))
+
+	n, err := s.Queue(messageQueue).Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	deadLetters, err := broker.ListDeadLetters(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(deadLetters))
+
+	for _, deadLetter := range deadLetters {
+		assert.Equal(t, DeadLetterFanoutFailed, deadLetter.Reason)
+		assert.Equal(t, maxDeliveryAttempts, deadLetter.Attempts)
+
+		if deadLetter.ClientID == "" {
+			assert.Equal(t, "$share/group/topic", deadLetter.Message.Shared)
+		} else {
+			assert.Equal(t, "a", deadLetter.ClientID)
+		}
+	}
+}
+
+func TestMessageConsumer_NackDeadLettersFull(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+	broker.deadLetterLimits.max = 1
+
+	consumer, err := broker.NewMessageConsumer(ctx)
+	assert.Nil(t, err)
+
+	assert.Nil(t, broker.QueueMessage("/topic", "{}", 0, QoS1, 0))
+
+	consumedMessage, err := consumer.Pop(ctx)
+	assert.Nil(t, err)
+
+	consumedMessage.Attempts = maxDeliveryAttempts - 1
+	consumedMessage.Subscribers = []string{"a", "b"}
+	assert.Equal(t, ErrDeadLettersFull, consumer.Nack(ctx, consumedMessage))
+
+	deadLetters, err := broker.ListDeadLetters(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(deadLetters))
+}
@@ -0,0 +1,275 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/env"
+	"github.com/dimkr/yodi/pkg/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// DeadLetterReason explains why a message could not be delivered
+type DeadLetterReason string
+
+const (
+	// DeadLetterMaxAttempts indicates that a message was not acked after the
+	// maximum number of delivery attempts
+	DeadLetterMaxAttempts DeadLetterReason = "max_attempts"
+
+	// DeadLetterSessionExpired indicates that a client disconnected before it
+	// acked a message
+	DeadLetterSessionExpired DeadLetterReason = "session_expired"
+
+	// DeadLetterFanoutFailed indicates that a published message could not be
+	// queued for a subscriber after the maximum number of attempts
+	DeadLetterFanoutFailed DeadLetterReason = "fanout_failed"
+)
+
+// DeadLetter is a message that could not be delivered to a client; if the
+// client ID is empty, the message was not queued for the shared subscription
+// group of the message or, if the message is not shared, for any subscriber
+type DeadLetter struct {
+	ID       string           `json:"id"`
+	ClientID string           `json:"client_id"`
+	Reason   DeadLetterReason `json:"reason"`
+	Attempts int              `json:"attempts"`
+	Time     time.Time        `json:"time"`
+	Message  QueuedMessage    `json:"message"`
+}
+
+const (
+	deadLettersMap = "/deadletters"
+
+	defaultMaxDeadLetters = 10000
+	defaultDeadLetterTTL  = 7 * 24 * time.Hour
+)
+
+// ErrDeadLettersFull is returned when the dead letter queue is full
+var ErrDeadLettersFull = errors.New("dead letter queue is full")
+
+// deadLetterLimits limits the number of dead letters and the time they're kept
+type deadLetterLimits struct {
+	max int64
+	ttl time.Duration
+}
+
+// deadLetterLimitsFromEnv reads the maximum number of dead letters from
+// DEAD_LETTER_MAX and the time they're kept, in seconds, from DEAD_LETTER_TTL
+func deadLetterLimitsFromEnv() (deadLetterLimits, error) {
+	limits := deadLetterLimits{max: defaultMaxDeadLetters}
+
+	if s := os.Getenv("DEAD_LETTER_MAX"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			return limits, fmt.Errorf("Invalid DEAD_LETTER_MAX: %s", s)
+		}
+		limits.max = n
+	}
+
+	var err error
+	limits.ttl, err = env.Seconds("DEAD_LETTER_TTL", defaultDeadLetterTTL)
+	return limits, err
+}
+
+// LogFields returns logging context for a dead letter
+func (d *DeadLetter) LogFields() log.Fields {
+	return log.Fields{"dead_letter_id": d.ID, "client_id": d.ClientID, "reason": d.Reason, "attempts": d.Attempts}
+}
+
+func (b *Broker) deadLetter(ctx context.Context, clientID string, queuedMessage *QueuedMessage, reason DeadLetterReason) error {
+	id, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+
+	deadLetter := DeadLetter{
+		ID:       id,
+		ClientID: clientID,
+		Reason:   reason,
+		Attempts: queuedMessage.Attempts,
+		Time:     time.Now(),
+		Message:  *queuedMessage,
+	}
+
+	j, err := json.Marshal(&deadLetter)
+	if err != nil {
+		return err
+	}
+
+	// the number of dead letters is checked and the dead letter is added
+	// atomically, so concurrent brokers don't exceed the limit
+	if err := b.store.Transaction(ctx, []string{deadLettersMap}, func(ctx context.Context, tx store.Tx) error {
+		n, err := b.store.Map(deadLettersMap).Len(ctx)
+		if err != nil {
+			return err
+		}
+
+		if n >= b.deadLetterLimits.max {
+			return ErrDeadLettersFull
+		}
+
+		tx.MapSet(deadLettersMap, id, string(j))
+		return nil
+	}); err != nil {
+		if errors.Is(err, ErrDeadLettersFull) {
+			log.WithFields(queuedMessage.LogFields()).WithFields(deadLetter.LogFields()).Warn("Dead letter queue is full, dropping a message")
+			b.count(metricMessagesDropped, 1)
+		}
+		return err
+	}
+
+	log.WithFields(queuedMessage.LogFields()).WithFields(deadLetter.LogFields()).Warn("Moved a message to the dead letter queue")
+
+	if b.deadLetterLimits.ttl > 0 {
+		expireField(ctx, b.store.Map(deadLettersMap), id, b.deadLetterLimits.ttl)
+	}
+
+	return nil
+}
+
+// deadLetterFanout moves a published message, which could not be queued for
+// subscribers, to the dead letter queue
+func (b *Broker) deadLetterFanout(ctx context.Context, queuedMessage *QueuedMessage) error {
+	subscribers, groups := queuedMessage.Subscribers, queuedMessage.Groups
+
+	deadLetteredMessage := *queuedMessage
+	deadLetteredMessage.Subscribers = nil
+	deadLetteredMessage.Groups = nil
+
+	if len(subscribers) == 0 && len(groups) == 0 {
+		return b.deadLetter(ctx, "", &deadLetteredMessage, DeadLetterFanoutFailed)
+	}
+
+	for _, clientID := range subscribers {
+		if err := b.deadLetter(ctx, clientID, &deadLetteredMessage, DeadLetterFanoutFailed); err != nil {
+			return err
+		}
+	}
+
+	for _, shared := range groups {
+		sharedMessage := deadLetteredMessage
+		sharedMessage.Shared = shared
+
+		if err := b.deadLetter(ctx, "", &sharedMessage, DeadLetterFanoutFailed); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeadLetterMessage moves a message from the message queue of a client to the
+// dead letter queue
+func (b *Broker) DeadLetterMessage(ctx context.Context, clientID string, queuedMessage *QueuedMessage, reason DeadLetterReason) error {
+	if err := b.deadLetter(ctx, clientID, queuedMessage, reason); err != nil {
+		return err
+	}
+
+	return b.UnqueueMessageForSubscriber(ctx, clientID, queuedMessage.ID)
+}
+
+// GetDeadLetter returns a message from the dead letter queue
+func (b *Broker) GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	j, err := b.store.Map(deadLettersMap).Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var deadLetter DeadLetter
+	if err := json.Unmarshal([]byte(j), &deadLetter); err != nil {
+		return nil, err
+	}
+
+	return &deadLetter, nil
+}
+
+// ListDeadLetters returns all messages in the dead letter queue
+func (b *Broker) ListDeadLetters(ctx context.Context) ([]*DeadLetter, error) {
+	deadLetters := make([]*DeadLetter, 0)
+
+	err := b.store.Map(deadLettersMap).Scan(ctx, func(ctx context.Context, k, v string) {
+		var deadLetter DeadLetter
+		if err := json.Unmarshal([]byte(v), &deadLetter); err != nil {
+			log.WithFields(log.Fields{"dead_letter_id": k}).WithError(err).Warn("failed to decode a dead letter")
+			return
+		}
+
+		deadLetters = append(deadLetters, &deadLetter)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deadLetters, nil
+}
+
+// RequeueDeadLetter moves a message from the dead letter queue back to the
+// message queue of the client it was sent to, or to the queue of published
+// messages if it was not queued for subscribers
+func (b *Broker) RequeueDeadLetter(ctx context.Context, id string) error {
+	deadLetter, err := b.GetDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	queuedMessage := deadLetter.Message
+	queuedMessage.Attempts = 0
+	queuedMessage.Duplicate = false
+
+	log.WithFields(queuedMessage.LogFields()).WithFields(deadLetter.LogFields()).Info("Requeueing a dead letter")
+
+	switch {
+	case deadLetter.ClientID != "":
+		if err = b.QueueMessageForSubscriber(ctx, deadLetter.ClientID, &queuedMessage); err == nil {
+			// the client may be disconnected, so its keys expire like
+			// the keys of a client that is never reaped
+			err = b.expireClientKeys(ctx, deadLetter.ClientID)
+		}
+
+	case queuedMessage.Shared != "":
+		err = b.queueMessageForSharedSubscription(ctx, queuedMessage.Shared, &queuedMessage)
+
+	default:
+		var j string
+		if j, err = encodeMessage(&queuedMessage); err == nil {
+			err = b.store.Queue(messageQueue).Push(ctx, j)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return b.store.Map(deadLettersMap).Remove(ctx, id)
+}
+
+// PurgeDeadLetter removes a message from the dead letter queue
+func (b *Broker) PurgeDeadLetter(ctx context.Context, id string) error {
+	return b.store.Map(deadLettersMap).Remove(ctx, id)
+}
+
+// PurgeDeadLetters removes all messages from the dead letter queue
+func (b *Broker) PurgeDeadLetters(ctx context.Context) error {
+	return b.store.Map(deadLettersMap).Destroy(ctx)
+}
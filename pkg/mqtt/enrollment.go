@@ -0,0 +1,327 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// EnrollmentToken allows devices to enroll, which creates a user for each
+// device; the token itself is not stored, only its ID, which is its hash
+type EnrollmentToken struct {
+	ID      string    `json:"id"`
+	Role    string    `json:"role,omitempty"`
+	MaxUses int64     `json:"max_uses"`
+	Uses    int64     `json:"uses"`
+	Created time.Time `json:"created"`
+	Expiry  time.Time `json:"expiry"`
+}
+
+// Enrollment records the enrollment of a device
+type Enrollment struct {
+	TokenID    string    `json:"token_id"`
+	ClientID   string    `json:"client_id"`
+	Username   string    `json:"username"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// EnrolledDevice holds the credentials of an enrolled device, which are
+// returned only once
+type EnrolledDevice struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ACL      ACL    `json:"acl"`
+}
+
+const (
+	enrollmentTokensMap    = "/enrollment/tokens"
+	enrollmentTokenUsesMap = "/enrollment/uses"
+	enrollmentsList        = "/enrollments"
+
+	// maxEnrollments is the number of enrollments kept
+	maxEnrollments = 10000
+)
+
+// ErrInvalidEnrollmentToken indicates that an enrollment token is unknown,
+// expired or used up
+var ErrInvalidEnrollmentToken = errors.New("invalid enrollment token")
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// tokenID returns the ID of a token, which is its hash
+func tokenID(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// CreateEnrollmentToken creates a token that allows up to maxUses devices to
+// enroll within ttl, with a role; it returns the token, which cannot be
+// retrieved later
+func CreateEnrollmentToken(ctx context.Context, s store.Store, role string, maxUses int64, ttl time.Duration) (string, *EnrollmentToken, error) {
+	if maxUses <= 0 {
+		return "", nil, errors.New("maximum number of uses must be positive")
+	}
+
+	if ttl <= 0 {
+		return "", nil, errors.New("TTL must be positive")
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	enrollmentToken := EnrollmentToken{
+		ID:      tokenID(token),
+		Role:    role,
+		MaxUses: maxUses,
+		Created: now,
+		Expiry:  now.Add(ttl),
+	}
+
+	j, err := json.Marshal(&enrollmentToken)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := s.Map(enrollmentTokensMap).Set(ctx, enrollmentToken.ID, string(j)); err != nil {
+		return "", nil, err
+	}
+
+	return token, &enrollmentToken, nil
+}
+
+func loadEnrollmentToken(ctx context.Context, s store.Store, id string) (*EnrollmentToken, error) {
+	j, err := s.Map(enrollmentTokensMap).Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var enrollmentToken EnrollmentToken
+	if err := json.Unmarshal([]byte(j), &enrollmentToken); err != nil {
+		return nil, err
+	}
+
+	return &enrollmentToken, nil
+}
+
+// ListEnrollmentTokens returns all enrollment tokens
+func ListEnrollmentTokens(ctx context.Context, s store.Store) ([]*EnrollmentToken, error) {
+	tokens := make([]*EnrollmentToken, 0)
+
+	if err := s.Map(enrollmentTokensMap).Scan(ctx, func(ctx context.Context, k, v string) {
+		var enrollmentToken EnrollmentToken
+		if err := json.Unmarshal([]byte(v), &enrollmentToken); err != nil {
+			log.WithError(err).Warn("Failed to decode an enrollment token")
+			return
+		}
+
+		tokens = append(tokens, &enrollmentToken)
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, enrollmentToken := range tokens {
+		v, err := s.Map(enrollmentTokenUsesMap).Get(ctx, enrollmentToken.ID)
+		if err != nil {
+			if errors.Is(err, store.ErrNoKey) {
+				continue
+			}
+			return nil, err
+		}
+
+		enrollmentToken.Uses, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tokens, nil
+}
+
+// RevokeEnrollmentToken deletes an enrollment token
+func RevokeEnrollmentToken(ctx context.Context, s store.Store, id string) error {
+	if err := s.Map(enrollmentTokensMap).Remove(ctx, id); err != nil {
+		return err
+	}
+
+	if err := s.Map(enrollmentTokenUsesMap).Remove(ctx, id); err != nil && !errors.Is(err, store.ErrNoKey) {
+		return err
+	}
+
+	return nil
+}
+
+// useEnrollmentToken counts a use of an enrollment token, if it's still valid
+func useEnrollmentToken(ctx context.Context, s store.Store, token string) (*EnrollmentToken, error) {
+	enrollmentToken, err := loadEnrollmentToken(ctx, s, tokenID(token))
+	if err != nil {
+		if errors.Is(err, store.ErrNoKey) {
+			return nil, ErrInvalidEnrollmentToken
+		}
+		return nil, err
+	}
+
+	if time.Now().After(enrollmentToken.Expiry) {
+		return nil, ErrInvalidEnrollmentToken
+	}
+
+	uses := s.Map(enrollmentTokenUsesMap)
+
+	// the counter is incremented atomically, so concurrent enrollments cannot
+	// exceed the maximum number of uses
+	n, err := uses.Increment(ctx, enrollmentToken.ID, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > enrollmentToken.MaxUses {
+		uses.Increment(ctx, enrollmentToken.ID, -1)
+		return nil, ErrInvalidEnrollmentToken
+	}
+
+	enrollmentToken.Uses = n
+	return enrollmentToken, nil
+}
+
+// releaseEnrollmentToken returns a use of an enrollment token, after a failed
+// enrollment
+func releaseEnrollmentToken(ctx context.Context, s store.Store, enrollmentToken *EnrollmentToken) {
+	if _, err := s.Map(enrollmentTokenUsesMap).Increment(ctx, enrollmentToken.ID, -1); err != nil {
+		log.WithFields(log.Fields{"token_id": enrollmentToken.ID}).WithError(err).Warn("Failed to release an enrollment token")
+	}
+}
+
+// EnrollDevice uses an enrollment token to create a user for a device, with a
+// unique client ID, a random password and an ACL that allows it to use topics
+// under /<client ID>/, in addition to the permissions of the token's role; if
+// the enrollment cannot be recorded, the user is removed and the enrollment
+// fails
+func EnrollDevice(ctx context.Context, s store.Store, token, remoteAddr string) (*EnrolledDevice, error) {
+	enrollmentToken, err := useEnrollmentToken(ctx, s, token)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := enrollDevice(ctx, s, enrollmentToken, remoteAddr)
+	if err != nil {
+		releaseEnrollmentToken(ctx, s, enrollmentToken)
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{"client_id": device.ClientID, "token_id": enrollmentToken.ID}).Info("Enrolled a device")
+
+	return device, nil
+}
+
+func enrollDevice(ctx context.Context, s store.Store, enrollmentToken *EnrollmentToken, remoteAddr string) (*EnrolledDevice, error) {
+	clientID, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := HashPassword(password, DefaultPasswordAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	device := EnrolledDevice{
+		ClientID: clientID,
+		Username: clientID,
+		Password: password,
+		ACL:      ACL{"/" + clientID + "/#": {Publish: true, Subscribe: true, QoS: QoS1}},
+	}
+
+	user := User{ACL: device.ACL, Password: hash, ClientIDs: []string{clientID}}
+	if enrollmentToken.Role != "" {
+		user.Roles = []string{enrollmentToken.Role}
+	}
+
+	enrollment := Enrollment{
+		TokenID:    enrollmentToken.ID,
+		ClientID:   clientID,
+		Username:   device.Username,
+		RemoteAddr: remoteAddr,
+		Time:       time.Now(),
+	}
+
+	j, err := json.Marshal(&enrollment)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := SaveUser(ctx, s, device.Username, &user); err != nil {
+		return nil, err
+	}
+
+	// a device must not be able to connect without a record of its enrollment
+	if err := s.List(enrollmentsList).Push(ctx, string(j), maxEnrollments); err != nil {
+		if err := DeleteUser(ctx, s, device.Username); err != nil {
+			log.WithFields(log.Fields{"client_id": clientID}).WithError(err).Error("Failed to remove the user of a failed enrollment")
+		}
+
+		return nil, err
+	}
+
+	return &device, nil
+}
+
+// ListEnrollments returns all enrollments, newest first
+func ListEnrollments(ctx context.Context, s store.Store) ([]*Enrollment, error) {
+	values, err := s.List(enrollmentsList).Range(ctx, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	enrollments := make([]*Enrollment, 0, len(values))
+	for _, v := range values {
+		var enrollment Enrollment
+		if err := json.Unmarshal([]byte(v), &enrollment); err != nil {
+			log.WithError(err).Warn("Failed to decode an enrollment")
+			continue
+		}
+
+		enrollments = append(enrollments, &enrollment)
+	}
+
+	return enrollments, nil
+}
@@ -0,0 +1,144 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnrollDevice(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, SaveRole(ctx, s, "device", &Role{ACL: ACL{"/broadcast": {Subscribe: true}}}))
+
+	token, enrollmentToken, err := CreateEnrollmentToken(ctx, s, "device", 2, time.Hour)
+	assert.Nil(t, err)
+	assert.NotEqual(t, token, enrollmentToken.ID)
+
+	first, err := EnrollDevice(ctx, s, token, "10.0.0.1")
+	assert.Nil(t, err)
+
+	second, err := EnrollDevice(ctx, s, token, "10.0.0.2")
+	assert.Nil(t, err)
+	assert.NotEqual(t, first.ClientID, second.ClientID)
+
+	_, err = EnrollDevice(ctx, s, token, "10.0.0.3")
+	assert.Equal(t, ErrInvalidEnrollmentToken, err)
+
+	auth := NewAuthenticator(s)
+
+	user, err := auth.AuthenticateUser(ctx, first.Username, first.Password)
+	assert.Nil(t, err)
+	assert.Nil(t, user.AuthenticateClientID(first.ClientID, first.Username))
+	assert.NotNil(t, user.AuthenticateClientID(second.ClientID, first.Username))
+	assert.Nil(t, user.ACL.AuthenticatePublish("/"+first.ClientID+"/results", QoS1, first.ClientID, first.Username))
+	assert.NotNil(t, user.ACL.AuthenticatePublish("/"+second.ClientID+"/results", QoS1, first.ClientID, first.Username))
+	assert.Nil(t, user.ACL.AuthenticateSubscribe("/broadcast", QoS0, first.ClientID, first.Username))
+
+	stored, err := LoadUser(ctx, s, first.Username)
+	assert.Nil(t, err)
+	assert.True(t, IsPasswordHash(stored.Password))
+
+	tokens, err := ListEnrollmentTokens(ctx, s)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(tokens))
+	assert.Equal(t, int64(2), tokens[0].Uses)
+
+	enrollments, err := ListEnrollments(ctx, s)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(enrollments))
+	assert.Equal(t, second.ClientID, enrollments[0].ClientID)
+	assert.Equal(t, "10.0.0.2", enrollments[0].RemoteAddr)
+	assert.Equal(t, enrollmentToken.ID, enrollments[1].TokenID)
+}
+
+type failingListStore struct {
+	store.Store
+}
+
+type failingList struct {
+	store.List
+}
+
+func (s *failingListStore) List(key string) store.List {
+	return &failingList{List: s.Store.List(key)}
+}
+
+func (l *failingList) Push(ctx context.Context, val string, max int64) error {
+	return errors.New("unavailable")
+}
+
+func TestEnrollDevice_RecordFailure(t *testing.T) {
+	s := &failingListStore{Store: store.NewMemoryStore()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	token, _, err := CreateEnrollmentToken(ctx, s, "", 1, time.Hour)
+	assert.Nil(t, err)
+
+	_, err = EnrollDevice(ctx, s, token, "10.0.0.1")
+	assert.NotNil(t, err)
+
+	// the user is removed and the use of the token is returned
+	users, err := ListUsers(ctx, s)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(users))
+
+	tokens, err := ListEnrollmentTokens(ctx, s)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), tokens[0].Uses)
+}
+
+func TestEnrollDevice_InvalidToken(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := EnrollDevice(ctx, s, "abcd", "")
+	assert.Equal(t, ErrInvalidEnrollmentToken, err)
+
+	token, enrollmentToken, err := CreateEnrollmentToken(ctx, s, "", 1, time.Millisecond)
+	assert.Nil(t, err)
+
+	time.Sleep(time.Millisecond * 10)
+
+	_, err = EnrollDevice(ctx, s, token, "")
+	assert.Equal(t, ErrInvalidEnrollmentToken, err)
+
+	// the token ID cannot be used to enroll
+	token, enrollmentToken, err = CreateEnrollmentToken(ctx, s, "", 1, time.Hour)
+	assert.Nil(t, err)
+
+	_, err = EnrollDevice(ctx, s, enrollmentToken.ID, "")
+	assert.Equal(t, ErrInvalidEnrollmentToken, err)
+
+	assert.Nil(t, RevokeEnrollmentToken(ctx, s, enrollmentToken.ID))
+
+	_, err = EnrollDevice(ctx, s, token, "")
+	assert.Equal(t, ErrInvalidEnrollmentToken, err)
+}
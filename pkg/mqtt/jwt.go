@@ -0,0 +1,337 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/golang-jwt/jwt/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultClientIDClaim = "client_id"
+
+// JWTConfig configures a JWT authenticator
+type JWTConfig struct {
+	// Keys maps key IDs to keys: a []byte HS256 secret, an *rsa.PublicKey for
+	// RS256 or an ed25519.PublicKey for EdDSA; the key with an empty ID
+	// verifies tokens with an unknown key ID or without one
+	Keys map[string]interface{}
+
+	// Audience is the required value of the aud claim
+	Audience string
+
+	// ClientIDClaim is the claim that specifies the client ID the token may be
+	// used with; the default is client_id
+	ClientIDClaim string
+}
+
+type jwtAuthenticator struct {
+	store  store.Store
+	config JWTConfig
+	parser *jwt.Parser
+}
+
+// jwtUserClaims are claims that specify the permissions of a user
+type jwtUserClaims struct {
+	ACL    ACL         `json:"acl"`
+	Roles  []string    `json:"roles"`
+	Limits QueueLimits `json:"limits"`
+}
+
+var errNoKey = errors.New("no key")
+
+// ParsePublicKey parses a PEM-encoded RSA or Ed25519 public key
+func ParsePublicKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("Invalid PEM data")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %T", key)
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+}
+
+func (k *jwk) key() (interface{}, error) {
+	switch k.Kty {
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("Invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("Unsupported curve: %s", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid Ed25519 key")
+		}
+
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %s", k.Kty)
+	}
+}
+
+// ParseJWKS parses a JSON Web Key Set and returns its keys, by key ID
+func ParseJWKS(data []byte) (map[string]interface{}, error) {
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range jwks.Keys {
+		key, err := k.key()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse key '%s': %w", k.Kid, err)
+		}
+
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+// JWTConfigFromEnv returns a JWT authenticator configuration specified by the
+// JWT_SECRET, JWT_PUBLIC_KEY (a PEM file), JWT_JWKS (a JWKS file),
+// JWT_AUDIENCE and JWT_CLIENT_ID_CLAIM environment variables
+func JWTConfigFromEnv() (*JWTConfig, error) {
+	config := JWTConfig{
+		Keys:          make(map[string]interface{}),
+		Audience:      os.Getenv("JWT_AUDIENCE"),
+		ClientIDClaim: os.Getenv("JWT_CLIENT_ID_CLAIM"),
+	}
+
+	if path := os.Getenv("JWT_JWKS"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Keys, err = ParseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		config.Keys[""] = []byte(secret)
+	} else if path := os.Getenv("JWT_PUBLIC_KEY"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Keys[""], err = ParsePublicKey(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(config.Keys) == 0 {
+		return nil, errors.New("No JWT keys")
+	}
+
+	return &config, nil
+}
+
+// key returns the key that verifies a token, if it matches the token's
+// algorithm; otherwise, a token signed using an HMAC with a public key as the
+// secret could pass verification
+func (a *jwtAuthenticator) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := a.config.Keys[kid]
+	if !ok {
+		key, ok = a.config.Keys[""]
+		if !ok {
+			return nil, fmt.Errorf("%w: '%s'", errNoKey, kid)
+		}
+	}
+
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if _, ok := key.([]byte); ok {
+			return key, nil
+		}
+
+	case *jwt.SigningMethodRSA:
+		if _, ok := key.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+
+	case *jwt.SigningMethodEd25519:
+		if _, ok := key.(ed25519.PublicKey); ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: '%s' for %s", errNoKey, kid, token.Method.Alg())
+}
+
+func verifyAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (a *jwtAuthenticator) verifyClaims(claims jwt.MapClaims, username string) (*User, error) {
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("token is expired or has no expiry")
+	}
+
+	if a.config.Audience != "" && !verifyAudience(claims, a.config.Audience) {
+		return nil, errors.New("token has a bad audience")
+	}
+
+	if sub, ok := claims["sub"].(string); !ok || sub != username {
+		return nil, errors.New("token is for another user")
+	}
+
+	clientID, ok := claims[a.config.ClientIDClaim].(string)
+	if !ok || clientID == "" {
+		return nil, errors.New("token has no client ID")
+	}
+
+	// claims is already parsed, so it can be marshaled again
+	j, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	var userClaims jwtUserClaims
+	if err := json.Unmarshal(j, &userClaims); err != nil {
+		return nil, err
+	}
+
+	return &User{
+		ACL:       userClaims.ACL,
+		Roles:     userClaims.Roles,
+		ClientIDs: []string{clientID},
+		Limits:    userClaims.Limits,
+	}, nil
+}
+
+func (a *jwtAuthenticator) AuthenticateUser(ctx context.Context, username, password string) (*User, error) {
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(password, claims, a.key); err != nil {
+		log.WithFields(log.Fields{"username": username}).WithError(err).Info("Rejected a token")
+		return nil, ErrBadCredentials
+	}
+
+	user, err := a.verifyClaims(claims, username)
+	if err != nil {
+		log.WithFields(log.Fields{"username": username}).WithError(err).Info("Rejected a token")
+		return nil, ErrBadCredentials
+	}
+
+	// a connected client is authenticated again using the claims, not the
+	// token, until the token expires
+	user.refresh = func(ctx context.Context) (*User, error) {
+		if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+			return nil, ErrBadCredentials
+		}
+
+		return ResolveRoles(ctx, a.store, user)
+	}
+
+	return ResolveRoles(ctx, a.store, user)
+}
+
+// NewJWTAuthenticator returns a new authenticator that treats passwords as
+// signed tokens, which specify the username (sub), the client ID, the ACL, roles
+// and message queue limits of a user
+func NewJWTAuthenticator(store store.Store, config JWTConfig) Authenticator {
+	if config.ClientIDClaim == "" {
+		config.ClientIDClaim = defaultClientIDClaim
+	}
+
+	return &jwtAuthenticator{
+		store:  store,
+		config: config,
+		parser: &jwt.Parser{ValidMethods: []string{"HS256", "RS256", "EdDSA"}},
+	}
+}
@@ -0,0 +1,178 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	s, err := token.SignedString(key)
+	assert.Nil(t, err)
+	return s
+}
+
+func deviceClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":       "user1",
+		"aud":       "yodi",
+		"exp":       time.Now().Add(time.Minute).Unix(),
+		"client_id": "abcd",
+		"acl": map[string]interface{}{
+			"/%c/commands": map[string]interface{}{"subscribe": true, "qos": 1},
+		},
+	}
+}
+
+func TestJWTAuthenticator_HS256(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	secret := []byte("secret")
+	auth := NewJWTAuthenticator(store.NewMemoryStore(), JWTConfig{Keys: map[string]interface{}{"": secret}, Audience: "yodi"})
+
+	user, err := auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodHS256, secret, "", deviceClaims()))
+	assert.Nil(t, err)
+	assert.Nil(t, user.AuthenticateClientID("abcd", "user1"))
+	assert.Equal(t, ErrClientIDRejected, user.AuthenticateClientID("efgh", "user1"))
+	assert.Nil(t, user.ACL.AuthenticateSubscribe("/abcd/commands", QoS1, "abcd", "user1"))
+	assert.NotNil(t, user.ACL.AuthenticatePublish("/abcd/commands", QoS0, "abcd", "user1"))
+
+	_, err = auth.AuthenticateUser(ctx, "user2", signToken(t, jwt.SigningMethodHS256, secret, "", deviceClaims()))
+	assert.Equal(t, ErrBadCredentials, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodHS256, []byte("secret2"), "", deviceClaims()))
+	assert.Equal(t, ErrBadCredentials, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Equal(t, ErrBadCredentials, err)
+
+	claims := deviceClaims()
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodHS256, secret, "", claims))
+	assert.Equal(t, ErrBadCredentials, err)
+
+	claims = deviceClaims()
+	delete(claims, "exp")
+	_, err = auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodHS256, secret, "", claims))
+	assert.Equal(t, ErrBadCredentials, err)
+
+	claims = deviceClaims()
+	claims["aud"] = "other"
+	_, err = auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodHS256, secret, "", claims))
+	assert.Equal(t, ErrBadCredentials, err)
+
+	claims["aud"] = []string{"other", "yodi"}
+	_, err = auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodHS256, secret, "", claims))
+	assert.Nil(t, err)
+
+	claims = deviceClaims()
+	delete(claims, "client_id")
+	_, err = auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodHS256, secret, "", claims))
+	assert.Equal(t, ErrBadCredentials, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", deviceClaims()))
+	assert.Equal(t, ErrBadCredentials, err)
+}
+
+func TestJWTAuthenticator_RS256(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	assert.Nil(t, err)
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	publicKey, err := ParsePublicKey(publicKeyPEM)
+	assert.Nil(t, err)
+
+	auth := NewJWTAuthenticator(store.NewMemoryStore(), JWTConfig{Keys: map[string]interface{}{"": publicKey}})
+
+	_, err = auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodRS256, privateKey, "", deviceClaims()))
+	assert.Nil(t, err)
+
+	// a token signed with the public key as an HMAC secret must be rejected
+	_, err = auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodHS256, publicKeyPEM, "", deviceClaims()))
+	assert.Equal(t, ErrBadCredentials, err)
+}
+
+func TestJWTAuthenticator_JWKS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	ed25519PublicKey, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	jwks := fmt.Sprintf(
+		`{"keys": [{"kty": "RSA", "kid": "rsa", "n": "%s", "e": "%s"}, {"kty": "OKP", "kid": "ed25519", "crv": "Ed25519", "x": "%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		base64.RawURLEncoding.EncodeToString(ed25519PublicKey),
+	)
+
+	keys, err := ParseJWKS([]byte(jwks))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(keys))
+
+	s := store.NewMemoryStore()
+	assert.Nil(t, SaveRole(ctx, s, "device", &Role{ACL: ACL{"/%c/results": {Publish: true}}}))
+
+	auth := NewJWTAuthenticator(s, JWTConfig{Keys: keys})
+
+	claims := deviceClaims()
+	claims["roles"] = []string{"device"}
+
+	user, err := auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodEdDSA, ed25519Key, "ed25519", claims))
+	assert.Nil(t, err)
+	assert.Nil(t, user.ACL.AuthenticatePublish("/abcd/results", QoS0, "abcd", "user1"))
+	assert.Nil(t, user.ACL.AuthenticateSubscribe("/abcd/commands", QoS1, "abcd", "user1"))
+
+	_, err = auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", deviceClaims()))
+	assert.Nil(t, err)
+
+	// the key ID must match the signing key
+	_, err = auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodRS256, rsaKey, "ed25519", deviceClaims()))
+	assert.Equal(t, ErrBadCredentials, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", signToken(t, jwt.SigningMethodRS256, rsaKey, "", deviceClaims()))
+	assert.Equal(t, ErrBadCredentials, err)
+}
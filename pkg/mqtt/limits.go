@@ -0,0 +1,298 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/dimkr/yodi/pkg/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// QueueLimitPolicy determines what happens when a client's message queue is
+// full
+type QueueLimitPolicy string
+
+const (
+	// DropOldest drops the oldest unacked messages to make room for new ones
+	DropOldest QueueLimitPolicy = "drop_oldest"
+
+	// DropNewest drops new messages
+	DropNewest QueueLimitPolicy = "drop_newest"
+
+	// RejectPublish rejects messages published to a topic the client is
+	// subscribed to
+	RejectPublish QueueLimitPolicy = "reject"
+)
+
+// QueueLimits limits the number and total size of messages queued for a
+// client; zero means no limit
+type QueueLimits struct {
+	MaxMessages int64            `json:"max_messages,omitempty"`
+	MaxBytes    int64            `json:"max_bytes,omitempty"`
+	Policy      QueueLimitPolicy `json:"policy,omitempty"`
+}
+
+const (
+	clientLimitsMap     = "/limits"
+	clientUsageMapFmt   = "/client/%s/usage"
+	clientUsageMessages = "messages"
+	clientUsageBytes    = "bytes"
+)
+
+// ErrQueueFull is returned when a client's message queue is full
+var ErrQueueFull = errors.New("message queue is full")
+
+// Unlimited determines whether or not limits are set
+func (l *QueueLimits) Unlimited() bool {
+	return l.MaxMessages == 0 && l.MaxBytes == 0
+}
+
+// Validate determines whether or not limits are valid
+func (l *QueueLimits) Validate() error {
+	if l.MaxMessages < 0 || l.MaxBytes < 0 {
+		return errors.New("limits must not be negative")
+	}
+
+	switch l.Policy {
+	case "", DropOldest, DropNewest, RejectPublish:
+		return nil
+
+	default:
+		return fmt.Errorf("unknown policy: %s", l.Policy)
+	}
+}
+
+func (l *QueueLimits) exceeded(messages, bytes int64) bool {
+	return (l.MaxMessages > 0 && messages > l.MaxMessages) || (l.MaxBytes > 0 && bytes > l.MaxBytes)
+}
+
+// SetClientLimits sets the message queue limits of a client, or removes them
+// if unlimited
+func (b *Broker) SetClientLimits(ctx context.Context, clientID string, limits *QueueLimits) error {
+	if limits.Unlimited() {
+		if err := b.store.Map(clientLimitsMap).Remove(ctx, clientID); err != nil && !errors.Is(err, store.ErrNoKey) {
+			return err
+		}
+
+		return nil
+	}
+
+	j, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+
+	return b.store.Map(clientLimitsMap).Set(ctx, clientID, string(j))
+}
+
+func (b *Broker) getClientLimits(ctx context.Context, clientID string) (*QueueLimits, error) {
+	var limits QueueLimits
+
+	j, err := b.store.Map(clientLimitsMap).Get(ctx, clientID)
+	if err != nil {
+		if errors.Is(err, store.ErrNoKey) {
+			return &limits, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(j), &limits); err != nil {
+		return nil, err
+	}
+
+	return &limits, nil
+}
+
+// GetClientUsage returns the number and total size of messages queued for a
+// client
+func (b *Broker) GetClientUsage(ctx context.Context, clientID string) (int64, int64, error) {
+	usage := b.store.Map(fmt.Sprintf(clientUsageMapFmt, clientID))
+
+	var counters [2]int64
+	for i, k := range []string{clientUsageMessages, clientUsageBytes} {
+		v, err := usage.Get(ctx, k)
+		if err != nil {
+			if errors.Is(err, store.ErrNoKey) {
+				continue
+			}
+			return 0, 0, err
+		}
+
+		counters[i], err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return counters[0], counters[1], nil
+}
+
+// updateClientUsage queues an update of the number and total size of messages
+// queued for a client
+func updateClientUsage(tx store.Tx, clientID string, messages, bytes int64) {
+	usage := fmt.Sprintf(clientUsageMapFmt, clientID)
+	tx.MapIncrement(usage, clientUsageMessages, messages)
+	tx.MapIncrement(usage, clientUsageBytes, bytes)
+}
+
+// dropOldestMessages drops old messages until the number and total size of
+// messages queued for a client don't exceed its limits
+func (b *Broker) dropOldestMessages(ctx context.Context, clientID string, limits *QueueLimits, messages, bytes int64) (int64, int64, error) {
+	unacked := make([]*QueuedMessage, 0)
+	if err := b.ScanQueuedMessagesForClient(ctx, clientID, func(queuedMessage *QueuedMessage) {
+		unacked = append(unacked, queuedMessage)
+	}); err != nil {
+		return messages, bytes, err
+	}
+
+	sort.Slice(unacked, func(i, j int) bool {
+		return unacked[i].QueueTime.Before(unacked[j].QueueTime)
+	})
+
+	for _, queuedMessage := range unacked {
+		if !limits.exceeded(messages, bytes) {
+			break
+		}
+
+		// the message may have been acked or dropped by others, and its
+		// notification is skipped when it's no longer queued
+		if err := b.UnqueueMessageForSubscriber(ctx, clientID, queuedMessage.ID); err != nil {
+			continue
+		}
+
+		log.WithFields(queuedMessage.LogFields()).WithFields(log.Fields{"client_id": clientID}).Warn("Message queue is full, dropping the oldest message")
+		b.count(metricMessagesDropped, 1)
+
+		messages--
+		bytes -= int64(len(queuedMessage.Message))
+	}
+
+	return messages, bytes, nil
+}
+
+// releaseClientUsage cancels the reservation of a message that was not queued
+func (b *Broker) releaseClientUsage(ctx context.Context, clientID string, bytes int64) {
+	usage := b.store.Map(fmt.Sprintf(clientUsageMapFmt, clientID))
+
+	if _, err := usage.Increment(ctx, clientUsageMessages, -1); err != nil {
+		log.WithFields(log.Fields{"client_id": clientID}).WithError(err).Warn("Failed to update message queue usage")
+	}
+
+	if _, err := usage.Increment(ctx, clientUsageBytes, -bytes); err != nil {
+		log.WithFields(log.Fields{"client_id": clientID}).WithError(err).Warn("Failed to update message queue usage")
+	}
+}
+
+// reserveClientUsage adds a message to the usage counters of a client before
+// it's queued, so concurrent publishers cannot exceed the limits together;
+// if the limits are exceeded, old messages are dropped to make room for it,
+// or the reservation is cancelled
+func (b *Broker) reserveClientUsage(ctx context.Context, clientID string, limits *QueueLimits, queuedMessage *QueuedMessage) error {
+	usage := b.store.Map(fmt.Sprintf(clientUsageMapFmt, clientID))
+	size := int64(len(queuedMessage.Message))
+
+	messages, err := usage.Increment(ctx, clientUsageMessages, 1)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := usage.Increment(ctx, clientUsageBytes, size)
+	if err != nil {
+		usage.Increment(ctx, clientUsageMessages, -1)
+		return err
+	}
+
+	if !limits.exceeded(messages, bytes) {
+		return nil
+	}
+
+	if limits.Policy == DropOldest {
+		messages, bytes, err = b.dropOldestMessages(ctx, clientID, limits, messages, bytes)
+		if err == nil && !limits.exceeded(messages, bytes) {
+			return nil
+		}
+	}
+
+	b.releaseClientUsage(ctx, clientID, size)
+
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(queuedMessage.LogFields()).WithFields(log.Fields{"client_id": clientID}).Warn("Message queue is full, dropping a message")
+	b.count(metricMessagesDropped, 1)
+
+	return ErrQueueFull
+}
+
+// rejectsMessage determines whether or not a subscriber rejects messages when
+// its queue is full, and a message would exceed its limits
+func (b *Broker) rejectsMessage(ctx context.Context, clientID string, size int64) (bool, error) {
+	limits, err := b.getClientLimits(ctx, clientID)
+	if err != nil || limits.Unlimited() || limits.Policy != RejectPublish {
+		return false, err
+	}
+
+	messages, bytes, err := b.GetClientUsage(ctx, clientID)
+	if err != nil {
+		return false, err
+	}
+
+	return limits.exceeded(messages+1, bytes+size), nil
+}
+
+// CheckSubscriberLimits determines whether or not a message can be published
+// to a topic, without exceeding the message queue limits of subscribers that
+// reject messages when their queue is full; these are the subscribers that
+// receive the message, directly or through wildcard filters, and all members of
+// shared subscription groups, because any member may receive the message
+func (b *Broker) CheckSubscriberLimits(ctx context.Context, topic string, msg string) error {
+	subscribers, groups, err := b.topicSubscribers(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	for _, shared := range groups {
+		members, err := b.store.Set(subscribersSetKey(shared)).Members(ctx)
+		if err != nil {
+			return err
+		}
+
+		subscribers = append(subscribers, members...)
+	}
+
+	for _, clientID := range subscribers {
+		full, err := b.rejectsMessage(ctx, clientID, int64(len(msg)))
+		if err != nil {
+			log.WithFields(log.Fields{"client_id": clientID}).WithError(err).Warn("Failed to check message queue limits")
+			continue
+		}
+
+		if full {
+			b.count(metricMessagesRejected, 1)
+			return ErrQueueFull
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func queueTestMessages(t *testing.T, broker *Broker, topic string, messages ...string) {
+	for _, msg := range messages {
+		assert.Nil(t, broker.QueueMessageForSubscribers(&QueuedMessage{Topic: topic, Message: msg, QoS: QoS1}))
+	}
+}
+
+func scanTestMessages(t *testing.T, ctx context.Context, broker *Broker, clientID string) map[string]struct{} {
+	messages := make(map[string]struct{})
+	assert.Nil(t, broker.ScanQueuedMessagesForClient(ctx, clientID, func(queuedMessage *QueuedMessage) {
+		messages[queuedMessage.Message] = struct{}{}
+	}))
+	return messages
+}
+
+func TestQueueLimits_DropNewest(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	clientID := "abcd"
+	topic := "/topic"
+
+	assert.Nil(t, broker.SetClientLimits(ctx, clientID, &QueueLimits{MaxMessages: 2, Policy: DropNewest}))
+	assert.Nil(t, broker.Subscribe(ctx, clientID, topic))
+
+	queueTestMessages(t, broker, topic, "1", "2", "3")
+
+	assert.Equal(t, map[string]struct{}{"1": {}, "2": {}}, scanTestMessages(t, ctx, broker, clientID))
+
+	messages, bytes, err := broker.GetClientUsage(ctx, clientID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), messages)
+	assert.Equal(t, int64(2), bytes)
+}
+
+func TestQueueLimits_DropOldest(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	clientID := "abcd"
+	topic := "/topic"
+
+	assert.Nil(t, broker.SetClientLimits(ctx, clientID, &QueueLimits{MaxBytes: 4, Policy: DropOldest}))
+	assert.Nil(t, broker.Subscribe(ctx, clientID, topic))
+
+	queueTestMessages(t, broker, topic, "1", "2", "345")
+
+	assert.Equal(t, map[string]struct{}{"2": {}, "345": {}}, scanTestMessages(t, ctx, broker, clientID))
+
+	messages, bytes, err := broker.GetClientUsage(ctx, clientID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), messages)
+	assert.Equal(t, int64(4), bytes)
+}
+
+func TestQueueLimits_RejectPublish(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	clientID := "abcd"
+	topic := "/topic"
+
+	assert.Nil(t, broker.SetClientLimits(ctx, clientID, &QueueLimits{MaxMessages: 1, Policy: RejectPublish}))
+	assert.Nil(t, broker.Subscribe(ctx, clientID, topic))
+
+	assert.Nil(t, broker.CheckSubscriberLimits(ctx, topic, "1"))
+	queueTestMessages(t, broker, topic, "1")
+	assert.Equal(t, ErrQueueFull, broker.CheckSubscriberLimits(ctx, topic, "2"))
+
+	c := broker.GetMessagesChannelForClient(ctx, clientID)
+	receivedMessage := <-c
+	assert.Nil(t, broker.UnqueueMessageForSubscriber(ctx, clientID, receivedMessage.ID))
+
+	assert.Nil(t, broker.CheckSubscriberLimits(ctx, topic, "2"))
+}
+
+func TestQueueLimits_RejectPublishFilters(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	for _, subscription := range []struct {
+		clientID, topic string
+	}{
+		{"abcd", "/a/+"},
+		{"efgh", "$share/group//b/#"},
+		{"ijkl", "$share/group//b/#"},
+	} {
+		assert.Nil(t, broker.SetClientLimits(ctx, subscription.clientID, &QueueLimits{MaxMessages: 1, Policy: RejectPublish}))
+		assert.Nil(t, broker.Subscribe(ctx, subscription.clientID, subscription.topic))
+	}
+
+	// subscribers through wildcard filters are checked
+	queueTestMessages(t, broker, "/a/b", "1")
+	assert.Equal(t, ErrQueueFull, broker.CheckSubscriberLimits(ctx, "/a/c", "2"))
+
+	// any member of a group may receive the message
+	assert.Nil(t, broker.CheckSubscriberLimits(ctx, "/b/c", "1"))
+	queueTestMessages(t, broker, "/b/c", "1")
+	assert.Equal(t, ErrQueueFull, broker.CheckSubscriberLimits(ctx, "/b/c", "2"))
+
+	// limits are removed when a client becomes unlimited
+	assert.Nil(t, broker.SetClientLimits(ctx, "abcd", &QueueLimits{}))
+	assert.Nil(t, broker.CheckSubscriberLimits(ctx, "/a/c", "2"))
+
+	_, err = s.Map(clientLimitsMap).Get(ctx, "abcd")
+	assert.True(t, errors.Is(err, store.ErrNoKey))
+}
+
+func TestHandlePublish_Rejected(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: "password1", ACL: ACL{"/%c/log": {Publish: true, QoS: QoS1}}}))
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	assert.Nil(t, broker.SetClientLimits(ctx, "efgh", &QueueLimits{MaxMessages: 1, Policy: RejectPublish}))
+	assert.Nil(t, broker.Subscribe(ctx, "efgh", "/+/log"))
+	queueTestMessages(t, broker, "/abcd/log", "1")
+
+	c := connectTestClient(t, broker, "abcd", "user1", "password1")
+	defer c.Close()
+
+	// the message is acked, but not queued
+	assert.Nil(t, c.handlePublish("/abcd/log", []byte("2"), 1, QoS1))
+
+	length, err := s.Queue(messageQueue).Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), length)
+
+	events, err := ListAuditEvents(ctx, s, &AuditFilter{Action: AuditPublish, Denied: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+}
+
+func TestQueueLimits_DropOldestNotification(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	clientID := "abcd"
+	topic := "/topic"
+
+	assert.Nil(t, broker.SetClientLimits(ctx, clientID, &QueueLimits{MaxMessages: 1, Policy: DropOldest}))
+	assert.Nil(t, broker.Subscribe(ctx, clientID, topic))
+
+	queueTestMessages(t, broker, topic, "1", "2")
+
+	// the notification of the dropped message is skipped
+	c := broker.GetMessagesChannelForClient(ctx, clientID)
+	receivedMessage := <-c
+	assert.Equal(t, "2", receivedMessage.Message)
+
+	assert.Nil(t, broker.UnqueueMessageForSubscriber(ctx, clientID, receivedMessage.ID))
+	assert.NotNil(t, broker.UnqueueMessageForSubscriber(ctx, clientID, receivedMessage.ID))
+
+	messages, bytes, err := broker.GetClientUsage(ctx, clientID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), messages)
+	assert.Equal(t, int64(0), bytes)
+}
+
+func TestQueueLimits_DropOldestQoS0(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	clientID := "abcd"
+	topic := "/topic"
+
+	assert.Nil(t, broker.SetClientLimits(ctx, clientID, &QueueLimits{MaxMessages: 1, Policy: DropOldest}))
+	assert.Nil(t, broker.Subscribe(ctx, clientID, topic))
+
+	for _, msg := range []string{"1", "2"} {
+		assert.Nil(t, broker.QueueMessageForSubscribers(&QueuedMessage{Topic: topic, Message: msg, QoS: QoS0}))
+	}
+
+	assert.Equal(t, map[string]struct{}{"2": {}}, scanTestMessages(t, ctx, broker, clientID))
+
+	c := broker.GetMessagesChannelForClient(ctx, clientID)
+	receivedMessage := <-c
+	assert.Equal(t, "2", receivedMessage.Message)
+
+	// messages with QoS 0 are removed from the queue when delivered
+	assert.Equal(t, map[string]struct{}{}, scanTestMessages(t, ctx, broker, clientID))
+
+	messages, bytes, err := broker.GetClientUsage(ctx, clientID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), messages)
+	assert.Equal(t, int64(0), bytes)
+}
+
+func TestQueueLimits_UpdateDropped(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, store, NewAuthenticator(store))
+	assert.Nil(t, err)
+
+	clientID := "abcd"
+	topic := "/topic"
+
+	assert.Nil(t, broker.Subscribe(ctx, clientID, topic))
+	queueTestMessages(t, broker, topic, "1")
+
+	c := broker.GetMessagesChannelForClient(ctx, clientID)
+	receivedMessage := <-c
+	assert.Nil(t, broker.UnqueueMessageForSubscriber(ctx, clientID, receivedMessage.ID))
+
+	// a message is not queued again when updated after it's dropped
+	assert.NotNil(t, broker.UpdateQueuedMessageForSubscriber(ctx, clientID, receivedMessage))
+	assert.Equal(t, map[string]struct{}{}, scanTestMessages(t, ctx, broker, clientID))
+}
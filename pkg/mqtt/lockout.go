@@ -0,0 +1,328 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	userLockoutsMap = "/lockouts/users"
+	ipLockoutsMap   = "/lockouts/ips"
+
+	// operators are locked out separately, so misbehaving devices that share
+	// an address with an operator cannot lock the operator out
+	operatorLockoutsMap   = "/lockouts/operators"
+	operatorIPLockoutsMap = "/lockouts/operators/ips"
+
+	// failed attempts are counted separately, using atomic increments, so
+	// concurrent attempts are never lost
+	lockoutFailuresSuffix = "/failures"
+
+	// userLockoutThreshold is the number of failed attempts to authenticate
+	// as a user, before it is locked out
+	userLockoutThreshold = 5
+
+	// ipLockoutThreshold is the number of failed attempts to authenticate
+	// from an address, before it is locked out; it is higher, because many
+	// clients may share an address
+	ipLockoutThreshold = 20
+
+	lockoutInitialDelay = time.Second
+	lockoutMaxDelay     = time.Hour
+
+	// lockoutResetAfter is the duration after which failed attempts are
+	// forgotten
+	lockoutResetAfter = time.Hour * 24
+)
+
+// ErrLockedOut indicates that a user or an address is temporarily not allowed
+// to authenticate, after too many failed attempts
+var ErrLockedOut = fmt.Errorf("%w: locked out", ErrBadCredentials)
+
+// Lockout tracks failed attempts to authenticate as a user or from an address
+type Lockout struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	Until       time.Time `json:"until,omitempty"`
+}
+
+// Lockouts holds failed authentication attempts, by username and by address,
+// of devices and of operators
+type Lockouts struct {
+	Users       map[string]*Lockout `json:"users"`
+	IPs         map[string]*Lockout `json:"ips"`
+	Operators   map[string]*Lockout `json:"operators"`
+	OperatorIPs map[string]*Lockout `json:"operator_ips"`
+}
+
+// lockoutScope counts failed attempts by one kind of key, in a map
+type lockoutScope struct {
+	m         string
+	threshold int
+}
+
+var (
+	userLockouts       = lockoutScope{m: userLockoutsMap, threshold: userLockoutThreshold}
+	ipLockouts         = lockoutScope{m: ipLockoutsMap, threshold: ipLockoutThreshold}
+	operatorLockouts   = lockoutScope{m: operatorLockoutsMap, threshold: userLockoutThreshold}
+	operatorIPLockouts = lockoutScope{m: operatorIPLockoutsMap, threshold: ipLockoutThreshold}
+)
+
+type lockoutAuthenticator struct {
+	store store.Store
+	next  Authenticator
+}
+
+// lockoutDelay returns the duration of a lockout after a number of failed
+// attempts, which doubles with each attempt beyond the threshold
+func lockoutDelay(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+
+	delay := lockoutInitialDelay
+	for i := threshold; i < failures && delay < lockoutMaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > lockoutMaxDelay {
+		delay = lockoutMaxDelay
+	}
+
+	return delay
+}
+
+func loadLockout(ctx context.Context, m store.Map, key string) (*Lockout, error) {
+	j, err := m.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, store.ErrNoKey) {
+			return &Lockout{}, nil
+		}
+		return nil, err
+	}
+
+	var lockout Lockout
+	if err := json.Unmarshal([]byte(j), &lockout); err != nil {
+		return nil, err
+	}
+
+	return &lockout, nil
+}
+
+func lockedOut(ctx context.Context, s store.Store, scope lockoutScope, key string, now time.Time) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+
+	lockout, err := loadLockout(ctx, s.Map(scope.m), key)
+	if err != nil {
+		return false, err
+	}
+
+	return now.Before(lockout.Until), nil
+}
+
+func fail(ctx context.Context, s store.Store, scope lockoutScope, key string, now time.Time) error {
+	if key == "" {
+		return nil
+	}
+
+	m := s.Map(scope.m)
+	failures := s.Map(scope.m + lockoutFailuresSuffix)
+
+	lockout, err := loadLockout(ctx, m, key)
+	if err != nil {
+		return err
+	}
+
+	if !lockout.LastFailure.IsZero() && now.Sub(lockout.LastFailure) > lockoutResetAfter {
+		if err := failures.Remove(ctx, key); err != nil && !errors.Is(err, store.ErrNoKey) {
+			return err
+		}
+	}
+
+	n, err := failures.Increment(ctx, key, 1)
+	if err != nil {
+		return err
+	}
+	expireField(ctx, failures, key, lockoutResetAfter)
+
+	lockout.Failures = int(n)
+	lockout.LastFailure = now
+	if delay := lockoutDelay(lockout.Failures, scope.threshold); delay > 0 {
+		lockout.Until = now.Add(delay)
+		log.WithFields(log.Fields{"key": key, "failures": lockout.Failures, "until": lockout.Until}).Warn("Locking out")
+	}
+
+	j, err := json.Marshal(lockout)
+	if err != nil {
+		return err
+	}
+
+	if err := m.Set(ctx, key, string(j)); err != nil {
+		return err
+	}
+
+	expireField(ctx, m, key, lockoutResetAfter)
+	return nil
+}
+
+// withLockouts rejects an authentication attempt if a user or an address is
+// locked out, and counts it as a failed attempt of both if it fails with
+// ErrBadCredentials
+func withLockouts(ctx context.Context, s store.Store, users lockoutScope, username string, ips lockoutScope, ip string, authenticate func() error) error {
+	now := time.Now()
+
+	for _, lockout := range []struct {
+		scope lockoutScope
+		key   string
+	}{{users, username}, {ips, ip}} {
+		locked, err := lockedOut(ctx, s, lockout.scope, lockout.key, now)
+		if err != nil {
+			return err
+		}
+		if locked {
+			return ErrLockedOut
+		}
+	}
+
+	err := authenticate()
+	if err == nil {
+		// a successful attempt from an address doesn't clear its failed
+		// attempts, because it may try to guess passwords of other users
+		if err := clearLockout(ctx, s, users, username); err != nil && !errors.Is(err, store.ErrNoKey) {
+			log.WithError(err).Warn("Failed to clear failed attempts")
+		}
+
+		return nil
+	}
+
+	if errors.Is(err, ErrBadCredentials) {
+		if err := fail(ctx, s, users, username, now); err != nil {
+			log.WithError(err).Warn("Failed to count a failed attempt")
+		}
+
+		if err := fail(ctx, s, ips, ip, now); err != nil {
+			log.WithError(err).Warn("Failed to count a failed attempt")
+		}
+	}
+
+	return err
+}
+
+func (a *lockoutAuthenticator) AuthenticateUser(ctx context.Context, username, password string) (*User, error) {
+	var user *User
+	if err := withLockouts(ctx, a.store, userLockouts, username, ipLockouts, remoteHost(ConnectInfoFromContext(ctx)), func() error {
+		var err error
+		user, err = a.next.AuthenticateUser(ctx, username, password)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// NewLockoutAuthenticator returns a new authenticator that locks out users and
+// addresses after repeated failed attempts of another authenticator, for a
+// duration that grows exponentially
+func NewLockoutAuthenticator(store store.Store, next Authenticator) Authenticator {
+	return &lockoutAuthenticator{store: store, next: next}
+}
+
+func scanLockouts(ctx context.Context, m store.Map) (map[string]*Lockout, error) {
+	lockouts := make(map[string]*Lockout)
+
+	if err := m.Scan(ctx, func(ctx context.Context, k, v string) {
+		var lockout Lockout
+		if err := json.Unmarshal([]byte(v), &lockout); err != nil {
+			return
+		}
+
+		lockouts[k] = &lockout
+	}); err != nil {
+		return nil, err
+	}
+
+	return lockouts, nil
+}
+
+// ListLockouts returns failed authentication attempts of all users, operators
+// and addresses
+func ListLockouts(ctx context.Context, s store.Store) (*Lockouts, error) {
+	var lockouts Lockouts
+
+	for _, scope := range []struct {
+		m       string
+		scanned *map[string]*Lockout
+	}{
+		{userLockoutsMap, &lockouts.Users},
+		{ipLockoutsMap, &lockouts.IPs},
+		{operatorLockoutsMap, &lockouts.Operators},
+		{operatorIPLockoutsMap, &lockouts.OperatorIPs},
+	} {
+		scanned, err := scanLockouts(ctx, s.Map(scope.m))
+		if err != nil {
+			return nil, err
+		}
+
+		*scope.scanned = scanned
+	}
+
+	return &lockouts, nil
+}
+
+func clearLockout(ctx context.Context, s store.Store, scope lockoutScope, key string) error {
+	if err := s.Map(scope.m+lockoutFailuresSuffix).Remove(ctx, key); err != nil && !errors.Is(err, store.ErrNoKey) {
+		return err
+	}
+
+	return s.Map(scope.m).Remove(ctx, key)
+}
+
+// ClearUserLockout forgets failed attempts to authenticate as a user
+func ClearUserLockout(ctx context.Context, s store.Store, username string) error {
+	return clearLockout(ctx, s, userLockouts, username)
+}
+
+// ClearOperatorLockout forgets failed attempts to authenticate as an operator
+func ClearOperatorLockout(ctx context.Context, s store.Store, username string) error {
+	return clearLockout(ctx, s, operatorLockouts, username)
+}
+
+// ClearIPLockout forgets failed attempts to authenticate from an address, as a
+// user or as an operator
+func ClearIPLockout(ctx context.Context, s store.Store, ip string) error {
+	err := clearLockout(ctx, s, ipLockouts, ip)
+	if err != nil && !errors.Is(err, store.ErrNoKey) {
+		return err
+	}
+
+	if operatorErr := clearLockout(ctx, s, operatorIPLockouts, ip); operatorErr == nil || !errors.Is(operatorErr, store.ErrNoKey) {
+		return operatorErr
+	}
+
+	return err
+}
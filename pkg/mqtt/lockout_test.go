@@ -0,0 +1,133 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockoutDelay(t *testing.T) {
+	assert.Equal(t, time.Duration(0), lockoutDelay(userLockoutThreshold-1, userLockoutThreshold))
+	assert.Equal(t, lockoutInitialDelay, lockoutDelay(userLockoutThreshold, userLockoutThreshold))
+	assert.Equal(t, lockoutInitialDelay*2, lockoutDelay(userLockoutThreshold+1, userLockoutThreshold))
+	assert.Equal(t, lockoutInitialDelay*4, lockoutDelay(userLockoutThreshold+2, userLockoutThreshold))
+	assert.Equal(t, lockoutMaxDelay, lockoutDelay(1000, userLockoutThreshold))
+}
+
+func TestLockoutAuthenticator_User(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := &stubAuthenticator{username: "user1", password: "password1"}
+	auth := NewLockoutAuthenticator(s, next)
+
+	for i := 0; i < userLockoutThreshold; i++ {
+		_, err := auth.AuthenticateUser(ctx, "user1", "password2")
+		assert.Equal(t, ErrBadCredentials, err)
+	}
+
+	// the correct password is rejected during the lockout, without checking it
+	_, err := auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Equal(t, ErrLockedOut, err)
+	assert.True(t, errors.Is(err, ErrBadCredentials))
+	assert.Equal(t, userLockoutThreshold, next.calls)
+
+	lockouts, err := ListLockouts(ctx, s)
+	assert.Nil(t, err)
+	assert.Equal(t, userLockoutThreshold, lockouts.Users["user1"].Failures)
+
+	assert.Nil(t, ClearUserLockout(ctx, s, "user1"))
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+
+	// a successful attempt clears failed attempts
+	_, err = auth.AuthenticateUser(ctx, "user1", "password2")
+	assert.Equal(t, ErrBadCredentials, err)
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+
+	lockouts, err = ListLockouts(ctx, s)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(lockouts.Users))
+}
+
+func TestLockoutAuthenticator_Concurrent(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, fail(ctx, s, userLockouts, "user1", now))
+		}()
+	}
+	wg.Wait()
+
+	// concurrent failed attempts are never lost
+	n, err := s.Map(userLockoutsMap+lockoutFailuresSuffix).Increment(ctx, "user1", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(50), n)
+
+	assert.Nil(t, ClearUserLockout(ctx, s, "user1"))
+
+	_, err = s.Map(userLockoutsMap+lockoutFailuresSuffix).Get(ctx, "user1")
+	assert.True(t, errors.Is(err, store.ErrNoKey))
+}
+
+func TestLockoutAuthenticator_IP(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	auth := NewLockoutAuthenticator(s, &stubAuthenticator{username: "user1", password: "password1"})
+
+	attacker := WithConnectInfo(ctx, ConnectInfo{RemoteAddr: "10.0.0.1:1234"})
+	for i := 0; i < ipLockoutThreshold; i++ {
+		_, err := auth.AuthenticateUser(attacker, fmt.Sprintf("user%d", i+2), "password1")
+		assert.Equal(t, ErrBadCredentials, err)
+	}
+
+	// the lockout applies to all ports
+	_, err := auth.AuthenticateUser(WithConnectInfo(ctx, ConnectInfo{RemoteAddr: "10.0.0.1:5678"}), "user1", "password1")
+	assert.Equal(t, ErrLockedOut, err)
+
+	_, err = auth.AuthenticateUser(WithConnectInfo(ctx, ConnectInfo{RemoteAddr: "10.0.0.2:1234"}), "user1", "password1")
+	assert.Nil(t, err)
+
+	assert.Nil(t, ClearIPLockout(ctx, s, "10.0.0.1"))
+
+	_, err = auth.AuthenticateUser(attacker, "user1", "password1")
+	assert.Nil(t, err)
+}
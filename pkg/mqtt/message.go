@@ -24,15 +24,29 @@ import (
 
 // QueuedMessage is a message published to a topic
 type QueuedMessage struct {
-	ID        uint16    `json:"id"`
-	Topic     string    `json:"topic"`
-	Message   string    `json:"message"`
-	QoS       QoS       `json:"qos"`
-	Duplicate bool      `json:"dup"`
-	SendTime  time.Time `json:"ts"`
+	ID        uint16     `json:"id"`
+	Topic     string     `json:"topic"`
+	Message   string     `json:"message"`
+	QoS       QoS        `json:"qos"`
+	Duplicate bool       `json:"dup"`
+	QueueTime time.Time  `json:"qts"`
+	SendTime  time.Time  `json:"ts"`
+	Attempts  int        `json:"attempts,omitempty"`
+	Expiry    *time.Time `json:"exp,omitempty"`
+	Shared    string     `json:"shared,omitempty"`
+
+	// Subscribers and Groups are the clients and shared subscriptions a
+	// published message could not be queued for, when it's retried
+	Subscribers []string `json:"subscribers,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
 }
 
 // LogFields returns logging context for a message
 func (m *QueuedMessage) LogFields() log.Fields {
 	return log.Fields{"id": m.ID, "topic": m.Topic}
 }
+
+// Expired determines whether or not a message has expired
+func (m *QueuedMessage) Expired(now time.Time) bool {
+	return m.Expiry != nil && now.After(*m.Expiry)
+}
@@ -0,0 +1,41 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import "expvar"
+
+const (
+	metricMessagesExpired      = "messages_expired"
+	metricMessagesDropped      = "messages_dropped"
+	metricMessagesRejected     = "messages_rejected"
+	metricMessagesReceived     = "messages_received"
+	metricMessagesSent         = "messages_sent"
+	metricMessagesFanoutFailed = "messages_fanout_failed"
+	metricDeadLettersFailed    = "dead_letters_failed"
+	metricBytesReceived        = "bytes_received"
+	metricBytesSent            = "bytes_sent"
+)
+
+// metrics holds counters of all brokers in the process, exported through
+// expvar under "mqtt"
+var metrics = expvar.NewMap("mqtt")
+
+// count adds to a counter of a broker, and to the exported counter
+func (b *Broker) count(name string, delta int64) {
+	b.metrics.Add(name, delta)
+	metrics.Add(name, delta)
+}
@@ -0,0 +1,537 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/env"
+	"github.com/dimkr/yodi/pkg/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// OperatorRole determines what an operator may do through the admin API; each
+// role includes the permissions of the roles before it
+type OperatorRole string
+
+const (
+	// OperatorRoleViewer may view devices, users and the broker state
+	OperatorRoleViewer OperatorRole = "viewer"
+
+	// OperatorRoleOperator may also manage devices and their users
+	OperatorRoleOperator OperatorRole = "operator"
+
+	// OperatorRoleAdmin may also manage roles and operators
+	OperatorRoleAdmin OperatorRole = "admin"
+)
+
+var operatorRoleLevels = map[OperatorRole]int{
+	OperatorRoleViewer:   1,
+	OperatorRoleOperator: 2,
+	OperatorRoleAdmin:    3,
+}
+
+// Validate determines whether or not a role is known
+func (r OperatorRole) Validate() error {
+	if _, ok := operatorRoleLevels[r]; !ok {
+		return fmt.Errorf("unknown operator role: %s", r)
+	}
+
+	return nil
+}
+
+// Allows determines whether or not a role includes the permissions of another
+func (r OperatorRole) Allows(required OperatorRole) bool {
+	level, ok := operatorRoleLevels[r]
+	return ok && level >= operatorRoleLevels[required]
+}
+
+// Operator is a human user of the admin API; operators are kept apart from
+// MQTT users, so device credentials never grant access to the admin API
+type Operator struct {
+	Role     OperatorRole `json:"role"`
+	Password string       `json:"password"`
+}
+
+// Validate checks an operator for errors
+func (o *Operator) Validate() error {
+	if err := o.Role.Validate(); err != nil {
+		return err
+	}
+
+	if o.Password == "" {
+		return errors.New("empty password")
+	}
+
+	return nil
+}
+
+// APIKey allows an operator to use the admin API without a password, with the
+// operator's role or a lesser one; the key itself is not stored, only its ID,
+// which is its hash
+type APIKey struct {
+	ID       string       `json:"id"`
+	Operator string       `json:"operator"`
+	Name     string       `json:"name,omitempty"`
+	Role     OperatorRole `json:"role"`
+	Created  time.Time    `json:"created"`
+	Expiry   *time.Time   `json:"expiry,omitempty"`
+}
+
+// OperatorSession is a session of an operator who has logged in with a
+// password; like API keys, only the hash of the session token is stored
+type OperatorSession struct {
+	ID       string    `json:"id"`
+	Operator string    `json:"operator"`
+	Created  time.Time `json:"created"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// OperatorIdentity is an authenticated operator and its effective role
+type OperatorIdentity struct {
+	Username  string
+	Role      OperatorRole
+	KeyID     string
+	SessionID string
+}
+
+const (
+	operatorsMap        = "/operators"
+	apiKeysMap          = "/operators/keys"
+	operatorSessionsMap = "/operators/sessions"
+
+	defaultOperatorSessionTTL = 12 * time.Hour
+)
+
+var (
+	// dummyPasswordHash is verified when an operator doesn't exist, so the
+	// response time doesn't reveal whether or not it does
+	dummyPasswordHash     string
+	dummyPasswordHashOnce sync.Once
+)
+
+// LoadOperator returns an operator from the operator store
+func LoadOperator(ctx context.Context, s store.Store, username string) (*Operator, error) {
+	j, err := s.Map(operatorsMap).Get(ctx, username)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find operator '%s': %w", username, err)
+	}
+
+	var operator Operator
+	if err := json.Unmarshal([]byte(j), &operator); err != nil {
+		return nil, fmt.Errorf("Failed to find operator '%s': %w", username, err)
+	}
+
+	return &operator, nil
+}
+
+// SaveOperator adds or replaces an operator in the operator store; the
+// password must be hashed, and if it changes, the operator's sessions and API
+// keys are revoked
+func SaveOperator(ctx context.Context, s store.Store, username string, operator *Operator) error {
+	if err := operator.Validate(); err != nil {
+		return err
+	}
+
+	existing, err := LoadOperator(ctx, s, username)
+	if err != nil && !errors.Is(err, store.ErrNoKey) {
+		return err
+	}
+
+	j, err := json.Marshal(operator)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Map(operatorsMap).Set(ctx, username, string(j)); err != nil {
+		return err
+	}
+
+	if existing != nil && existing.Password != operator.Password {
+		return revokeOperatorCredentials(ctx, s, username)
+	}
+
+	return nil
+}
+
+// revokeOperatorCredentials revokes all sessions and API keys of an operator
+func revokeOperatorCredentials(ctx context.Context, s store.Store, username string) error {
+	for _, m := range []store.Map{s.Map(operatorSessionsMap), s.Map(apiKeysMap)} {
+		ids := make([]string, 0)
+
+		if err := m.Scan(ctx, func(ctx context.Context, k, v string) {
+			var owner struct {
+				Operator string `json:"operator"`
+			}
+			if err := json.Unmarshal([]byte(v), &owner); err == nil && owner.Operator == username {
+				ids = append(ids, k)
+			}
+		}); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := m.Remove(ctx, id); err != nil && !errors.Is(err, store.ErrNoKey) {
+				return err
+			}
+		}
+	}
+
+	log.WithFields(log.Fields{"operator": username}).Info("Revoked the sessions and API keys of an operator")
+	return nil
+}
+
+// DeleteOperator removes an operator from the operator store and revokes its
+// sessions and API keys, so they stay invalid if another operator with the same
+// name is added later
+func DeleteOperator(ctx context.Context, s store.Store, username string) error {
+	if _, err := LoadOperator(ctx, s, username); err != nil {
+		return err
+	}
+
+	if err := s.Map(operatorsMap).Remove(ctx, username); err != nil {
+		return err
+	}
+
+	return revokeOperatorCredentials(ctx, s, username)
+}
+
+// ListOperators returns all operators in the operator store
+func ListOperators(ctx context.Context, s store.Store) (map[string]*Operator, error) {
+	operators := make(map[string]*Operator)
+
+	if err := s.Map(operatorsMap).Scan(ctx, func(ctx context.Context, k, v string) {
+		var operator Operator
+		if err := json.Unmarshal([]byte(v), &operator); err != nil {
+			return
+		}
+
+		operators[k] = &operator
+	}); err != nil {
+		return nil, err
+	}
+
+	return operators, nil
+}
+
+// BootstrapOperator creates an admin operator if there are no operators, so the
+// admin API can be used to create others
+func BootstrapOperator(ctx context.Context, s store.Store, username, password string) error {
+	n, err := s.Map(operatorsMap).Len(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		return nil
+	}
+
+	hash, err := HashPassword(password, DefaultPasswordAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	if err := SaveOperator(ctx, s, username, &Operator{Role: OperatorRoleAdmin, Password: hash}); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"operator": username}).Info("Created the first operator")
+	return nil
+}
+
+// OperatorSessionTTL returns the lifetime of operator sessions, specified in
+// seconds by OPERATOR_SESSION_TTL
+func OperatorSessionTTL() time.Duration {
+	ttl, err := env.Seconds("OPERATOR_SESSION_TTL", defaultOperatorSessionTTL)
+	if err != nil {
+		log.WithError(err).Warn("Invalid OPERATOR_SESSION_TTL")
+		return defaultOperatorSessionTTL
+	}
+
+	if ttl == 0 {
+		return defaultOperatorSessionTTL
+	}
+
+	return ttl
+}
+
+// AuthenticateOperator authenticates an operator using a password; like users,
+// operators and the addresses they connect from (taken from the ConnectInfo
+// of ctx) are locked out after repeated failed attempts
+func AuthenticateOperator(ctx context.Context, s store.Store, username, password string) (*OperatorIdentity, error) {
+	var identity *OperatorIdentity
+	if err := withLockouts(ctx, s, operatorLockouts, username, operatorIPLockouts, remoteHost(ConnectInfoFromContext(ctx)), func() error {
+		var err error
+		identity, err = authenticateOperator(ctx, s, username, password)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+func authenticateOperator(ctx context.Context, s store.Store, username, password string) (*OperatorIdentity, error) {
+	operator, err := LoadOperator(ctx, s, username)
+	if err != nil {
+		if !errors.Is(err, store.ErrNoKey) {
+			return nil, err
+		}
+
+		dummyPasswordHashOnce.Do(func() {
+			dummyPasswordHash, _ = HashPassword("", DefaultPasswordAlgorithm)
+		})
+		VerifyPassword(dummyPasswordHash, password)
+
+		return nil, ErrBadCredentials
+	}
+
+	ok, err := VerifyPassword(operator.Password, password)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to verify the password of operator '%s': %w", username, err)
+	}
+	if !ok {
+		return nil, ErrBadCredentials
+	}
+
+	return &OperatorIdentity{Username: username, Role: operator.Role}, nil
+}
+
+// CreateOperatorSession authenticates an operator using a password and starts
+// a session; it returns the session token, which cannot be retrieved later
+func CreateOperatorSession(ctx context.Context, s store.Store, username, password string, ttl time.Duration) (string, *OperatorSession, error) {
+	if ttl <= 0 {
+		return "", nil, errors.New("TTL must be positive")
+	}
+
+	if _, err := AuthenticateOperator(ctx, s, username, password); err != nil {
+		return "", nil, err
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	session := OperatorSession{
+		ID:       tokenID(token),
+		Operator: username,
+		Created:  now,
+		Expiry:   now.Add(ttl),
+	}
+
+	j, err := json.Marshal(&session)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := s.Map(operatorSessionsMap).Set(ctx, session.ID, string(j)); err != nil {
+		return "", nil, err
+	}
+
+	expireField(ctx, s.Map(operatorSessionsMap), session.ID, ttl)
+
+	return token, &session, nil
+}
+
+// RevokeOperatorSession ends an operator session
+func RevokeOperatorSession(ctx context.Context, s store.Store, id string) error {
+	return s.Map(operatorSessionsMap).Remove(ctx, id)
+}
+
+// CreateAPIKey creates an API key for an operator, with a role that doesn't
+// exceed the operator's role, which expires after ttl, or never if ttl is 0;
+// it returns the key, which cannot be retrieved later
+func CreateAPIKey(ctx context.Context, s store.Store, username, name string, role OperatorRole, ttl time.Duration) (string, *APIKey, error) {
+	if err := role.Validate(); err != nil {
+		return "", nil, err
+	}
+
+	if ttl < 0 {
+		return "", nil, errors.New("TTL must not be negative")
+	}
+
+	operator, err := LoadOperator(ctx, s, username)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !operator.Role.Allows(role) {
+		return "", nil, fmt.Errorf("operator '%s' cannot create a key with role %s", username, role)
+	}
+
+	key, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	apiKey := APIKey{
+		ID:       tokenID(key),
+		Operator: username,
+		Name:     name,
+		Role:     role,
+		Created:  time.Now(),
+	}
+
+	if ttl > 0 {
+		expiry := apiKey.Created.Add(ttl)
+		apiKey.Expiry = &expiry
+	}
+
+	j, err := json.Marshal(&apiKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := s.Map(apiKeysMap).Set(ctx, apiKey.ID, string(j)); err != nil {
+		return "", nil, err
+	}
+
+	if ttl > 0 {
+		expireField(ctx, s.Map(apiKeysMap), apiKey.ID, ttl)
+	}
+
+	return key, &apiKey, nil
+}
+
+func loadAPIKey(ctx context.Context, s store.Store, id string) (*APIKey, error) {
+	j, err := s.Map(apiKeysMap).Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var apiKey APIKey
+	if err := json.Unmarshal([]byte(j), &apiKey); err != nil {
+		return nil, err
+	}
+
+	return &apiKey, nil
+}
+
+// GetAPIKey returns an API key
+func GetAPIKey(ctx context.Context, s store.Store, id string) (*APIKey, error) {
+	apiKey, err := loadAPIKey(ctx, s, id)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find API key '%s': %w", id, err)
+	}
+
+	return apiKey, nil
+}
+
+// ListAPIKeys returns all API keys
+func ListAPIKeys(ctx context.Context, s store.Store) ([]*APIKey, error) {
+	apiKeys := make([]*APIKey, 0)
+
+	if err := s.Map(apiKeysMap).Scan(ctx, func(ctx context.Context, k, v string) {
+		var apiKey APIKey
+		if err := json.Unmarshal([]byte(v), &apiKey); err != nil {
+			return
+		}
+
+		apiKeys = append(apiKeys, &apiKey)
+	}); err != nil {
+		return nil, err
+	}
+
+	return apiKeys, nil
+}
+
+// RevokeAPIKey removes an API key
+func RevokeAPIKey(ctx context.Context, s store.Store, id string) error {
+	if _, err := GetAPIKey(ctx, s, id); err != nil {
+		return err
+	}
+
+	return s.Map(apiKeysMap).Remove(ctx, id)
+}
+
+// effectiveRole returns the role of an operator, limited by the role of its API
+// key
+func effectiveRole(operatorRole, keyRole OperatorRole) OperatorRole {
+	if keyRole.Allows(operatorRole) {
+		return operatorRole
+	}
+
+	return keyRole
+}
+
+// AuthenticateOperatorToken authenticates an operator using an API key or a
+// session token; the operator's current role applies, so keys and sessions of
+// deleted or demoted operators lose their permissions
+func AuthenticateOperatorToken(ctx context.Context, s store.Store, token string) (*OperatorIdentity, error) {
+	id := tokenID(token)
+	now := time.Now()
+
+	var identity OperatorIdentity
+
+	if j, err := s.Map(operatorSessionsMap).Get(ctx, id); err == nil {
+		var session OperatorSession
+		if err := json.Unmarshal([]byte(j), &session); err != nil {
+			return nil, err
+		}
+
+		if now.After(session.Expiry) {
+			if err := RevokeOperatorSession(ctx, s, id); err != nil {
+				log.WithError(err).Warn("Failed to remove an expired operator session")
+			}
+			return nil, ErrBadCredentials
+		}
+
+		identity.Username = session.Operator
+		identity.SessionID = id
+	} else if !errors.Is(err, store.ErrNoKey) {
+		return nil, err
+	} else {
+		apiKey, err := loadAPIKey(ctx, s, id)
+		if err != nil {
+			if errors.Is(err, store.ErrNoKey) {
+				return nil, ErrBadCredentials
+			}
+			return nil, err
+		}
+
+		if apiKey.Expiry != nil && now.After(*apiKey.Expiry) {
+			return nil, ErrBadCredentials
+		}
+
+		identity.Username = apiKey.Operator
+		identity.Role = apiKey.Role
+		identity.KeyID = id
+	}
+
+	operator, err := LoadOperator(ctx, s, identity.Username)
+	if err != nil {
+		if errors.Is(err, store.ErrNoKey) {
+			return nil, ErrBadCredentials
+		}
+		return nil, err
+	}
+
+	if identity.KeyID == "" {
+		identity.Role = operator.Role
+	} else {
+		identity.Role = effectiveRole(operator.Role, identity.Role)
+	}
+
+	return &identity, nil
+}
@@ -0,0 +1,241 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOperatorRole_Allows(t *testing.T) {
+	assert.True(t, OperatorRoleAdmin.Allows(OperatorRoleViewer))
+	assert.True(t, OperatorRoleAdmin.Allows(OperatorRoleAdmin))
+	assert.True(t, OperatorRoleOperator.Allows(OperatorRoleViewer))
+	assert.False(t, OperatorRoleOperator.Allows(OperatorRoleAdmin))
+	assert.False(t, OperatorRoleViewer.Allows(OperatorRoleOperator))
+	assert.False(t, OperatorRole("root").Allows(OperatorRoleViewer))
+
+	assert.NotNil(t, OperatorRole("root").Validate())
+	assert.NotNil(t, OperatorRole("").Validate())
+}
+
+func saveTestOperator(t *testing.T, s store.Store, username, password string, role OperatorRole) {
+	hash, err := HashPassword(password, DefaultPasswordAlgorithm)
+	assert.Nil(t, err)
+	assert.Nil(t, SaveOperator(context.Background(), s, username, &Operator{Role: role, Password: hash}))
+}
+
+func TestAuthenticateOperator(t *testing.T) {
+	s := store.NewMemoryStore()
+	ctx := context.Background()
+
+	saveTestOperator(t, s, "alice", "password1", OperatorRoleAdmin)
+
+	identity, err := AuthenticateOperator(ctx, s, "alice", "password1")
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", identity.Username)
+	assert.Equal(t, OperatorRoleAdmin, identity.Role)
+
+	_, err = AuthenticateOperator(ctx, s, "alice", "password2")
+	assert.Equal(t, ErrBadCredentials, err)
+
+	_, err = AuthenticateOperator(ctx, s, "bob", "password1")
+	assert.Equal(t, ErrBadCredentials, err)
+}
+
+func TestAuthenticateOperator_DeviceUser(t *testing.T) {
+	s := store.NewMemoryStore()
+	ctx := context.Background()
+
+	assert.Nil(t, SaveUser(ctx, s, "device1", &User{Password: "password1"}))
+
+	_, err := AuthenticateOperator(ctx, s, "device1", "password1")
+	assert.Equal(t, ErrBadCredentials, err)
+}
+
+func TestBootstrapOperator(t *testing.T) {
+	s := store.NewMemoryStore()
+	ctx := context.Background()
+
+	assert.Nil(t, BootstrapOperator(ctx, s, "alice", "password1"))
+
+	identity, err := AuthenticateOperator(ctx, s, "alice", "password1")
+	assert.Nil(t, err)
+	assert.Equal(t, OperatorRoleAdmin, identity.Role)
+
+	// bootstrap does nothing once there are operators
+	assert.Nil(t, BootstrapOperator(ctx, s, "bob", "password2"))
+
+	_, err = AuthenticateOperator(ctx, s, "bob", "password2")
+	assert.Equal(t, ErrBadCredentials, err)
+}
+
+func TestOperatorSession(t *testing.T) {
+	s := store.NewMemoryStore()
+	ctx := context.Background()
+
+	saveTestOperator(t, s, "alice", "password1", OperatorRoleOperator)
+
+	_, _, err := CreateOperatorSession(ctx, s, "alice", "password2", time.Hour)
+	assert.Equal(t, ErrBadCredentials, err)
+
+	token, session, err := CreateOperatorSession(ctx, s, "alice", "password1", time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", session.Operator)
+
+	identity, err := AuthenticateOperatorToken(ctx, s, token)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", identity.Username)
+	assert.Equal(t, OperatorRoleOperator, identity.Role)
+	assert.Equal(t, session.ID, identity.SessionID)
+
+	assert.Nil(t, RevokeOperatorSession(ctx, s, session.ID))
+
+	_, err = AuthenticateOperatorToken(ctx, s, token)
+	assert.Equal(t, ErrBadCredentials, err)
+
+	token, _, err = CreateOperatorSession(ctx, s, "alice", "password1", time.Millisecond)
+	assert.Nil(t, err)
+
+	time.Sleep(time.Millisecond * 10)
+
+	_, err = AuthenticateOperatorToken(ctx, s, token)
+	assert.Equal(t, ErrBadCredentials, err)
+}
+
+func TestAPIKey(t *testing.T) {
+	s := store.NewMemoryStore()
+	ctx := context.Background()
+
+	saveTestOperator(t, s, "alice", "password1", OperatorRoleOperator)
+
+	_, _, err := CreateAPIKey(ctx, s, "alice", "ci", OperatorRoleAdmin, 0)
+	assert.NotNil(t, err)
+
+	key, apiKey, err := CreateAPIKey(ctx, s, "alice", "ci", OperatorRoleViewer, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, apiKey.Expiry)
+
+	identity, err := AuthenticateOperatorToken(ctx, s, key)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", identity.Username)
+	assert.Equal(t, OperatorRoleViewer, identity.Role)
+	assert.Equal(t, apiKey.ID, identity.KeyID)
+
+	apiKeys, err := ListAPIKeys(ctx, s)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(apiKeys))
+
+	_, err = AuthenticateOperatorToken(ctx, s, "abcd")
+	assert.Equal(t, ErrBadCredentials, err)
+
+	assert.Nil(t, RevokeAPIKey(ctx, s, apiKey.ID))
+
+	_, err = AuthenticateOperatorToken(ctx, s, key)
+	assert.Equal(t, ErrBadCredentials, err)
+}
+
+func TestAPIKey_Demoted(t *testing.T) {
+	s := store.NewMemoryStore()
+	ctx := context.Background()
+
+	saveTestOperator(t, s, "alice", "password1", OperatorRoleAdmin)
+
+	key, _, err := CreateAPIKey(ctx, s, "alice", "", OperatorRoleAdmin, time.Hour)
+	assert.Nil(t, err)
+
+	// the key is limited by the current role of the operator
+	operator, err := LoadOperator(ctx, s, "alice")
+	assert.Nil(t, err)
+	operator.Role = OperatorRoleViewer
+	assert.Nil(t, SaveOperator(ctx, s, "alice", operator))
+
+	identity, err := AuthenticateOperatorToken(ctx, s, key)
+	assert.Nil(t, err)
+	assert.Equal(t, OperatorRoleViewer, identity.Role)
+
+	assert.Nil(t, DeleteOperator(ctx, s, "alice"))
+
+	_, err = AuthenticateOperatorToken(ctx, s, key)
+	assert.Equal(t, ErrBadCredentials, err)
+}
+
+func TestAuthenticateOperator_Lockout(t *testing.T) {
+	s := store.NewMemoryStore()
+	ctx := WithConnectInfo(context.Background(), ConnectInfo{RemoteAddr: "127.0.0.1"})
+
+	saveTestOperator(t, s, "alice", "password1", OperatorRoleAdmin)
+
+	for i := 0; i < userLockoutThreshold; i++ {
+		_, err := AuthenticateOperator(ctx, s, "alice", "password2")
+		assert.Equal(t, ErrBadCredentials, err)
+	}
+
+	_, _, err := CreateOperatorSession(ctx, s, "alice", "password1", time.Hour)
+	assert.Equal(t, ErrLockedOut, err)
+
+	lockouts, err := ListLockouts(ctx, s)
+	assert.Nil(t, err)
+	assert.Equal(t, userLockoutThreshold, lockouts.Operators["alice"].Failures)
+	assert.Equal(t, userLockoutThreshold, lockouts.OperatorIPs["127.0.0.1"].Failures)
+	assert.Equal(t, 0, len(lockouts.Users))
+
+	assert.Nil(t, ClearOperatorLockout(ctx, s, "alice"))
+
+	_, err = AuthenticateOperator(ctx, s, "alice", "password1")
+	assert.Nil(t, err)
+}
+
+func TestSaveOperator_RevokesCredentials(t *testing.T) {
+	s := store.NewMemoryStore()
+	ctx := context.Background()
+
+	saveTestOperator(t, s, "alice", "password1", OperatorRoleAdmin)
+	saveTestOperator(t, s, "bob", "password1", OperatorRoleAdmin)
+
+	session, _, err := CreateOperatorSession(ctx, s, "alice", "password1", time.Hour)
+	assert.Nil(t, err)
+
+	key, _, err := CreateAPIKey(ctx, s, "alice", "key", OperatorRoleViewer, 0)
+	assert.Nil(t, err)
+
+	otherKey, _, err := CreateAPIKey(ctx, s, "bob", "key", OperatorRoleViewer, 0)
+	assert.Nil(t, err)
+
+	// a change of role alone keeps the credentials
+	operator, err := LoadOperator(ctx, s, "alice")
+	assert.Nil(t, err)
+	operator.Role = OperatorRoleOperator
+	assert.Nil(t, SaveOperator(ctx, s, "alice", operator))
+
+	_, err = AuthenticateOperatorToken(ctx, s, session)
+	assert.Nil(t, err)
+
+	saveTestOperator(t, s, "alice", "password2", OperatorRoleOperator)
+
+	for _, token := range []string{session, key} {
+		_, err = AuthenticateOperatorToken(ctx, s, token)
+		assert.Equal(t, ErrBadCredentials, err)
+	}
+
+	_, err = AuthenticateOperatorToken(ctx, s, otherKey)
+	assert.Nil(t, err)
+}
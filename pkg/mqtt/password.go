@@ -0,0 +1,305 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordAlgorithm is a password hashing algorithm
+type PasswordAlgorithm string
+
+const (
+	// Bcrypt is bcrypt
+	Bcrypt PasswordAlgorithm = "bcrypt"
+
+	// Scrypt is scrypt
+	Scrypt PasswordAlgorithm = "scrypt"
+
+	// Argon2id is Argon2id
+	Argon2id PasswordAlgorithm = "argon2id"
+
+	// DefaultPasswordAlgorithm is used to hash plaintext passwords
+	DefaultPasswordAlgorithm = Bcrypt
+)
+
+const (
+	saltSize = 16
+	keySize  = 32
+
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+
+	argon2Memory  = 64 * 1024
+	argon2Time    = 1
+	argon2Threads = 4
+
+	// hashes with costlier parameters are rejected, so a caller-supplied hash
+	// cannot make verification exhaust the CPU or memory
+	maxScryptLogN    = 20
+	maxScryptR       = 32
+	maxScryptP       = 16
+	maxArgon2Memory  = 1024 * 1024
+	maxArgon2Time    = 10
+	maxArgon2Threads = 16
+	minHashKeySize   = 16
+	maxHashKeySize   = 64
+)
+
+var (
+	errInvalidScryptParams = errors.New("invalid scrypt parameters")
+	errInvalidArgon2Params = errors.New("invalid argon2id parameters")
+)
+
+var b64 = base64.RawStdEncoding
+
+func generateSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return salt, nil
+}
+
+// HashPassword hashes a password; the hash specifies the algorithm and its
+// parameters
+func HashPassword(password string, algorithm PasswordAlgorithm) (string, error) {
+	switch algorithm {
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+
+		return string(hash), nil
+
+	case Scrypt:
+		salt, err := generateSalt()
+		if err != nil {
+			return "", err
+		}
+
+		key, err := scrypt.Key([]byte(password), salt, 1<<scryptLogN, scryptR, scryptP, keySize)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", scryptLogN, scryptR, scryptP, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+
+	case Argon2id:
+		salt, err := generateSalt()
+		if err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, keySize)
+
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+
+	default:
+		return "", fmt.Errorf("unknown algorithm: %s", algorithm)
+	}
+}
+
+// passwordAlgorithm returns the algorithm used to hash a password, or an empty
+// string if the password is not hashed
+func passwordAlgorithm(hash string) PasswordAlgorithm {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return Bcrypt
+
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return Scrypt
+
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return Argon2id
+
+	default:
+		return ""
+	}
+}
+
+// IsPasswordHash determines whether or not a password is hashed using one of
+// the supported algorithms
+func IsPasswordHash(password string) bool {
+	return passwordAlgorithm(password) != ""
+}
+
+// splitHash splits a $<algorithm>$[<version>$]<parameters>$<salt>$<key> hash
+// into parameters, salt and key
+func splitHash(hash string, fields int) (string, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != fields {
+		return "", nil, nil, errors.New("invalid hash")
+	}
+
+	salt, err := b64.DecodeString(parts[fields-2])
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	key, err := b64.DecodeString(parts[fields-1])
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return parts[fields-3], salt, key, nil
+}
+
+type scryptParams struct {
+	logN, r, p int
+	salt, key  []byte
+}
+
+func parseScrypt(hash string) (*scryptParams, error) {
+	params, salt, key, err := splitHash(hash, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := scryptParams{salt: salt, key: key}
+	if _, err := fmt.Sscanf(params, "ln=%d,r=%d,p=%d", &parsed.logN, &parsed.r, &parsed.p); err != nil {
+		return nil, err
+	}
+
+	if parsed.logN <= 0 || parsed.logN > maxScryptLogN ||
+		parsed.r <= 0 || parsed.r > maxScryptR ||
+		parsed.p <= 0 || parsed.p > maxScryptP ||
+		len(key) < minHashKeySize || len(key) > maxHashKeySize {
+		return nil, errInvalidScryptParams
+	}
+
+	return &parsed, nil
+}
+
+func verifyScrypt(hash, password string) (bool, error) {
+	parsed, err := parseScrypt(hash)
+	if err != nil {
+		return false, err
+	}
+
+	derived, err := scrypt.Key([]byte(password), parsed.salt, 1<<parsed.logN, parsed.r, parsed.p, len(parsed.key))
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare(derived, parsed.key) == 1, nil
+}
+
+type argon2Params struct {
+	memory, time uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+func parseArgon2id(hash string) (*argon2Params, error) {
+	params, salt, key, err := splitHash(hash, 6)
+	if err != nil {
+		return nil, err
+	}
+
+	var memory, time, threads uint64
+	if _, err := fmt.Sscanf(params, "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return nil, err
+	}
+
+	if memory == 0 || memory > maxArgon2Memory ||
+		time == 0 || time > maxArgon2Time ||
+		threads == 0 || threads > maxArgon2Threads ||
+		len(key) < minHashKeySize || len(key) > maxHashKeySize {
+		return nil, errInvalidArgon2Params
+	}
+
+	return &argon2Params{
+		memory:  uint32(memory),
+		time:    uint32(time),
+		threads: uint8(threads),
+		salt:    salt,
+		key:     key,
+	}, nil
+}
+
+func verifyArgon2id(hash, password string) (bool, error) {
+	parsed, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	derived := argon2.IDKey([]byte(password), parsed.salt, parsed.time, parsed.memory, parsed.threads, uint32(len(parsed.key)))
+	return subtle.ConstantTimeCompare(derived, parsed.key) == 1, nil
+}
+
+// ValidatePasswordHash checks that a hash is well-formed and its parameters
+// are within bounds
+func ValidatePasswordHash(hash string) error {
+	switch passwordAlgorithm(hash) {
+	case Bcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return err
+		}
+
+		if cost > bcrypt.MaxCost {
+			return errors.New("invalid bcrypt cost")
+		}
+
+		return nil
+
+	case Scrypt:
+		_, err := parseScrypt(hash)
+		return err
+
+	case Argon2id:
+		_, err := parseArgon2id(hash)
+		return err
+
+	default:
+		return errors.New("unknown hash")
+	}
+}
+
+// VerifyPassword compares a password with a hash, or with a plaintext password
+func VerifyPassword(hash, password string) (bool, error) {
+	switch passwordAlgorithm(hash) {
+	case Bcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+
+	case Scrypt:
+		return verifyScrypt(hash, password)
+
+	case Argon2id:
+		return verifyArgon2id(hash, password)
+
+	default:
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1, nil
+	}
+}
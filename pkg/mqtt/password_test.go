@@ -0,0 +1,156 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashPassword(t *testing.T) {
+	for _, algorithm := range []PasswordAlgorithm{Bcrypt, Scrypt, Argon2id} {
+		hash, err := HashPassword("password1", algorithm)
+		assert.Nil(t, err)
+		assert.Equal(t, algorithm, passwordAlgorithm(hash))
+
+		ok, err := VerifyPassword(hash, "password1")
+		assert.Nil(t, err)
+		assert.True(t, ok)
+
+		ok, err = VerifyPassword(hash, "password2")
+		assert.Nil(t, err)
+		assert.False(t, ok)
+
+		otherHash, err := HashPassword("password1", algorithm)
+		assert.Nil(t, err)
+		assert.NotEqual(t, hash, otherHash)
+	}
+
+	_, err := HashPassword("password1", "md5")
+	assert.NotNil(t, err)
+}
+
+func TestVerifyPassword_Bounds(t *testing.T) {
+	salt := b64.EncodeToString(make([]byte, saltSize))
+	key := b64.EncodeToString(make([]byte, keySize))
+
+	for _, params := range []string{
+		"m=65536,t=1,p=0",
+		"m=65536,t=1,p=17",
+		"m=65536,t=1,p=256",
+		"m=1048577,t=1,p=4",
+		"m=65536,t=0,p=4",
+		"m=65536,t=11,p=4",
+	} {
+		hash := "$argon2id$v=19$" + params + "$" + salt + "$" + key
+		assert.NotNil(t, ValidatePasswordHash(hash), params)
+
+		_, err := VerifyPassword(hash, "password1")
+		assert.NotNil(t, err, params)
+	}
+
+	for _, params := range []string{"ln=21,r=8,p=1", "ln=15,r=0,p=1", "ln=15,r=8,p=17"} {
+		hash := "$scrypt$" + params + "$" + salt + "$" + key
+		assert.NotNil(t, ValidatePasswordHash(hash), params)
+
+		_, err := VerifyPassword(hash, "password1")
+		assert.NotNil(t, err, params)
+	}
+
+	for _, algorithm := range []PasswordAlgorithm{Bcrypt, Scrypt, Argon2id} {
+		hash, err := HashPassword("password1", algorithm)
+		assert.Nil(t, err)
+		assert.Nil(t, ValidatePasswordHash(hash))
+	}
+
+	assert.NotNil(t, ValidatePasswordHash("password1"))
+}
+
+func TestVerifyPassword_Plaintext(t *testing.T) {
+	assert.Equal(t, PasswordAlgorithm(""), passwordAlgorithm("password1"))
+
+	ok, err := VerifyPassword("password1", "password1")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = VerifyPassword("password1", "password2")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestAuthenticateUser_UpgradePassword(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, store.Map(usersMap).Set(ctx, "user1", `{"password": "password1", "acl": {"/topic": {"publish": true}}}`))
+
+	auth := NewAuthenticator(store)
+
+	_, err := auth.AuthenticateUser(ctx, "user1", "password2")
+	assert.Equal(t, ErrBadCredentials, err)
+
+	j, err := store.Map(usersMap).Get(ctx, "user1")
+	assert.Nil(t, err)
+
+	var user User
+	assert.Nil(t, json.Unmarshal([]byte(j), &user))
+	assert.Equal(t, "password1", user.Password)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+
+	j, err = store.Map(usersMap).Get(ctx, "user1")
+	assert.Nil(t, err)
+
+	assert.Nil(t, json.Unmarshal([]byte(j), &user))
+	assert.Equal(t, DefaultPasswordAlgorithm, passwordAlgorithm(user.Password))
+	assert.True(t, user.ACL["/topic"].Publish)
+
+	authenticatedUser, err := auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+	assert.True(t, authenticatedUser.ACL["/topic"].Publish)
+}
+
+func TestAuthenticateUser_UpgradeChangedPassword(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: "password1", ACL: ACL{"/topic": {Publish: true}}}))
+
+	auth := NewAuthenticator(s).(*authenticator)
+
+	user, err := LoadUser(ctx, s, "user1")
+	assert.Nil(t, err)
+
+	// the password is changed after it's verified, before it's upgraded
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: "password2", ACL: ACL{"/topic": {Subscribe: true}}}))
+
+	assert.Equal(t, "password1", auth.upgradePassword(ctx, "user1", user, "password1"))
+
+	user, err = LoadUser(ctx, s, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, "password2", user.Password)
+	assert.True(t, user.ACL["/topic"].Subscribe)
+}
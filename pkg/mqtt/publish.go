@@ -19,24 +19,89 @@ package mqtt
 import (
 	"encoding/binary"
 	"errors"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// messageTTLPrefix is the prefix of topics that specify the TTL of a published
+// message, in seconds: $ttl/<seconds>/<topic>, e.g. $ttl/60//abcd/log
+const messageTTLPrefix = "$ttl/"
+
+// parseMessageTTL splits a topic that specifies the TTL of a published message
+// into the TTL and the topic, or returns a zero TTL if it doesn't specify one
+func parseMessageTTL(topic string) (time.Duration, string, error) {
+	if !strings.HasPrefix(topic, messageTTLPrefix) {
+		return 0, topic, nil
+	}
+
+	parts := strings.SplitN(topic[len(messageTTLPrefix):], "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", errors.New("invalid TTL topic")
+	}
+
+	seconds, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || seconds == 0 {
+		return 0, "", errors.New("invalid TTL")
+	}
+
+	return time.Duration(seconds) * time.Second, parts[1], nil
+}
+
 func (c *Client) authenticatePublish(topic string, qos QoS) error {
 	log.WithFields(c.logFields).Info("Authenticating publish")
-	return c.user.ACL.AuthenticatePublish(topic, qos)
+
+	err := c.currentUser().ACL.AuthenticatePublish(topic, qos, c.clientID, c.username)
+	if err != nil {
+		c.audit(AuditPublish, topic, err)
+	}
+
+	return err
 }
 
+// handlePublish queues a published message; its TTL is specified by the
+// publisher using a $ttl/<seconds>/ prefix, or the default of the topic in the
+// ACL
 func (c *Client) handlePublish(topic string, msg []byte, messageID uint16, qos QoS) error {
+	ttl, topic, err := parseMessageTTL(topic)
+	if err != nil {
+		return err
+	}
+
+	if isWildcardFilter(topic) {
+		return errors.New("topic contains wildcards")
+	}
+
 	if err := c.authenticatePublish(topic, qos); err != nil {
 		return err
 	}
 
-	if err := c.broker.QueueMessage(topic, string(msg), messageID, qos); err != nil {
+	if err := c.broker.CheckSubscriberLimits(c.ctx, topic, string(msg)); err != nil {
+		log.WithFields(c.logFields).WithFields(log.Fields{"topic": topic}).WithError(err).Warn("Rejecting a published message")
+		c.audit(AuditPublish, topic, err)
+
+		// the message is acked anyway, because the client would send it
+		// again and again otherwise
+		if qos == QoS0 {
+			return nil
+		}
+
+		return c.writePublishAck(messageID)
+	}
+
+	if ttl == 0 {
+		ttl = c.currentUser().ACL.TTL(topic, c.clientID, c.username)
+	}
+
+	if err := c.broker.QueueMessage(topic, string(msg), messageID, qos, ttl); err != nil {
 		return err
 	}
 
+	c.broker.count(metricMessagesReceived, 1)
+	c.broker.count(metricBytesReceived, int64(len(msg)))
+
 	if qos == QoS0 {
 		return nil
 	}
@@ -140,5 +205,8 @@ func (c *Client) publish(queuedMessage *QueuedMessage) error {
 		return errors.New("failed to send the message")
 	}
 
+	c.broker.count(metricMessagesSent, 1)
+	c.broker.count(metricBytesSent, int64(len(msg)))
+
 	return nil
 }
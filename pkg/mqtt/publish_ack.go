@@ -37,6 +37,7 @@ func (c *Client) writePublishAck(messageID uint16) error {
 }
 
 func (c *Client) handlePublishAck(messageID uint16) error {
+	c.redeliveries.Cancel(messageID)
 	return c.broker.UnqueueMessageForSubscriber(c.ctx, c.clientID, messageID)
 }
 
@@ -0,0 +1,214 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	redeliveryInitialDelay = ackTimeout
+	redeliveryMaxDelay     = time.Minute * 5
+	redeliveryJitter       = 0.2
+
+	maxDeliveryAttempts = 10
+)
+
+// redeliveryDelay returns the time to wait for an ack before the next delivery
+// attempt of a message, after it has been delivered attempts times
+func redeliveryDelay(attempts int) time.Duration {
+	delay := redeliveryInitialDelay
+	for i := 1; i < attempts && delay < redeliveryMaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > redeliveryMaxDelay {
+		delay = redeliveryMaxDelay
+	}
+
+	// spread retries of messages delivered together, so they don't arrive
+	// together again
+	jitter := time.Duration(float64(delay) * redeliveryJitter * (2*rand.Float64() - 1))
+	return delay + jitter
+}
+
+type redelivery struct {
+	messageID uint16
+	due       time.Time
+	index     int
+}
+
+type redeliveryQueue []*redelivery
+
+func (q redeliveryQueue) Len() int {
+	return len(q)
+}
+
+func (q redeliveryQueue) Less(i, j int) bool {
+	return q[i].due.Before(q[j].due)
+}
+
+func (q redeliveryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *redeliveryQueue) Push(x interface{}) {
+	r := x.(*redelivery)
+	r.index = len(*q)
+	*q = append(*q, r)
+}
+
+func (q *redeliveryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	r := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return r
+}
+
+// redeliveryScheduler keeps track of unacked messages and the time of their
+// next delivery attempt; it sleeps when no message is waiting for an ack
+type redeliveryScheduler struct {
+	lock    sync.Mutex
+	queue   redeliveryQueue
+	pending map[uint16]*redelivery
+	wake    chan struct{}
+}
+
+func newRedeliveryScheduler() *redeliveryScheduler {
+	return &redeliveryScheduler{
+		pending: make(map[uint16]*redelivery),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (s *redeliveryScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Schedule schedules the next delivery attempt of a message
+func (s *redeliveryScheduler) Schedule(messageID uint16, delay time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	due := time.Now().Add(delay)
+
+	if r, ok := s.pending[messageID]; ok {
+		r.due = due
+		heap.Fix(&s.queue, r.index)
+	} else {
+		r := &redelivery{messageID: messageID, due: due}
+		s.pending[messageID] = r
+		heap.Push(&s.queue, r)
+	}
+
+	s.notify()
+}
+
+// Cancel cancels the next delivery attempt of a message
+func (s *redeliveryScheduler) Cancel(messageID uint16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r, ok := s.pending[messageID]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&s.queue, r.index)
+	delete(s.pending, messageID)
+
+	s.notify()
+}
+
+// Len returns the number of messages waiting for an ack
+func (s *redeliveryScheduler) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.queue)
+}
+
+func (s *redeliveryScheduler) popDue(now time.Time) []uint16 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	due := make([]uint16, 0)
+	for len(s.queue) > 0 && !s.queue[0].due.After(now) {
+		r := heap.Pop(&s.queue).(*redelivery)
+		delete(s.pending, r.messageID)
+		due = append(due, r.messageID)
+	}
+
+	return due
+}
+
+func (s *redeliveryScheduler) nextTimer() *time.Timer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.queue) == 0 {
+		return nil
+	}
+
+	return time.NewTimer(time.Until(s.queue[0].due))
+}
+
+// Run passes the IDs of messages due for another delivery attempt to c
+func (s *redeliveryScheduler) Run(ctx context.Context, c chan<- uint16) {
+	for {
+		var expired <-chan time.Time
+
+		timer := s.nextTimer()
+		if timer != nil {
+			expired = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+
+		case <-s.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+
+		case now := <-expired:
+			for _, messageID := range s.popDue(now) {
+				select {
+				case <-ctx.Done():
+					return
+
+				case c <- messageID:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertDelay(t *testing.T, expected, delay time.Duration) {
+	jitter := time.Duration(float64(expected) * redeliveryJitter)
+	assert.True(t, delay >= expected-jitter && delay <= expected+jitter, "%v is not %v±%v", delay, expected, jitter)
+}
+
+func TestRedeliveryDelay(t *testing.T) {
+	assertDelay(t, redeliveryInitialDelay, redeliveryDelay(1))
+	assertDelay(t, redeliveryInitialDelay*2, redeliveryDelay(2))
+	assertDelay(t, redeliveryInitialDelay*4, redeliveryDelay(3))
+	assertDelay(t, redeliveryMaxDelay, redeliveryDelay(maxDeliveryAttempts))
+	assertDelay(t, redeliveryMaxDelay, redeliveryDelay(1000))
+}
+
+func TestRedeliveryScheduler_Order(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newRedeliveryScheduler()
+	c := make(chan uint16)
+	go s.Run(ctx, c)
+
+	s.Schedule(3, time.Millisecond*30)
+	s.Schedule(1, time.Millisecond*10)
+	s.Schedule(2, time.Millisecond*20)
+
+	assert.Equal(t, uint16(1), <-c)
+	assert.Equal(t, uint16(2), <-c)
+	assert.Equal(t, uint16(3), <-c)
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestRedeliveryScheduler_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newRedeliveryScheduler()
+	c := make(chan uint16)
+	go s.Run(ctx, c)
+
+	s.Schedule(1, time.Millisecond*10)
+	s.Schedule(2, time.Millisecond*20)
+	s.Cancel(1)
+	assert.Equal(t, 1, s.Len())
+
+	assert.Equal(t, uint16(2), <-c)
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestRedeliveryScheduler_Reschedule(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newRedeliveryScheduler()
+	c := make(chan uint16)
+	go s.Run(ctx, c)
+
+	s.Schedule(1, time.Millisecond*10)
+	s.Schedule(2, time.Millisecond*20)
+	s.Schedule(1, time.Millisecond*30)
+	assert.Equal(t, 2, s.Len())
+
+	assert.Equal(t, uint16(2), <-c)
+	assert.Equal(t, uint16(1), <-c)
+}
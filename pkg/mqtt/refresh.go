@@ -0,0 +1,138 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func (b *Broker) addConnectedClient(c *Client) {
+	b.connectedLock.Lock()
+	defer b.connectedLock.Unlock()
+
+	clients, ok := b.connected[c.username]
+	if !ok {
+		clients = make(map[*Client]struct{})
+		b.connected[c.username] = clients
+	}
+
+	clients[c] = struct{}{}
+}
+
+func (b *Broker) removeConnectedClient(c *Client) {
+	b.connectedLock.Lock()
+	defer b.connectedLock.Unlock()
+
+	clients, ok := b.connected[c.username]
+	if !ok {
+		return
+	}
+
+	delete(clients, c)
+	if len(clients) == 0 {
+		delete(b.connected, c.username)
+	}
+}
+
+// connectedClients returns the clients connected to this broker as a user, or
+// all clients if username is empty
+func (b *Broker) connectedClients(username string) []*Client {
+	b.connectedLock.Lock()
+	defer b.connectedLock.Unlock()
+
+	clients := make([]*Client, 0)
+	for connectedUsername, userClients := range b.connected {
+		if username != "" && connectedUsername != username {
+			continue
+		}
+
+		for c := range userClients {
+			clients = append(clients, c)
+		}
+	}
+
+	return clients
+}
+
+// maxConcurrentRefreshes limits the number of clients refreshed at once, so a
+// change of all users doesn't overload the user store
+const maxConcurrentRefreshes = 16
+
+// watchUsers refreshes connected clients when their users change, on any
+// broker
+func (b *Broker) watchUsers(changes <-chan string) {
+	sem := make(chan struct{}, maxConcurrentRefreshes)
+
+	for username := range changes {
+		for _, c := range b.connectedClients(username) {
+			sem <- struct{}{}
+			go func(c *Client) {
+				defer func() { <-sem }()
+				c.refreshUser()
+			}(c)
+		}
+	}
+}
+
+// kick disconnects a client
+func (c *Client) kick() {
+	c.conn.Close()
+	c.cancel()
+}
+
+// refreshUser authenticates a connected client again, without the password it
+// connected with, then disconnects it if it's no longer authorized, or updates
+// its permissions
+func (c *Client) refreshUser() {
+	refresh := c.currentUser().refresh
+	if refresh == nil {
+		// the authenticator doesn't support refresh
+		return
+	}
+
+	ctx := WithConnectInfo(c.ctx, ConnectInfo{ClientID: c.clientID, RemoteAddr: c.remoteAddr})
+
+	user, err := refresh(ctx)
+	if err == nil {
+		err = user.AuthenticateClientID(c.clientID, c.username)
+	}
+
+	if err != nil {
+		if !errors.Is(err, ErrBadCredentials) && !errors.Is(err, ErrClientIDRejected) {
+			// keep the current permissions if the user store is unavailable
+			log.WithFields(c.logFields).WithError(err).Warn("Failed to refresh a client")
+			return
+		}
+
+		log.WithFields(c.logFields).WithError(err).Warn("Disconnecting a client that is no longer authorized")
+		c.audit(AuditRefresh, "", err)
+		c.kick()
+		return
+	}
+
+	c.audit(AuditRefresh, "", nil)
+
+	if err := c.broker.SetClientLimits(c.ctx, c.clientID, &user.Limits); err != nil {
+		log.WithFields(c.logFields).WithError(err).Warn("Failed to update message queue limits")
+	}
+
+	c.setUser(user)
+
+	log.WithFields(c.logFields).Info("Refreshed a client")
+}
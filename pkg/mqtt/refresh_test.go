@@ -0,0 +1,157 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func connectTestClient(t *testing.T, broker *Broker, clientID, username, password string) *Client {
+	conn, peer := net.Pipe()
+	go io.Copy(ioutil.Discard, peer)
+
+	c, err := broker.NewClient(conn)
+	assert.Nil(t, err)
+	assert.Nil(t, c.handleConnect(clientID, username, password))
+
+	return c
+}
+
+func TestRefreshUser(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: "password1", ACL: ACL{"/%c/log": {Publish: true}}}))
+	assert.Nil(t, SaveUser(ctx, s, "user2", &User{Password: "password2", ACL: ACL{"/%c/log": {Publish: true}}}))
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	first := connectTestClient(t, broker, "abcd", "user1", "password1")
+	defer first.Close()
+
+	second := connectTestClient(t, broker, "efgh", "user2", "password2")
+	defer second.Close()
+
+	assert.Nil(t, first.authenticatePublish("/abcd/log", QoS0))
+
+	// permissions are refreshed in place
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: "password1", ACL: ACL{"/%c/results": {Publish: true}}}))
+
+	assert.Eventually(t, func() bool {
+		return first.authenticatePublish("/abcd/log", QoS0) != nil
+	}, time.Second*10, time.Millisecond*10)
+	assert.Nil(t, first.authenticatePublish("/abcd/results", QoS0))
+	assert.Nil(t, first.ctx.Err())
+
+	// a client is disconnected when its credentials are revoked
+	assert.Nil(t, DeleteUser(ctx, s, "user1"))
+
+	assert.Eventually(t, func() bool {
+		return first.ctx.Err() != nil
+	}, time.Second*10, time.Millisecond*10)
+
+	assert.Nil(t, second.ctx.Err())
+	assert.Nil(t, second.authenticatePublish("/efgh/log", QoS0))
+
+	// a client is disconnected when it may no longer use its client ID
+	assert.Nil(t, SaveUser(ctx, s, "user2", &User{Password: "password2", ClientIDs: []string{"ijkl"}}))
+
+	assert.Eventually(t, func() bool {
+		return second.ctx.Err() != nil
+	}, time.Second*10, time.Millisecond*10)
+}
+
+func TestRefreshUser_PasswordChanged(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hash, err := HashPassword("password1", DefaultPasswordAlgorithm)
+	assert.Nil(t, err)
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: hash, ACL: ACL{"/%c/log": {Publish: true}}}))
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	c := connectTestClient(t, broker, "abcd", "user1", "password1")
+	defer c.Close()
+
+	// the same hash is still accepted
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: hash, ACL: ACL{"/%c/results": {Publish: true}}}))
+
+	assert.Eventually(t, func() bool {
+		return c.authenticatePublish("/abcd/results", QoS0) == nil
+	}, time.Second*10, time.Millisecond*10)
+	assert.Nil(t, c.ctx.Err())
+
+	// the client doesn't keep its password, so it's disconnected when the
+	// password changes
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: "password2", ACL: ACL{"/%c/results": {Publish: true}}}))
+
+	assert.Eventually(t, func() bool {
+		return c.ctx.Err() != nil
+	}, time.Second*10, time.Millisecond*10)
+}
+
+func TestRefreshUser_RotationCompleted(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: "password1", ClientIDs: []string{"abcd"}, ACL: ACL{"/%c/log": {Publish: true}}}))
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	_, err = broker.RotateCredentials(ctx, "user1", time.Hour, false)
+	assert.Nil(t, err)
+
+	command := receiveRotateCredentialsCommand(t, broker, ctx, "abcd")
+
+	password, err := RedeemRotation(ctx, s, "user1", "password1", command.Nonce)
+	assert.Nil(t, err)
+
+	// the first connection with the new password completes rotation
+	c := connectTestClient(t, broker, "abcd", "user1", password)
+	defer c.Close()
+
+	user, err := LoadUser(ctx, s, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, "", user.NextPassword)
+
+	user.ACL = ACL{"/%c/results": {Publish: true}}
+	assert.Nil(t, SaveUser(ctx, s, "user1", user))
+
+	// the client is refreshed, not disconnected
+	assert.Eventually(t, func() bool {
+		return c.authenticatePublish("/abcd/results", QoS0) == nil
+	}, time.Second*10, time.Millisecond*10)
+	assert.Nil(t, c.ctx.Err())
+}
@@ -0,0 +1,156 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dimkr/yodi/pkg/store"
+)
+
+// Role is a named set of permissions shared by users
+type Role struct {
+	ACL ACL `json:"acl"`
+}
+
+const rolesMap = "/roles"
+
+// ErrRoleInUse indicates that a role cannot be deleted, because users have it
+var ErrRoleInUse = errors.New("role is in use")
+
+// Validate determines whether or not a role is valid
+func (r *Role) Validate() error {
+	if err := r.ACL.Validate(); err != nil {
+		return fmt.Errorf("invalid ACL: %w", err)
+	}
+
+	return nil
+}
+
+// LoadRole returns a role from the role store
+func LoadRole(ctx context.Context, s store.Store, name string) (*Role, error) {
+	j, err := s.Map(rolesMap).Get(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find role '%s': %w", name, err)
+	}
+
+	var role Role
+	if err := json.Unmarshal([]byte(j), &role); err != nil {
+		return nil, fmt.Errorf("Failed to find role '%s': %w", name, err)
+	}
+
+	return &role, nil
+}
+
+// SaveRole adds or replaces a role in the role store
+func SaveRole(ctx context.Context, s store.Store, name string, role *Role) error {
+	if err := role.Validate(); err != nil {
+		return err
+	}
+
+	j, err := json.Marshal(role)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Map(rolesMap).Set(ctx, name, string(j)); err != nil {
+		return err
+	}
+
+	return NotifyUserChanged(ctx, s, "")
+}
+
+// DeleteRole removes a role from the role store, or returns ErrRoleInUse if
+// users still have it
+func DeleteRole(ctx context.Context, s store.Store, name string) error {
+	if _, err := LoadRole(ctx, s, name); err != nil {
+		return err
+	}
+
+	if err := s.Transaction(ctx, []string{usersMap}, func(ctx context.Context, tx store.Tx) error {
+		users, err := ListUsers(ctx, s)
+		if err != nil {
+			return err
+		}
+
+		for username, user := range users {
+			for _, role := range user.Roles {
+				if role == name {
+					return fmt.Errorf("%w: '%s' has it", ErrRoleInUse, username)
+				}
+			}
+		}
+
+		tx.MapRemove(rolesMap, name)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return NotifyUserChanged(ctx, s, "")
+}
+
+// ListRoles returns all roles in the role store
+func ListRoles(ctx context.Context, s store.Store) (map[string]*Role, error) {
+	roles := make(map[string]*Role)
+
+	if err := s.Map(rolesMap).Scan(ctx, func(ctx context.Context, k, v string) {
+		var role Role
+		if err := json.Unmarshal([]byte(v), &role); err != nil {
+			return
+		}
+
+		roles[k] = &role
+	}); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// ResolveRoles returns a copy of a user, with an ACL that combines the ACLs of
+// its roles and its own ACL; entries of a role override entries of previous
+// roles, and the user's entries override entries of all roles
+func ResolveRoles(ctx context.Context, s store.Store, user *User) (*User, error) {
+	resolvedUser := *user
+
+	if len(user.Roles) == 0 {
+		return &resolvedUser, nil
+	}
+
+	resolvedUser.ACL = make(ACL)
+
+	for _, name := range user.Roles {
+		role, err := LoadRole(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+
+		for topic, entry := range role.ACL {
+			resolvedUser.ACL[topic] = entry
+		}
+	}
+
+	for topic, entry := range user.ACL {
+		resolvedUser.ACL[topic] = entry
+	}
+
+	return &resolvedUser, nil
+}
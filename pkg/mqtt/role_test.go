@@ -0,0 +1,95 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticateUser_Roles(t *testing.T) {
+	store := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, SaveRole(ctx, store, "device", &Role{ACL: ACL{
+		"/%c/commands": {Subscribe: true, QoS: QoS1},
+		"/%c/results":  {Publish: true, QoS: QoS1},
+		"/%c/log":      {Publish: true},
+	}}))
+	assert.Nil(t, SaveRole(ctx, store, "quiet", &Role{ACL: ACL{
+		"/%c/log": {Deny: true},
+	}}))
+	assert.Nil(t, store.Map(usersMap).Set(ctx, "user1", `{"password": "password1", "roles": ["device", "quiet"], "acl": {"/%c/results": {"publish": true}}}`))
+
+	auth := NewAuthenticator(store)
+
+	user, err := auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+	assert.Nil(t, user.ACL.AuthenticateSubscribe("/abcd/commands", QoS1, "abcd", "user1"))
+	assert.NotNil(t, user.ACL.AuthenticatePublish("/abcd/results", QoS1, "abcd", "user1"))
+	assert.Nil(t, user.ACL.AuthenticatePublish("/abcd/results", QoS0, "abcd", "user1"))
+	assert.NotNil(t, user.ACL.AuthenticatePublish("/abcd/log", QoS0, "abcd", "user1"))
+
+	// role changes apply to new connections
+	assert.Nil(t, SaveRole(ctx, store, "quiet", &Role{}))
+
+	user, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+	assert.Nil(t, user.ACL.AuthenticatePublish("/abcd/log", QoS0, "abcd", "user1"))
+
+	storedUser, err := LoadUser(ctx, store, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(storedUser.ACL))
+
+	// a role cannot be deleted while users have it
+	assert.True(t, errors.Is(DeleteRole(ctx, store, "quiet"), ErrRoleInUse))
+
+	_, err = LoadRole(ctx, store, "quiet")
+	assert.Nil(t, err)
+
+	assert.Nil(t, store.Map(rolesMap).Remove(ctx, "quiet"))
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.NotNil(t, err)
+	assert.NotEqual(t, ErrBadCredentials, err)
+}
+
+func TestDeleteRole(t *testing.T) {
+	s := store.NewMemoryStore()
+	ctx := context.Background()
+
+	assert.NotNil(t, SaveRole(ctx, s, "device", &Role{ACL: ACL{"": {Publish: true}}}))
+
+	assert.Nil(t, SaveRole(ctx, s, "device", &Role{ACL: ACL{"/%c/log": {Publish: true}}}))
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: "password1", Roles: []string{"device"}}))
+
+	assert.True(t, errors.Is(DeleteRole(ctx, s, "device"), ErrRoleInUse))
+
+	assert.Nil(t, DeleteUser(ctx, s, "user1"))
+	assert.Nil(t, DeleteRole(ctx, s, "device"))
+
+	_, err := LoadRole(ctx, s, "device")
+	assert.True(t, errors.Is(err, store.ErrNoKey))
+
+	assert.True(t, errors.Is(DeleteRole(ctx, s, "device"), store.ErrNoKey))
+}
@@ -0,0 +1,555 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// RotationState is the state of credential rotation
+type RotationState string
+
+const (
+	// RotationPending indicates that the device hasn't authenticated with its
+	// new password yet
+	RotationPending RotationState = "pending"
+
+	// RotationCompleted indicates that the device has authenticated with its
+	// new password, and the old one is retired
+	RotationCompleted RotationState = "completed"
+
+	// RotationExpired indicates that the device hasn't authenticated with its
+	// new password before the deadline; its old password is retired, unless
+	// the rotation keeps it until the device does
+	RotationExpired RotationState = "expired"
+)
+
+// Rotation tracks credential rotation of a device
+type Rotation struct {
+	ID        string        `json:"id"`
+	Username  string        `json:"username"`
+	ClientID  string        `json:"client_id"`
+	State     RotationState `json:"state"`
+	Started   time.Time     `json:"started"`
+	Deadline  time.Time     `json:"deadline"`
+	Completed *time.Time    `json:"completed,omitempty"`
+
+	// KeepOldPassword determines whether or not the old password is accepted
+	// after the deadline, until the device authenticates with the new one
+	KeepOldPassword bool `json:"keep_old_password,omitempty"`
+}
+
+// rotateCredentialsCommand tells a device to redeem a one-time nonce for a new
+// password, using RedeemRotation; the password itself is never queued, so it
+// doesn't stay in message queues or dead letters
+type rotateCredentialsCommand struct {
+	Type     string    `json:"type"`
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Nonce    string    `json:"nonce"`
+	Deadline time.Time `json:"deadline"`
+}
+
+const (
+	rotationsMap = "/rotations"
+
+	// rotationNoncesMap maps users to the hashes of their rotation nonces
+	rotationNoncesMap = "/rotations/nonces"
+
+	rotateCredentialsCommandType = "rotate_credentials"
+	commandTopicFmt              = "/%s/commands"
+)
+
+// ErrNoDeviceClientID indicates that a user doesn't belong to a single device
+var ErrNoDeviceClientID = errors.New("user is not bound to a single client ID")
+
+// ErrInvalidRotationNonce indicates that a rotation nonce is wrong, expired or
+// used; it's counted as a failed attempt of the user
+var ErrInvalidRotationNonce = fmt.Errorf("%w: invalid rotation nonce", ErrBadCredentials)
+
+// deviceClientID returns the client ID of a device, if its user may connect only
+// with one client ID
+func deviceClientID(user *User) (string, error) {
+	if len(user.ClientIDs) != 1 || strings.Contains(user.ClientIDs[0], clientIDWildcard) || strings.Contains(user.ClientIDs[0], usernamePlaceholder) {
+		return "", ErrNoDeviceClientID
+	}
+
+	return user.ClientIDs[0], nil
+}
+
+func saveRotation(ctx context.Context, s store.Store, rotation *Rotation) error {
+	j, err := json.Marshal(rotation)
+	if err != nil {
+		return err
+	}
+
+	return s.Map(rotationsMap).Set(ctx, rotation.Username, string(j))
+}
+
+func decodeRotation(j string, now time.Time) (*Rotation, error) {
+	var rotation Rotation
+	if err := json.Unmarshal([]byte(j), &rotation); err != nil {
+		return nil, err
+	}
+
+	if rotation.State == RotationPending && now.After(rotation.Deadline) {
+		rotation.State = RotationExpired
+	}
+
+	return &rotation, nil
+}
+
+// GetRotation returns the status of the last credential rotation of a device
+func GetRotation(ctx context.Context, s store.Store, username string) (*Rotation, error) {
+	j, err := s.Map(rotationsMap).Get(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeRotation(j, time.Now())
+}
+
+// ListRotations returns the status of the last credential rotation of all
+// devices
+func ListRotations(ctx context.Context, s store.Store) ([]*Rotation, error) {
+	rotations := make([]*Rotation, 0)
+	now := time.Now()
+
+	if err := s.Map(rotationsMap).Scan(ctx, func(ctx context.Context, k, v string) {
+		rotation, err := decodeRotation(v, now)
+		if err != nil {
+			log.WithFields(log.Fields{"username": k}).WithError(err).Warn("Failed to decode a rotation")
+			return
+		}
+
+		rotations = append(rotations, rotation)
+	}); err != nil {
+		return nil, err
+	}
+
+	return rotations, nil
+}
+
+// completeRotation replaces the password of a user with the next one, after
+// the first successful authentication with it
+func (a *authenticator) completeRotation(ctx context.Context, username string, user *User) {
+	user.Password = user.NextPassword
+	user.NextPassword = ""
+	user.RotationDeadline = nil
+	user.KeepOldPassword = false
+
+	// this disconnects clients that are still connected with the old password
+	if err := SaveUser(ctx, a.store, username, user); err != nil {
+		log.WithFields(log.Fields{"username": username}).WithError(err).Warn("Failed to complete credential rotation")
+		return
+	}
+
+	rotation, err := GetRotation(ctx, a.store, username)
+	if err != nil {
+		log.WithFields(log.Fields{"username": username}).WithError(err).Warn("Failed to find credential rotation")
+		return
+	}
+
+	now := time.Now()
+	rotation.State = RotationCompleted
+	rotation.Completed = &now
+
+	if err := saveRotation(ctx, a.store, rotation); err != nil {
+		log.WithFields(log.Fields{"username": username}).WithError(err).Warn("Failed to save credential rotation")
+		return
+	}
+
+	log.WithFields(log.Fields{"username": username}).Info("Completed credential rotation")
+}
+
+// RotateCredentials sends a one-time nonce to a device's command topic, which
+// the device redeems for a new password before the grace period is over; both
+// passwords are accepted until the device authenticates with the new one, or
+// until the deadline. If keepOldPassword is true, the old password is accepted
+// after the deadline too, until the device authenticates with the new one, so
+// devices that are offline during the grace period aren't locked out.
+func (b *Broker) RotateCredentials(ctx context.Context, username string, grace time.Duration, keepOldPassword bool) (*Rotation, error) {
+	if grace <= 0 {
+		return nil, errors.New("grace period must be positive")
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	deadline := now.Add(grace)
+
+	var clientID string
+	if err := b.store.Transaction(ctx, []string{usersMap}, func(ctx context.Context, tx store.Tx) error {
+		user, err := LoadUser(ctx, b.store, username)
+		if err != nil {
+			return err
+		}
+
+		clientID, err = deviceClientID(user)
+		if err != nil {
+			return fmt.Errorf("Cannot rotate the credentials of '%s': %w", username, err)
+		}
+
+		// a new rotation replaces a previous one the device hasn't completed
+		user.NextPassword = ""
+		user.RotationDeadline = &deadline
+		user.KeepOldPassword = keepOldPassword
+
+		j, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+
+		tx.MapSet(usersMap, username, string(j))
+		tx.MapSet(rotationNoncesMap, username, tokenID(nonce))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	expireField(ctx, b.store.Map(rotationNoncesMap), username, grace)
+
+	if err := NotifyUserChanged(ctx, b.store, username); err != nil {
+		log.WithFields(log.Fields{"username": username}).WithError(err).Warn("Failed to notify about credential rotation")
+	}
+
+	rotation := Rotation{
+		ID:              id,
+		Username:        username,
+		ClientID:        clientID,
+		State:           RotationPending,
+		Started:         now,
+		Deadline:        deadline,
+		KeepOldPassword: keepOldPassword,
+	}
+
+	if err := saveRotation(ctx, b.store, &rotation); err != nil {
+		return nil, err
+	}
+
+	j, err := json.Marshal(&rotateCredentialsCommand{
+		Type:     rotateCredentialsCommandType,
+		ID:       id,
+		Username: username,
+		Nonce:    nonce,
+		Deadline: deadline,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the command is queued for the device even if it's not connected, so it
+	// receives it when it connects with its old password; the nonce is
+	// useless after the deadline, if not delivered
+	command := QueuedMessage{Topic: fmt.Sprintf(commandTopicFmt, clientID), Message: string(j), QoS: QoS1, Expiry: &deadline}
+	if err := b.QueueMessageForSubscriber(ctx, clientID, &command); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{"username": username, "client_id": clientID, "deadline": deadline}).Info("Started credential rotation")
+
+	return &rotation, nil
+}
+
+// RedeemRotation exchanges a rotation nonce for a new password of a device,
+// which authenticates with its current password; the nonce can be used once,
+// and only before the deadline. Like authentication of clients, users and the
+// addresses they connect from (taken from the ConnectInfo of ctx) are locked
+// out after repeated failed attempts.
+func RedeemRotation(ctx context.Context, s store.Store, username, password, nonce string) (string, error) {
+	var nextPassword string
+	if err := withLockouts(ctx, s, userLockouts, username, ipLockouts, remoteHost(ConnectInfoFromContext(ctx)), func() error {
+		var err error
+		nextPassword, err = redeemRotation(ctx, s, username, password, nonce)
+		return err
+	}); err != nil {
+		return "", err
+	}
+
+	return nextPassword, nil
+}
+
+func redeemRotation(ctx context.Context, s store.Store, username, password, nonce string) (string, error) {
+	var nextPassword string
+
+	if err := s.Transaction(ctx, []string{usersMap, rotationNoncesMap}, func(ctx context.Context, tx store.Tx) error {
+		user, err := LoadUser(ctx, s, username)
+		if err != nil {
+			if errors.Is(err, store.ErrNoKey) {
+				return ErrBadCredentials
+			}
+			return err
+		}
+
+		ok, err := VerifyPassword(user.Password, password)
+		if err != nil {
+			return fmt.Errorf("Failed to verify the password of '%s': %w", username, err)
+		}
+		if !ok {
+			return ErrBadCredentials
+		}
+
+		hash, err := s.Map(rotationNoncesMap).Get(ctx, username)
+		if err != nil {
+			if errors.Is(err, store.ErrNoKey) {
+				return ErrInvalidRotationNonce
+			}
+			return err
+		}
+
+		if user.RotationDeadline == nil || time.Now().After(*user.RotationDeadline) || subtle.ConstantTimeCompare([]byte(hash), []byte(tokenID(nonce))) != 1 {
+			return ErrInvalidRotationNonce
+		}
+
+		nextPassword, err = randomHex(32)
+		if err != nil {
+			return err
+		}
+
+		user.NextPassword, err = HashPassword(nextPassword, DefaultPasswordAlgorithm)
+		if err != nil {
+			return err
+		}
+
+		j, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+
+		tx.MapSet(usersMap, username, string(j))
+		tx.MapRemove(rotationNoncesMap, username)
+		return nil
+	}); err != nil {
+		return "", err
+	}
+
+	if err := NotifyUserChanged(ctx, s, username); err != nil {
+		log.WithFields(log.Fields{"username": username}).WithError(err).Warn("Failed to notify about a redeemed rotation nonce")
+	}
+
+	log.WithFields(log.Fields{"username": username}).Info("Issued a new password")
+
+	return nextPassword, nil
+}
+
+// RotationJobDeviceState is the state of a device in a rotation job
+type RotationJobDeviceState string
+
+const (
+	// RotationJobQueued indicates that the job hasn't reached the device yet
+	RotationJobQueued RotationJobDeviceState = "queued"
+
+	// RotationJobStarted indicates that rotation has started; its progress is
+	// tracked by the Rotation of the device
+	RotationJobStarted RotationJobDeviceState = "started"
+
+	// RotationJobFailed indicates that rotation couldn't start
+	RotationJobFailed RotationJobDeviceState = "failed"
+)
+
+// RotationJobDevice is the progress of a rotation job for a device
+type RotationJobDevice struct {
+	State RotationJobDeviceState `json:"state"`
+	Error string                 `json:"error,omitempty"`
+}
+
+// RotationJob rotates the credentials of several devices in the background
+type RotationJob struct {
+	ID       string                        `json:"id"`
+	Started  time.Time                     `json:"started"`
+	Finished *time.Time                    `json:"finished,omitempty"`
+	Devices  map[string]*RotationJobDevice `json:"devices,omitempty"`
+}
+
+const (
+	rotationJobsMap       = "/rotations/jobs"
+	rotationJobDevicesFmt = "/rotations/jobs/%s"
+
+	// rotationJobTTL is the time jobs are kept after they start
+	rotationJobTTL = 7 * 24 * time.Hour
+)
+
+func saveRotationJob(ctx context.Context, s store.Store, job *RotationJob) error {
+	j, err := json.Marshal(&RotationJob{ID: job.ID, Started: job.Started, Finished: job.Finished})
+	if err != nil {
+		return err
+	}
+
+	m := s.Map(rotationJobsMap)
+	if err := m.Set(ctx, job.ID, string(j)); err != nil {
+		return err
+	}
+
+	expireField(ctx, m, job.ID, time.Until(job.Started.Add(rotationJobTTL)))
+	return nil
+}
+
+func saveRotationJobDevice(ctx context.Context, s store.Store, id, username string, device *RotationJobDevice) error {
+	j, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+
+	return s.Map(fmt.Sprintf(rotationJobDevicesFmt, id)).Set(ctx, username, string(j))
+}
+
+// GetRotationJob returns the progress of a rotation job
+func GetRotationJob(ctx context.Context, s store.Store, id string) (*RotationJob, error) {
+	j, err := s.Map(rotationJobsMap).Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var job RotationJob
+	if err := json.Unmarshal([]byte(j), &job); err != nil {
+		return nil, err
+	}
+
+	job.Devices = make(map[string]*RotationJobDevice)
+
+	if err := s.Map(fmt.Sprintf(rotationJobDevicesFmt, id)).Scan(ctx, func(ctx context.Context, k, v string) {
+		var device RotationJobDevice
+		if err := json.Unmarshal([]byte(v), &device); err != nil {
+			log.WithFields(log.Fields{"job": id, "username": k}).WithError(err).Warn("Failed to decode a rotation job")
+			return
+		}
+
+		job.Devices[k] = &device
+	}); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// StartRotationJob starts rotation of the credentials of several devices, or
+// all devices if usernames is empty, in the background; event is recorded for
+// every rotation that starts, with the username as its target, and
+// keepOldPassword is passed to RotateCredentials. The progress of
+// the job is available through GetRotationJob; if the broker stops before the
+// job is finished, the remaining devices stay queued.
+func (b *Broker) StartRotationJob(ctx context.Context, usernames []string, grace time.Duration, keepOldPassword bool, event AuditEvent) (*RotationJob, error) {
+	if grace <= 0 {
+		return nil, errors.New("grace period must be positive")
+	}
+
+	if len(usernames) == 0 {
+		users, err := ListUsers(ctx, b.store)
+		if err != nil {
+			return nil, err
+		}
+
+		for username, user := range users {
+			// skip users that don't belong to a device
+			if _, err := deviceClientID(user); err == nil {
+				usernames = append(usernames, username)
+			}
+		}
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	job := RotationJob{
+		ID:      id,
+		Started: time.Now(),
+		Devices: make(map[string]*RotationJobDevice, len(usernames)),
+	}
+
+	devices := fmt.Sprintf(rotationJobDevicesFmt, id)
+
+	if err := b.store.Transaction(ctx, nil, func(ctx context.Context, tx store.Tx) error {
+		for _, username := range usernames {
+			device := RotationJobDevice{State: RotationJobQueued}
+
+			j, err := json.Marshal(&device)
+			if err != nil {
+				return err
+			}
+
+			tx.MapSet(devices, username, string(j))
+			job.Devices[username] = &device
+		}
+
+		tx.Expire(devices, rotationJobTTL)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := saveRotationJob(ctx, b.store, &job); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{"job": id, "devices": len(usernames)}).Info("Started a rotation job")
+
+	go b.runRotationJob(RotationJob{ID: id, Started: job.Started}, usernames, grace, keepOldPassword, event)
+
+	return &job, nil
+}
+
+func (b *Broker) runRotationJob(job RotationJob, usernames []string, grace time.Duration, keepOldPassword bool, event AuditEvent) {
+	for _, username := range usernames {
+		device := RotationJobDevice{State: RotationJobStarted}
+
+		if _, err := b.RotateCredentials(b.ctx, username, grace, keepOldPassword); err != nil {
+			if b.ctx.Err() != nil {
+				return
+			}
+
+			device = RotationJobDevice{State: RotationJobFailed, Error: err.Error()}
+		} else {
+			rotationEvent := event
+			rotationEvent.Target = username
+			rotationEvent.Allowed = true
+			b.Audit(b.ctx, &rotationEvent)
+		}
+
+		if err := saveRotationJobDevice(b.ctx, b.store, job.ID, username, &device); err != nil {
+			log.WithFields(log.Fields{"job": job.ID, "username": username}).WithError(err).Warn("Failed to save the progress of a rotation job")
+		}
+	}
+
+	now := time.Now()
+	job.Finished = &now
+
+	if err := saveRotationJob(b.ctx, b.store, &job); err != nil {
+		log.WithFields(log.Fields{"job": job.ID}).WithError(err).Warn("Failed to save a rotation job")
+		return
+	}
+
+	log.WithFields(log.Fields{"job": job.ID}).Info("Finished a rotation job")
+}
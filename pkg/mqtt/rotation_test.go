@@ -0,0 +1,267 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func receiveRotateCredentialsCommand(t *testing.T, broker *Broker, ctx context.Context, clientID string) *rotateCredentialsCommand {
+	var command *rotateCredentialsCommand
+
+	assert.Nil(t, broker.ScanQueuedMessagesForClient(ctx, clientID, func(queuedMessage *QueuedMessage) {
+		assert.Equal(t, "/"+clientID+"/commands", queuedMessage.Topic)
+		assert.EqualValues(t, QoS1, queuedMessage.QoS)
+
+		command = &rotateCredentialsCommand{}
+		assert.Nil(t, json.Unmarshal([]byte(queuedMessage.Message), command))
+	}))
+
+	return command
+}
+
+func TestRotateCredentials(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: "password1", ClientIDs: []string{"abcd"}}))
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	rotation, err := broker.RotateCredentials(ctx, "user1", time.Hour, false)
+	assert.Nil(t, err)
+	assert.Equal(t, RotationPending, rotation.State)
+	assert.Equal(t, "abcd", rotation.ClientID)
+
+	command := receiveRotateCredentialsCommand(t, broker, ctx, "abcd")
+	assert.Equal(t, rotateCredentialsCommandType, command.Type)
+	assert.Equal(t, rotation.ID, command.ID)
+	assert.Equal(t, "user1", command.Username)
+
+	// the nonce is redeemed with the current password
+	_, err = RedeemRotation(ctx, s, "user1", "password2", command.Nonce)
+	assert.Equal(t, ErrBadCredentials, err)
+
+	_, err = RedeemRotation(ctx, s, "user1", "password1", "abcd")
+	assert.Equal(t, ErrInvalidRotationNonce, err)
+
+	password, err := RedeemRotation(ctx, s, "user1", "password1", command.Nonce)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", password)
+
+	// the nonce can be used only once
+	_, err = RedeemRotation(ctx, s, "user1", "password1", command.Nonce)
+	assert.Equal(t, ErrInvalidRotationNonce, err)
+
+	auth := NewAuthenticator(s)
+
+	// both passwords are accepted until the new one is used
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", password)
+	assert.Nil(t, err)
+
+	rotation, err = GetRotation(ctx, s, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, RotationCompleted, rotation.State)
+	assert.NotNil(t, rotation.Completed)
+
+	// the old password is retired once the new one is used
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Equal(t, ErrBadCredentials, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", password)
+	assert.Nil(t, err)
+
+	user, err := LoadUser(ctx, s, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, "", user.NextPassword)
+	assert.Nil(t, user.RotationDeadline)
+}
+
+func TestRotateCredentials_Expired(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: "password1", ClientIDs: []string{"abcd"}}))
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	_, err = broker.RotateCredentials(ctx, "user1", time.Millisecond*50, false)
+	assert.Nil(t, err)
+
+	command := receiveRotateCredentialsCommand(t, broker, ctx, "abcd")
+
+	password, err := RedeemRotation(ctx, s, "user1", "password1", command.Nonce)
+	assert.Nil(t, err)
+
+	time.Sleep(time.Millisecond * 100)
+
+	rotation, err := GetRotation(ctx, s, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, RotationExpired, rotation.State)
+
+	auth := NewAuthenticator(s)
+
+	// the old password is retired after the deadline
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Equal(t, ErrBadCredentials, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", password)
+	assert.Nil(t, err)
+}
+
+func TestRotateCredentials_KeepOldPassword(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: "password1", ClientIDs: []string{"abcd"}}))
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	rotation, err := broker.RotateCredentials(ctx, "user1", time.Millisecond*50, true)
+	assert.Nil(t, err)
+	assert.True(t, rotation.KeepOldPassword)
+
+	command := receiveRotateCredentialsCommand(t, broker, ctx, "abcd")
+
+	password, err := RedeemRotation(ctx, s, "user1", "password1", command.Nonce)
+	assert.Nil(t, err)
+
+	time.Sleep(time.Millisecond * 100)
+
+	rotation, err = GetRotation(ctx, s, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, RotationExpired, rotation.State)
+
+	auth := NewAuthenticator(s)
+
+	// a device that misses the deadline is not locked out
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", password)
+	assert.Nil(t, err)
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Equal(t, ErrBadCredentials, err)
+
+	user, err := LoadUser(ctx, s, "user1")
+	assert.Nil(t, err)
+	assert.False(t, user.KeepOldPassword)
+}
+
+func TestRedeemRotation_Expired(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, SaveUser(ctx, s, "user1", &User{Password: "password1", ClientIDs: []string{"abcd"}}))
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	_, err = broker.RotateCredentials(ctx, "user1", time.Millisecond*10, false)
+	assert.Nil(t, err)
+
+	command := receiveRotateCredentialsCommand(t, broker, ctx, "abcd")
+
+	time.Sleep(time.Millisecond * 20)
+
+	_, err = RedeemRotation(ctx, s, "user1", "password1", command.Nonce)
+	assert.Equal(t, ErrInvalidRotationNonce, err)
+
+	_, err = NewAuthenticator(s).AuthenticateUser(ctx, "user1", "password1")
+	assert.Equal(t, ErrBadCredentials, err)
+}
+
+func waitForRotationJob(t *testing.T, s store.Store, ctx context.Context, id string) *RotationJob {
+	for i := 0; i < 100; i++ {
+		job, err := GetRotationJob(ctx, s, id)
+		assert.Nil(t, err)
+		if job.Finished != nil {
+			return job
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatal("rotation job has not finished")
+	return nil
+}
+
+func TestStartRotationJob(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, SaveUser(ctx, s, "device1", &User{Password: "password1", ClientIDs: []string{"abcd"}}))
+	assert.Nil(t, SaveUser(ctx, s, "device2", &User{Password: "password2", ClientIDs: []string{"efgh"}}))
+	assert.Nil(t, SaveUser(ctx, s, "operator", &User{Password: "password3", ClientIDs: []string{"%u-*"}}))
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	job, err := broker.StartRotationJob(ctx, nil, time.Hour, false, AuditEvent{Action: AuditRotate, Operator: "alice"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(job.Devices))
+
+	job = waitForRotationJob(t, s, ctx, job.ID)
+	assert.Equal(t, 2, len(job.Devices))
+	assert.Equal(t, RotationJobStarted, job.Devices["device1"].State)
+	assert.Equal(t, RotationJobStarted, job.Devices["device2"].State)
+
+	events, err := ListAuditEvents(ctx, s, &AuditFilter{Action: AuditRotate, Operator: "alice"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+
+	job, err = broker.StartRotationJob(ctx, []string{"device1", "operator", "nobody"}, time.Hour, false, AuditEvent{Action: AuditRotate})
+	assert.Nil(t, err)
+
+	job = waitForRotationJob(t, s, ctx, job.ID)
+	assert.Equal(t, 3, len(job.Devices))
+	assert.Equal(t, RotationJobStarted, job.Devices["device1"].State)
+	assert.Equal(t, RotationJobFailed, job.Devices["operator"].State)
+	assert.NotEqual(t, "", job.Devices["operator"].Error)
+	assert.Equal(t, RotationJobFailed, job.Devices["nobody"].State)
+
+	all, err := ListRotations(ctx, s)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(all))
+
+	_, err = GetRotationJob(ctx, s, "abcd")
+	assert.True(t, errors.Is(err, store.ErrNoKey))
+}
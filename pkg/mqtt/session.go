@@ -0,0 +1,169 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	clientSessionMapFmt = "/client/%s/session"
+
+	// clientSessionTTL is the time a client remains registered after its
+	// broker stops refreshing its session, i.e. if the broker crashes
+	clientSessionTTL = 90 * time.Second
+
+	// clientKeysTTL is the time the subscriptions and message queue of a
+	// client are kept after its broker stops refreshing its session, if
+	// the client is never reaped
+	clientKeysTTL = time.Hour
+
+	clientSessionLastSeen = "last_seen"
+)
+
+// expireField removes a field of a map after a TTL, if the store supports it
+func expireField(ctx context.Context, m store.Map, field string, ttl time.Duration) {
+	if err := m.ExpireField(ctx, field, ttl); err != nil && !errors.Is(err, store.ErrNotSupported) {
+		log.WithError(err).Warn("Failed to set the TTL of a field")
+	}
+}
+
+// expireClientKeysTx queues the postponement of expiry of the keys of a client
+func expireClientKeysTx(tx store.Tx, clientID string) {
+	for _, key := range []string{
+		fmt.Sprintf(clientSubscriptionsSetFmt, clientID),
+		fmt.Sprintf(clientMessageQueueFmt, clientID),
+		fmt.Sprintf(clientMessageNotificationFmt, clientID),
+		fmt.Sprintf(clientUsageMapFmt, clientID),
+	} {
+		tx.Expire(key, clientKeysTTL)
+	}
+}
+
+// expireClientKeys postpones expiry of the keys of a client, without
+// refreshing its session
+func (b *Broker) expireClientKeys(ctx context.Context, clientID string) error {
+	return b.store.Transaction(ctx, nil, func(ctx context.Context, tx store.Tx) error {
+		expireClientKeysTx(tx, clientID)
+		return nil
+	})
+}
+
+// touchClient refreshes the session of a client and postpones expiry of its
+// keys, in one round trip
+func (b *Broker) touchClient(ctx context.Context, clientID string) error {
+	return b.store.Transaction(ctx, nil, func(ctx context.Context, tx store.Tx) error {
+		session := fmt.Sprintf(clientSessionMapFmt, clientID)
+		tx.MapSet(session, clientSessionLastSeen, time.Now().Format(time.RFC3339))
+		tx.Expire(session, clientSessionTTL)
+
+		expireClientKeysTx(tx, clientID)
+		return nil
+	})
+}
+
+// isStaleClient determines whether or not a registered client has no session,
+// because its broker has stopped refreshing it
+func (b *Broker) isStaleClient(ctx context.Context, clientID string) (bool, error) {
+	n, err := b.store.Map(fmt.Sprintf(clientSessionMapFmt, clientID)).Len(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return n == 0, nil
+}
+
+// keepAlive periodically refreshes the session of a client until it
+// disconnects
+func (c *Client) keepAlive() {
+	ticker := time.NewTicker(clientSessionTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+
+		case <-ticker.C:
+			if err := c.broker.touchClient(c.ctx, c.clientID); err != nil {
+				log.WithFields(c.logFields).WithError(err).Warn("Failed to refresh the session")
+			}
+		}
+	}
+}
+
+// reapStaleClients removes clients that have been stale in two consecutive
+// checks, so clients registered during a check are not removed
+func (b *Broker) reapStaleClients(ctx context.Context, suspects map[string]struct{}) map[string]struct{} {
+	clientIDs, err := b.store.Set(clientSet).Members(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Failed to list clients")
+		return suspects
+	}
+
+	stale := make(map[string]struct{})
+
+	for _, clientID := range clientIDs {
+		isStale, err := b.isStaleClient(ctx, clientID)
+		if err != nil {
+			log.WithError(err).Warn("Failed to check a client")
+			continue
+		}
+
+		if !isStale {
+			continue
+		}
+
+		if _, ok := suspects[clientID]; !ok {
+			stale[clientID] = struct{}{}
+			continue
+		}
+
+		log.WithFields(log.Fields{"client_id": clientID}).Warn("Removing a stale client")
+
+		if err := b.RemoveClient(clientID); err != nil {
+			log.WithFields(log.Fields{"client_id": clientID}).WithError(err).Warn("Failed to remove a stale client")
+		}
+	}
+
+	return stale
+}
+
+// ReapStaleClients periodically removes clients registered by brokers that
+// have stopped refreshing their sessions
+func (b *Broker) ReapStaleClients(ctx context.Context) {
+	ticker := time.NewTicker(clientSessionTTL)
+	defer ticker.Stop()
+
+	suspects := make(map[string]struct{})
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			suspects = b.reapStaleClients(ctx, suspects)
+		}
+	}
+}
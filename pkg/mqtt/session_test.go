@@ -0,0 +1,142 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddClient_Stale(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	clientID := "abcd"
+	topic := "/topic"
+
+	assert.Nil(t, broker.AddClient(ctx, clientID))
+	assert.Nil(t, broker.Subscribe(ctx, clientID, topic))
+	assert.NotNil(t, broker.AddClient(ctx, clientID))
+
+	// the broker of the client has stopped refreshing its session
+	assert.Nil(t, s.Map(fmt.Sprintf(clientSessionMapFmt, clientID)).Destroy(ctx))
+
+	assert.Nil(t, broker.AddClient(ctx, clientID))
+
+	n, err := s.Set(subscribersSetKey(topic)).Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	assert.NotNil(t, broker.AddClient(ctx, clientID))
+}
+
+func TestReapStaleClients(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := NewBroker(ctx, s, NewAuthenticator(s))
+	assert.Nil(t, err)
+
+	assert.Nil(t, broker.AddClient(ctx, "abcd"))
+	assert.Nil(t, broker.AddClient(ctx, "efgh"))
+	assert.Nil(t, broker.Subscribe(ctx, "abcd", "/topic"))
+
+	assert.Nil(t, s.Map(fmt.Sprintf(clientSessionMapFmt, "abcd")).Destroy(ctx))
+
+	// a stale client is removed only if it's still stale in the next check
+	suspects := broker.reapStaleClients(ctx, map[string]struct{}{})
+	assert.Equal(t, map[string]struct{}{"abcd": {}}, suspects)
+
+	clientIDs, err := s.Set(clientSet).Members(ctx)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"abcd", "efgh"}, clientIDs)
+
+	suspects = broker.reapStaleClients(ctx, suspects)
+	assert.Equal(t, 0, len(suspects))
+
+	clientIDs, err = s.Set(clientSet).Members(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"efgh"}, clientIDs)
+
+	n, err := s.Set(subscribersSetKey("/topic")).Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestStore_Expire(t *testing.T) {
+	s := store.NewMemoryStore()
+	ctx := context.Background()
+
+	assert.Nil(t, s.Set("/a").Add(ctx, "a"))
+	assert.Nil(t, s.Set("/a").Expire(ctx, time.Millisecond*10))
+
+	assert.Nil(t, s.Set("/b").Add(ctx, "b"))
+	assert.Nil(t, s.Set("/b").Expire(ctx, time.Millisecond*10))
+	assert.Nil(t, s.Set("/b").Expire(ctx, 0))
+
+	assert.Eventually(t, func() bool {
+		n, err := s.Set("/a").Len(ctx)
+		return err == nil && n == 0
+	}, time.Second*10, time.Millisecond*10)
+
+	n, err := s.Set("/b").Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestStore_ExpireField(t *testing.T) {
+	s := store.NewMemoryStore()
+	ctx := context.Background()
+
+	m := s.Map("/a")
+	assert.Nil(t, m.Set(ctx, "a", "1"))
+	assert.Nil(t, m.Set(ctx, "b", "2"))
+	assert.Nil(t, m.Set(ctx, "c", "3"))
+
+	assert.Nil(t, m.ExpireField(ctx, "a", time.Millisecond*10))
+	assert.Nil(t, m.ExpireField(ctx, "b", time.Millisecond*10))
+	assert.True(t, errors.Is(m.ExpireField(ctx, "d", time.Millisecond*10), store.ErrNoKey))
+
+	// setting a field removes its TTL
+	assert.Nil(t, m.Set(ctx, "b", "4"))
+
+	time.Sleep(time.Millisecond * 20)
+
+	_, err := m.Get(ctx, "a")
+	assert.True(t, errors.Is(err, store.ErrNoKey))
+
+	v, err := m.Get(ctx, "b")
+	assert.Nil(t, err)
+	assert.Equal(t, "4", v)
+
+	n, err := m.Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+}
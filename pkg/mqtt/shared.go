@@ -0,0 +1,169 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SharedSubscriptionStrategy determines how messages are distributed between
+// members of a shared subscription group
+type SharedSubscriptionStrategy string
+
+const (
+	// RoundRobin delivers each message to the next member of the group
+	RoundRobin SharedSubscriptionStrategy = "round_robin"
+
+	// LeastInflight delivers each message to the member of the group with the
+	// smallest number of queued messages
+	LeastInflight SharedSubscriptionStrategy = "least_inflight"
+)
+
+const (
+	sharedSubscriptionPrefix = "$share/"
+
+	topicGroupsSetFmt  = "/topic/%s/groups"
+	groupMembersSetFmt = "/topic/%s/group/%s/members"
+	groupStateMapFmt   = "/topic/%s/group/%s"
+	groupNextMember    = "next"
+)
+
+var errEmptyGroup = errors.New("group has no members")
+
+func getSharedSubscriptionStrategy() SharedSubscriptionStrategy {
+	switch strategy := SharedSubscriptionStrategy(os.Getenv("SHARED_SUBSCRIPTION_STRATEGY")); strategy {
+	case RoundRobin, LeastInflight:
+		return strategy
+
+	case "":
+
+	default:
+		log.WithFields(log.Fields{"strategy": strategy}).Warn("Unknown shared subscription strategy")
+	}
+
+	return RoundRobin
+}
+
+// parseSharedSubscription splits a $share/<group>/<filter> topic filter
+func parseSharedSubscription(topic string) (string, string, bool) {
+	if !strings.HasPrefix(topic, sharedSubscriptionPrefix) {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(topic[len(sharedSubscriptionPrefix):], "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(parts[0], "+#") {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// subscribersSetKey returns the key of the set of clients subscribed to a topic
+// filter, which may be a shared subscription
+func subscribersSetKey(topic string) string {
+	if group, filter, ok := parseSharedSubscription(topic); ok {
+		return fmt.Sprintf(groupMembersSetFmt, filter, group)
+	}
+
+	return fmt.Sprintf(topicSubscribersSetFmt, topic)
+}
+
+func (b *Broker) pickGroupMember(ctx context.Context, filter, group string) (string, error) {
+	members, err := b.store.Set(fmt.Sprintf(groupMembersSetFmt, filter, group)).Members(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if len(members) == 0 {
+		return "", errEmptyGroup
+	}
+
+	sort.Strings(members)
+
+	if b.sharedSubscriptionStrategy == LeastInflight {
+		var member string
+		var min int64
+
+		for _, clientID := range members {
+			messages, _, err := b.GetClientUsage(ctx, clientID)
+			if err != nil {
+				continue
+			}
+
+			if member == "" || messages < min {
+				member = clientID
+				min = messages
+			}
+		}
+
+		if member != "" {
+			return member, nil
+		}
+	}
+
+	n, err := b.store.Map(fmt.Sprintf(groupStateMapFmt, filter, group)).Increment(ctx, groupNextMember, 1)
+	if err != nil {
+		return "", err
+	}
+
+	return members[(n-1)%int64(len(members))], nil
+}
+
+// queueMessageForGroup pushes a published message into the message queue of
+// one member of a shared subscription group
+func (b *Broker) queueMessageForGroup(ctx context.Context, filter, group string, queuedMessage *QueuedMessage) error {
+	clientID, err := b.pickGroupMember(ctx, filter, group)
+	if err != nil {
+		return err
+	}
+
+	queuedMessageForGroup := *queuedMessage
+	queuedMessageForGroup.Shared = sharedSubscriptionPrefix + group + "/" + filter
+
+	return b.QueueMessageForSubscriber(ctx, clientID, &queuedMessageForGroup)
+}
+
+// queueMessageForSharedSubscription pushes a published message into the
+// message queue of one member of a shared subscription group, identified by
+// its shared subscription topic filter
+func (b *Broker) queueMessageForSharedSubscription(ctx context.Context, shared string, queuedMessage *QueuedMessage) error {
+	group, filter, ok := parseSharedSubscription(shared)
+	if !ok {
+		return fmt.Errorf("invalid shared subscription: %s", shared)
+	}
+
+	return b.queueMessageForGroup(ctx, filter, group, queuedMessage)
+}
+
+// redistributeMessage pushes an unacked message, delivered to a member of a
+// shared subscription group, into the message queue of another member
+func (b *Broker) redistributeMessage(ctx context.Context, queuedMessage *QueuedMessage) error {
+	redistributedMessage := *queuedMessage
+	redistributedMessage.Attempts = 0
+	redistributedMessage.Duplicate = false
+
+	log.WithFields(queuedMessage.LogFields()).WithFields(log.Fields{"group": queuedMessage.Shared}).Info("Redistributing a message")
+
+	return b.queueMessageForSharedSubscription(ctx, queuedMessage.Shared, &redistributedMessage)
+}
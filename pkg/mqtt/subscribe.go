@@ -19,6 +19,8 @@ package mqtt
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -30,7 +32,31 @@ type SubscribeFixedHeader struct {
 
 func (c *Client) authenticateSubscribe(topic string, qos QoS) error {
 	log.WithFields(c.logFields).Info("Authenticating subscribe")
-	return c.user.ACL.AuthenticateSubscribe(topic, qos)
+
+	original := topic
+
+	if strings.HasPrefix(topic, sharedSubscriptionPrefix) {
+		_, filter, ok := parseSharedSubscription(topic)
+		if !ok {
+			return fmt.Errorf("invalid shared subscription: %s", topic)
+		}
+
+		topic = filter
+	}
+
+	if err := validateTopicFilter(topic); err != nil {
+		return err
+	}
+
+	err := c.currentUser().ACL.AuthenticateSubscribe(topic, qos, c.clientID, c.username)
+	c.audit(AuditSubscribe, original, err)
+	return err
+}
+
+// authenticateDelivery determines whether or not a client is allowed to receive
+// a message published to a topic that matches a filter it is subscribed to
+func (c *Client) authenticateDelivery(queuedMessage *QueuedMessage) error {
+	return c.currentUser().ACL.AuthenticateSubscribe(queuedMessage.Topic, QoS0, c.clientID, c.username)
 }
 
 func (c *Client) handleSubscribe(messageID uint16, topic string, qos QoS) error {
@@ -0,0 +1,232 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Version is the broker version, published through $SYS/broker/version
+var Version = "dev"
+
+const (
+	sysMap               = "/sys"
+	sysPublishersSet     = "/sys/publishers"
+	sysReplicasMap       = "/sys/replicas"
+	sysSubscriptions     = "subscriptions"
+	sysTopicPrefix       = "$SYS/broker/"
+	defaultStatsInterval = time.Second * 10
+)
+
+// sysCounters maps $SYS topics to counters aggregated across all replicas
+var sysCounters = map[string]string{
+	"messages/received":   metricMessagesReceived,
+	"messages/sent":       metricMessagesSent,
+	"messages/expired":    metricMessagesExpired,
+	"messages/dropped":    metricMessagesDropped,
+	"messages/rejected":   metricMessagesRejected,
+	"bytes/received":      metricBytesReceived,
+	"bytes/sent":          metricBytesSent,
+	"subscriptions/count": sysSubscriptions,
+}
+
+// StatsInterval returns the interval between updates of $SYS topics, set
+// through SYS_INTERVAL (in seconds); zero disables $SYS topics
+func StatsInterval() time.Duration {
+	s := os.Getenv("SYS_INTERVAL")
+	if s == "" {
+		return defaultStatsInterval
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		log.WithError(err).Warn("Invalid SYS_INTERVAL")
+		return defaultStatsInterval
+	}
+
+	return time.Duration(n) * time.Second
+}
+
+func (b *Broker) countSubscriptions(ctx context.Context, delta int64) {
+	if _, err := b.store.Map(sysMap).Increment(ctx, sysSubscriptions, delta); err != nil {
+		log.WithError(err).Warn("Failed to count subscriptions")
+	}
+}
+
+// flushMetrics adds the counters of the broker to the counters shared by all
+// replicas
+func (b *Broker) flushMetrics(ctx context.Context) error {
+	b.flushedMetricsLock.Lock()
+	defer b.flushedMetricsLock.Unlock()
+
+	var err error
+	b.metrics.Do(func(kv expvar.KeyValue) {
+		counter, ok := kv.Value.(*expvar.Int)
+		if !ok || err != nil {
+			return
+		}
+
+		value := counter.Value()
+		delta := value - b.flushedMetrics[kv.Key]
+		if delta == 0 {
+			return
+		}
+
+		if _, err = b.store.Map(sysMap).Increment(ctx, kv.Key, delta); err == nil {
+			b.flushedMetrics[kv.Key] = value
+		}
+	})
+
+	return err
+}
+
+// GetStats returns broker statistics, aggregated across all replicas and keyed
+// by $SYS topic
+func (b *Broker) GetStats(ctx context.Context) (map[string]string, error) {
+	counters := make(map[string]string)
+	if err := b.store.Map(sysMap).Scan(ctx, func(ctx context.Context, k, v string) {
+		counters[k] = v
+	}); err != nil {
+		return nil, err
+	}
+
+	startTime, err := b.replicasStartTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := map[string]string{
+		"version": Version,
+		"uptime":  fmt.Sprintf("%d seconds", int64(time.Since(startTime).Seconds())),
+	}
+
+	for topic, counter := range sysCounters {
+		if v, ok := counters[counter]; ok {
+			stats[topic] = v
+		} else {
+			stats[topic] = "0"
+		}
+	}
+
+	clients, err := b.store.Set(clientSet).Len(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats["clients/connected"] = strconv.FormatInt(clients, 10)
+
+	queued, err := b.store.Queue(messageQueue).Len(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats["messages/queued"] = strconv.FormatInt(queued, 10)
+
+	deadLetters, err := b.store.Map(deadLettersMap).Len(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats["messages/deadletters"] = strconv.FormatInt(deadLetters, 10)
+
+	return stats, nil
+}
+
+// registerReplica records the start time of the broker, until it misses a few
+// intervals
+func (b *Broker) registerReplica(ctx context.Context, interval time.Duration) error {
+	m := b.store.Map(sysReplicasMap)
+	if err := m.Set(ctx, b.id, strconv.FormatInt(b.startTime.UnixNano(), 10)); err != nil {
+		return err
+	}
+
+	expireField(ctx, m, b.id, interval*3)
+	return nil
+}
+
+// replicasStartTime returns the start time of the oldest running replica, so
+// the uptime doesn't depend on the replica that publishes it
+func (b *Broker) replicasStartTime(ctx context.Context) (time.Time, error) {
+	startTime := b.startTime
+
+	if err := b.store.Map(sysReplicasMap).Scan(ctx, func(ctx context.Context, k, v string) {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.WithFields(log.Fields{"replica": k}).WithError(err).Warn("Invalid replica start time")
+			return
+		}
+
+		if t := time.Unix(0, n); t.Before(startTime) {
+			startTime = t
+		}
+	}); err != nil {
+		return time.Time{}, err
+	}
+
+	return startTime, nil
+}
+
+func (b *Broker) publishStats(ctx context.Context, now time.Time, interval time.Duration) {
+	if err := b.flushMetrics(ctx); err != nil {
+		log.WithError(err).Warn("Failed to flush metrics")
+	}
+
+	if err := b.registerReplica(ctx, interval); err != nil {
+		log.WithError(err).Warn("Failed to register the broker")
+	}
+
+	// only one replica publishes the statistics in each interval
+	slot := now.Truncate(interval)
+	if err := b.store.Set(sysPublishersSet).Add(ctx, strconv.FormatInt(slot.Unix(), 10)); err != nil {
+		return
+	}
+	b.store.Set(sysPublishersSet).Remove(ctx, strconv.FormatInt(slot.Add(-interval).Unix(), 10))
+
+	stats, err := b.GetStats(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Failed to collect statistics")
+		return
+	}
+
+	for topic, value := range stats {
+		b.QueueMessage(sysTopicPrefix+topic, value, 0, QoS0, interval)
+	}
+}
+
+// PublishStats periodically publishes broker statistics to $SYS topics
+func (b *Broker) PublishStats(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case now := <-ticker.C:
+			b.publishStats(ctx, now, interval)
+		}
+	}
+}
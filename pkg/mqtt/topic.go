@@ -0,0 +1,91 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	singleLevelWildcard = "+"
+	multiLevelWildcard  = "#"
+	reservedTopicPrefix = "$"
+)
+
+// isReservedTopic determines whether or not a topic is reserved for use by the
+// broker, like $SYS topics
+func isReservedTopic(topic string) bool {
+	return strings.HasPrefix(topic, reservedTopicPrefix)
+}
+
+// isWildcardFilter determines whether or not a topic filter contains wildcards
+func isWildcardFilter(filter string) bool {
+	return strings.ContainsAny(filter, singleLevelWildcard+multiLevelWildcard)
+}
+
+// validateTopicFilter checks that wildcards in a topic filter occupy entire
+// levels and the multi-level wildcard is the last level
+func validateTopicFilter(filter string) error {
+	levels := strings.Split(filter, "/")
+
+	for i, level := range levels {
+		if level == multiLevelWildcard {
+			if i != len(levels)-1 {
+				return errors.New("multi-level wildcard must be the last level")
+			}
+			continue
+		}
+
+		if level != singleLevelWildcard && isWildcardFilter(level) {
+			return errors.New("wildcard must occupy an entire level")
+		}
+	}
+
+	return nil
+}
+
+// matchTopic determines whether or not a topic matches a topic filter; topics
+// that start with $ are not matched by filters that start with a wildcard
+func matchTopic(filter, topic string) bool {
+	if filter == topic {
+		return true
+	}
+
+	if isReservedTopic(topic) && (strings.HasPrefix(filter, singleLevelWildcard) || strings.HasPrefix(filter, multiLevelWildcard)) {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == multiLevelWildcard {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level != singleLevelWildcard && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,54 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTopic(t *testing.T) {
+	assert.True(t, matchTopic("/a/b", "/a/b"))
+	assert.False(t, matchTopic("/a/b", "/a/c"))
+
+	assert.True(t, matchTopic("/a/+", "/a/b"))
+	assert.False(t, matchTopic("/a/+", "/a/b/c"))
+	assert.True(t, matchTopic("/+/b", "/a/b"))
+	assert.True(t, matchTopic("+/+", "/a"))
+
+	assert.True(t, matchTopic("/a/#", "/a/b/c"))
+	assert.True(t, matchTopic("/a/#", "/a"))
+	assert.True(t, matchTopic("#", "/a/b"))
+	assert.False(t, matchTopic("/a/#", "/b/c"))
+
+	assert.False(t, matchTopic("#", "$SYS/broker/uptime"))
+	assert.False(t, matchTopic("+/broker/uptime", "$SYS/broker/uptime"))
+	assert.True(t, matchTopic("$SYS/#", "$SYS/broker/uptime"))
+	assert.True(t, matchTopic("$SYS/broker/+", "$SYS/broker/uptime"))
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	assert.Nil(t, validateTopicFilter("/a/b"))
+	assert.Nil(t, validateTopicFilter("/a/+/c"))
+	assert.Nil(t, validateTopicFilter("/a/#"))
+	assert.Nil(t, validateTopicFilter("#"))
+
+	assert.NotNil(t, validateTopicFilter("/a/#/c"))
+	assert.NotNil(t, validateTopicFilter("/a/b#"))
+	assert.NotNil(t, validateTopicFilter("/a/b+/c"))
+}
@@ -0,0 +1,225 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/env"
+	"github.com/dimkr/yodi/pkg/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWebhookTimeout    = time.Second * 5
+	defaultWebhookRetries    = 2
+	defaultWebhookRetryDelay = time.Millisecond * 200
+
+	maxWebhookResponseSize = 1 << 20
+)
+
+// WebhookConfig configures a webhook authenticator
+type WebhookConfig struct {
+	// URL receives a POST request for each authentication attempt
+	URL string
+
+	// Timeout limits the duration of each request
+	Timeout time.Duration
+
+	// Retries is the number of times a request is retried after a network
+	// error or a server error
+	Retries int
+
+	// RetryDelay is the delay before the first retry; it doubles after each
+	// retry
+	RetryDelay time.Duration
+}
+
+// WebhookRequest is the body of a request sent to an authentication webhook
+type WebhookRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	ClientID   string `json:"client_id,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+type webhookAuthenticator struct {
+	store  store.Store
+	config WebhookConfig
+	client *http.Client
+}
+
+var errWebhookUnavailable = fmt.Errorf("%w: webhook", ErrAuthUnavailable)
+
+func (a *webhookAuthenticator) post(ctx context.Context, body []byte) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errWebhookUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		var user User
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxWebhookResponseSize)).Decode(&user); err != nil {
+			return nil, fmt.Errorf("%w: %v", errWebhookUnavailable, err)
+		}
+
+		if err := user.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid authentication webhook response: %w", err)
+		}
+
+		user.Password = ""
+		return &user, nil
+
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, ErrBadCredentials
+
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, fmt.Errorf("%w: %s", errWebhookUnavailable, resp.Status)
+
+	default:
+		return nil, fmt.Errorf("Unexpected authentication webhook response: %s", resp.Status)
+	}
+}
+
+func (a *webhookAuthenticator) authenticate(ctx context.Context, body []byte) (*User, error) {
+	delay := a.config.RetryDelay
+
+	for i := 0; ; i++ {
+		user, err := a.post(ctx, body)
+		if err == nil || !errors.Is(err, errWebhookUnavailable) || i == a.config.Retries {
+			return user, err
+		}
+
+		log.WithError(err).Warn("Retrying an authentication request")
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+
+		case <-time.After(delay):
+			delay *= 2
+		}
+	}
+}
+
+// AuthenticateUser sends credentials to the webhook; responses are not cached
+// here, and clients are rejected while the webhook is unavailable, unless the
+// authenticator is wrapped by a caching one that reuses expired results
+func (a *webhookAuthenticator) AuthenticateUser(ctx context.Context, username, password string) (*User, error) {
+	info := ConnectInfoFromContext(ctx)
+
+	body, err := json.Marshal(&WebhookRequest{
+		Username:   username,
+		Password:   password,
+		ClientID:   info.ClientID,
+		RemoteAddr: info.RemoteAddr,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := a.authenticate(ctx, body)
+	if err != nil {
+		if errors.Is(err, errWebhookUnavailable) {
+			log.WithFields(log.Fields{"username": username}).WithError(err).Warn("Authentication webhook is unavailable")
+		}
+		return nil, err
+	}
+
+	return a.resolve(ctx, user)
+}
+
+// resolve resolves the roles of a user returned by the webhook; a connected
+// client keeps this response until it reconnects, because the webhook cannot
+// be asked again without the password, but its roles are resolved again when
+// they change
+func (a *webhookAuthenticator) resolve(ctx context.Context, user *User) (*User, error) {
+	resolved := *user
+	resolved.refresh = func(ctx context.Context) (*User, error) {
+		return ResolveRoles(ctx, a.store, &resolved)
+	}
+
+	return ResolveRoles(ctx, a.store, &resolved)
+}
+
+// NewWebhookAuthenticator returns a new authenticator that sends credentials to
+// a HTTP server, which responds with a User if they're valid, or with status
+// 401 or 403 if not
+func NewWebhookAuthenticator(store store.Store, config WebhookConfig) Authenticator {
+	if config.Timeout == 0 {
+		config.Timeout = defaultWebhookTimeout
+	}
+
+	if config.RetryDelay == 0 {
+		config.RetryDelay = defaultWebhookRetryDelay
+	}
+
+	return &webhookAuthenticator{
+		store:  store,
+		config: config,
+		client: &http.Client{},
+	}
+}
+
+// WebhookConfigFromEnv returns a webhook authenticator configuration specified
+// by the AUTH_WEBHOOK_URL, AUTH_WEBHOOK_TIMEOUT (in seconds) and
+// AUTH_WEBHOOK_RETRIES environment variables
+func WebhookConfigFromEnv() (*WebhookConfig, error) {
+	config := WebhookConfig{
+		URL:     os.Getenv("AUTH_WEBHOOK_URL"),
+		Retries: defaultWebhookRetries,
+	}
+
+	if config.URL == "" {
+		return nil, errors.New("No authentication webhook URL")
+	}
+
+	var err error
+	config.Timeout, err = env.Seconds("AUTH_WEBHOOK_TIMEOUT", defaultWebhookTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if s := os.Getenv("AUTH_WEBHOOK_RETRIES"); s != "" {
+		config.Retries, err = strconv.Atoi(s)
+		if err != nil || config.Retries < 0 {
+			return nil, fmt.Errorf("Invalid AUTH_WEBHOOK_RETRIES: %s", s)
+		}
+	}
+
+	return &config, nil
+}
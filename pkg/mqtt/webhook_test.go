@@ -0,0 +1,212 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookServer struct {
+	*httptest.Server
+	requests int32
+	status   int32
+}
+
+func newWebhookServer(t *testing.T) *webhookServer {
+	s := &webhookServer{status: http.StatusOK}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+
+		if status := int(atomic.LoadInt32(&s.status)); status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		var req WebhookRequest
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+
+		if req.Username != "user1" || req.Password != "password1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		assert.Equal(t, "abcd", req.ClientID)
+		assert.Equal(t, "127.0.0.1:1234", req.RemoteAddr)
+
+		json.NewEncoder(w).Encode(&User{
+			ACL:       ACL{"/%c/commands": {Subscribe: true, QoS: QoS1}},
+			ClientIDs: []string{req.ClientID},
+			Password:  "leaked",
+		})
+	}))
+
+	return s
+}
+
+func (s *webhookServer) setStatus(status int) {
+	atomic.StoreInt32(&s.status, int32(status))
+}
+
+func (s *webhookServer) Requests() int {
+	return int(atomic.LoadInt32(&s.requests))
+}
+
+func webhookContext(ctx context.Context) context.Context {
+	return WithConnectInfo(ctx, ConnectInfo{ClientID: "abcd", RemoteAddr: "127.0.0.1:1234"})
+}
+
+func TestWebhookAuthenticator(t *testing.T) {
+	server := newWebhookServer(t)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = webhookContext(ctx)
+
+	auth := NewWebhookAuthenticator(store.NewMemoryStore(), WebhookConfig{URL: server.URL})
+
+	user, err := auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+	assert.Equal(t, "", user.Password)
+	assert.Nil(t, user.AuthenticateClientID("abcd", "user1"))
+	assert.Nil(t, user.ACL.AuthenticateSubscribe("/abcd/commands", QoS1, "abcd", "user1"))
+
+	_, err = auth.AuthenticateUser(ctx, "user1", "password2")
+	assert.Equal(t, ErrBadCredentials, err)
+
+	server.setStatus(http.StatusBadRequest)
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.NotNil(t, err)
+	assert.NotEqual(t, ErrBadCredentials, err)
+}
+
+func TestWebhookAuthenticator_Retries(t *testing.T) {
+	server := newWebhookServer(t)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = webhookContext(ctx)
+
+	auth := NewWebhookAuthenticator(store.NewMemoryStore(), WebhookConfig{URL: server.URL, Retries: 2, RetryDelay: time.Millisecond})
+
+	server.setStatus(http.StatusServiceUnavailable)
+	_, err := auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, server.Requests())
+
+	// wrong credentials are not retried
+	server.setStatus(http.StatusUnauthorized)
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Equal(t, ErrBadCredentials, err)
+	assert.Equal(t, 4, server.Requests())
+}
+
+func TestWebhookAuthenticator_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	auth := NewWebhookAuthenticator(store.NewMemoryStore(), WebhookConfig{URL: server.URL, Timeout: time.Millisecond * 50})
+
+	start := time.Now()
+	_, err := auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestWebhookAuthenticator_Unavailable(t *testing.T) {
+	server := newWebhookServer(t)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = webhookContext(ctx)
+
+	auth := NewWebhookAuthenticator(store.NewMemoryStore(), WebhookConfig{URL: server.URL, RetryDelay: time.Millisecond})
+
+	_, err := auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+
+	// clients are rejected while the webhook is unavailable
+	server.setStatus(http.StatusInternalServerError)
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.True(t, errors.Is(err, ErrAuthUnavailable))
+	assert.False(t, errors.Is(err, ErrBadCredentials))
+
+	server.Close()
+	_, err = auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.True(t, errors.Is(err, ErrAuthUnavailable))
+}
+
+func TestWebhookAuthenticator_InvalidUser(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&User{ACL: ACL{"/#/commands": {Subscribe: true}}})
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	auth := NewWebhookAuthenticator(store.NewMemoryStore(), WebhookConfig{URL: server.URL})
+
+	_, err := auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrBadCredentials))
+	assert.False(t, errors.Is(err, ErrAuthUnavailable))
+}
+
+func TestWebhookAuthenticator_UnavailableLockout(t *testing.T) {
+	server := newWebhookServer(t)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = webhookContext(ctx)
+
+	s := store.NewMemoryStore()
+	auth := NewLockoutAuthenticator(s, NewWebhookAuthenticator(s, WebhookConfig{URL: server.URL, RetryDelay: time.Millisecond}))
+
+	// an outage is not counted as failed attempts
+	server.setStatus(http.StatusInternalServerError)
+	for i := 0; i < userLockoutThreshold*2; i++ {
+		_, err := auth.AuthenticateUser(ctx, "user1", "password1")
+		assert.True(t, errors.Is(err, ErrAuthUnavailable))
+	}
+
+	server.setStatus(http.StatusOK)
+	_, err := auth.AuthenticateUser(ctx, "user1", "password1")
+	assert.Nil(t, err)
+}
@@ -0,0 +1,53 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import "context"
+
+// Channel is a publish-subscribe channel; messages are delivered only to
+// subscribers that subscribed before they were published
+type Channel interface {
+	Publish(context.Context, string) error
+	Subscribe(context.Context) (<-chan string, error)
+}
+
+// ResyncMessage is received by a subscriber instead of messages it has
+// missed, because it didn't receive them fast enough
+const ResyncMessage = ""
+
+const bufferSize = 64
+
+// deliver passes a message to a subscriber; if the subscriber is too slow, all
+// messages it has not received yet are replaced with ResyncMessage, so it never
+// misses a message silently; there must be only one sender
+func deliver(subscriber chan string, msg string) {
+	select {
+	case subscriber <- msg:
+		return
+
+	default:
+	}
+
+	for len(subscriber) > 0 {
+		select {
+		case <-subscriber:
+		default:
+		}
+	}
+
+	subscriber <- ResyncMessage
+}
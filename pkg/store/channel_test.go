@@ -0,0 +1,63 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannel_Resync(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c := s.Channel(testKey(t, "channel"))
+
+		messages, err := c.Subscribe(ctx)
+		assert.Nil(t, err)
+
+		// the subscriber doesn't receive messages while they're published
+		for i := 0; i < bufferSize*2; i++ {
+			assert.Nil(t, c.Publish(ctx, fmt.Sprintf("%d", i)))
+		}
+
+		received := make([]string, 0)
+		for {
+			select {
+			case msg := <-messages:
+				received = append(received, msg)
+				continue
+
+			case <-time.After(time.Second):
+			}
+			break
+		}
+
+		// missed messages are replaced with one ResyncMessage, followed by
+		// messages published after it
+		if assert.NotEqual(t, 0, len(received)) {
+			assert.True(t, len(received) <= bufferSize)
+			assert.Contains(t, received, ResyncMessage)
+			assert.Equal(t, fmt.Sprintf("%d", bufferSize*2-1), received[len(received)-1])
+		}
+	})
+}
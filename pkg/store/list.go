@@ -0,0 +1,40 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// List is a list of values, newest first, which may be capped
+type List interface {
+	// Push adds a value to the beginning of the list, then removes the oldest
+	// values if it's longer than max, unless max is 0
+	Push(context.Context, string, int64) error
+
+	// Range returns the values between two indexes, inclusive; negative
+	// indexes are offsets from the end of the list
+	Range(context.Context, int64, int64) ([]string, error)
+
+	Len(context.Context) (int64, error)
+
+	// Expire removes the list after a TTL, or never if the TTL is 0
+	Expire(context.Context, time.Duration) error
+
+	Destroy(context.Context) error
+}
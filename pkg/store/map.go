@@ -19,16 +19,32 @@ package store
 import (
 	"context"
 	"errors"
+	"time"
 )
 
 // ErrNoKey is returned when a key does not exist
 var ErrNoKey = errors.New("no such key")
 
+// ErrNotSupported is returned when an operation is not supported by the
+// backend
+var ErrNotSupported = errors.New("not supported")
+
 // Map is an associative array
 type Map interface {
 	Get(context.Context, string) (string, error)
 	Set(context.Context, string, string) error
 	Remove(context.Context, string) error
+	Increment(context.Context, string, int64) (int64, error)
 	Scan(context.Context, func(context.Context, string, string)) error
+	Len(context.Context) (int64, error)
+
+	// Expire removes the map after a TTL, or never if the TTL is 0
+	Expire(context.Context, time.Duration) error
+
+	// ExpireField removes a field after a TTL, or never if the TTL is 0;
+	// setting the field removes its TTL, and ErrNotSupported is returned if
+	// the backend doesn't support expiry of fields
+	ExpireField(context.Context, string, time.Duration) error
+
 	Destroy(context.Context) error
 }
@@ -0,0 +1,62 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"sync"
+)
+
+type memoryChannel struct {
+	lock        sync.Mutex
+	subscribers map[chan string]struct{}
+}
+
+func newMemoryChannel() *memoryChannel {
+	return &memoryChannel{subscribers: make(map[chan string]struct{})}
+}
+
+func (c *memoryChannel) Publish(ctx context.Context, msg string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for subscriber := range c.subscribers {
+		deliver(subscriber, msg)
+	}
+
+	return nil
+}
+
+func (c *memoryChannel) Subscribe(ctx context.Context) (<-chan string, error) {
+	subscriber := make(chan string, bufferSize)
+
+	c.lock.Lock()
+	c.subscribers[subscriber] = struct{}{}
+	c.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		c.lock.Lock()
+		delete(c.subscribers, subscriber)
+		c.lock.Unlock()
+
+		close(subscriber)
+	}()
+
+	return subscriber, nil
+}
@@ -18,19 +18,30 @@ package store
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type memoryKey struct {
-	lock  sync.Mutex
-	store *memoryStore
-	key   string
+	// version is incremented on every modification, so transactions can
+	// detect modification of the keys they watch
+	version uint64
+	lock    sync.Mutex
+	store   *memoryStore
+	key     string
+	timer   *time.Timer
 }
 
 func (k *memoryKey) Destroy(ctx context.Context) error {
 	return k.store.Destroy(k.key)
 }
 
+func (k *memoryKey) base() *memoryKey {
+	return k
+}
+
 func (k *memoryKey) Lock() {
 	k.lock.Lock()
 }
@@ -38,3 +49,41 @@ func (k *memoryKey) Lock() {
 func (k *memoryKey) Unlock() {
 	k.lock.Unlock()
 }
+
+// modified marks the key as modified; it must be called while the key is
+// locked
+func (k *memoryKey) modified() {
+	atomic.AddUint64(&k.version, 1)
+}
+
+func (k *memoryKey) getVersion() uint64 {
+	return atomic.LoadUint64(&k.version)
+}
+
+// expire sets the TTL of a locked key
+func (k *memoryKey) expire(ttl time.Duration) {
+	k.modified()
+
+	if k.timer != nil {
+		k.timer.Stop()
+		k.timer = nil
+	}
+
+	if ttl > 0 {
+		k.timer = time.AfterFunc(ttl, func() {
+			k.store.destroyKey(k)
+		})
+	}
+}
+
+func (k *memoryKey) Expire(ctx context.Context, ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New("negative TTL")
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	k.expire(ttl)
+	return nil
+}
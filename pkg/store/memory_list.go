@@ -0,0 +1,76 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+)
+
+type memoryList struct {
+	*memoryKey
+	items []string
+}
+
+func newMemoryList(key *memoryKey) *memoryList {
+	return &memoryList{memoryKey: key}
+}
+
+func (l *memoryList) Push(ctx context.Context, val string, max int64) error {
+	l.Lock()
+	defer l.Unlock()
+
+	l.items = append([]string{val}, l.items...)
+	if max > 0 && int64(len(l.items)) > max {
+		l.items = l.items[:max]
+	}
+	l.modified()
+
+	return nil
+}
+
+func (l *memoryList) Range(ctx context.Context, start, stop int64) ([]string, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	n := int64(len(l.items))
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+
+	values := make([]string, 0)
+	if start > stop {
+		return values, nil
+	}
+
+	return append(values, l.items[start:stop+1]...), nil
+}
+
+func (l *memoryList) Len(ctx context.Context) (int64, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	return int64(len(l.items)), nil
+}
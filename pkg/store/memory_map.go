@@ -17,23 +17,81 @@
 package store
 
 import (
+	"container/heap"
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"time"
 )
 
 type memoryMap struct {
 	*memoryKey
-	items map[string]string
+	items    map[string]string
+	expiry   map[string]time.Time
+	expiring fieldExpiryHeap
+}
+
+// fieldExpiry is the expiry time of a map field
+type fieldExpiry struct {
+	field string
+	time  time.Time
+}
+
+// fieldExpiryHeap orders fields with a TTL by expiry time; a field appears
+// again whenever its TTL is changed, and only the entry that matches its
+// current expiry time is valid
+type fieldExpiryHeap []fieldExpiry
+
+func (h fieldExpiryHeap) Len() int {
+	return len(h)
+}
+
+func (h fieldExpiryHeap) Less(i, j int) bool {
+	return h[i].time.Before(h[j].time)
+}
+
+func (h fieldExpiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *fieldExpiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(fieldExpiry))
+}
+
+func (h *fieldExpiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
 }
 
 func newMemoryMap(key *memoryKey) *memoryMap {
-	return &memoryMap{memoryKey: key, items: make(map[string]string)}
+	return &memoryMap{memoryKey: key, items: make(map[string]string), expiry: make(map[string]time.Time)}
+}
+
+// purge removes expired fields, without visiting fields that have not expired
+func (m *memoryMap) purge() {
+	now := time.Now()
+
+	for len(m.expiring) > 0 && !now.Before(m.expiring[0].time) {
+		e := heap.Pop(&m.expiring).(fieldExpiry)
+
+		if expiry, ok := m.expiry[e.field]; ok && expiry.Equal(e.time) {
+			delete(m.items, e.field)
+			delete(m.expiry, e.field)
+			m.modified()
+		}
+	}
 }
 
 func (m *memoryMap) Get(ctx context.Context, k string) (string, error) {
 	m.Lock()
 	defer m.Unlock()
 
+	m.purge()
+
 	v, ok := m.items[k]
 	if !ok {
 		return "", fmt.Errorf("%s: %w", k, ErrNoKey)
@@ -47,6 +105,8 @@ func (m *memoryMap) Set(ctx context.Context, k, v string) error {
 	defer m.Unlock()
 
 	m.items[k] = v
+	delete(m.expiry, k)
+	m.modified()
 
 	return nil
 }
@@ -55,22 +115,85 @@ func (m *memoryMap) Remove(ctx context.Context, k string) error {
 	m.Lock()
 	defer m.Unlock()
 
+	m.purge()
+
 	if _, ok := m.items[k]; !ok {
 		return fmt.Errorf("%s: %w", k, ErrNoKey)
 	}
 
 	delete(m.items, k)
+	delete(m.expiry, k)
+	m.modified()
 
 	return nil
 }
 
+func (m *memoryMap) Increment(ctx context.Context, k string, delta int64) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.purge()
+
+	var n int64
+	if v, ok := m.items[k]; ok {
+		var err error
+		n, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n += delta
+	m.items[k] = strconv.FormatInt(n, 10)
+	m.modified()
+
+	return n, nil
+}
+
 func (m *memoryMap) Scan(ctx context.Context, f func(context.Context, string, string)) error {
 	m.Lock()
 	defer m.Unlock()
 
+	m.purge()
+
 	for k, v := range m.items {
 		f(ctx, k, v)
 	}
 
 	return nil
 }
+
+func (m *memoryMap) Len(ctx context.Context) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.purge()
+
+	return int64(len(m.items)), nil
+}
+
+func (m *memoryMap) ExpireField(ctx context.Context, k string, ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New("negative TTL")
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.purge()
+
+	if _, ok := m.items[k]; !ok {
+		return fmt.Errorf("%s: %w", k, ErrNoKey)
+	}
+
+	if ttl == 0 {
+		delete(m.expiry, k)
+	} else {
+		expiry := time.Now().Add(ttl)
+		m.expiry[k] = expiry
+		heap.Push(&m.expiring, fieldExpiry{field: k, time: expiry})
+	}
+	m.modified()
+
+	return nil
+}
@@ -0,0 +1,64 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryMap_ExpireField(t *testing.T) {
+	ctx := context.Background()
+
+	m := NewMemoryStore().Map("/map")
+
+	for _, k := range []string{"a", "b", "c"} {
+		assert.Nil(t, m.Set(ctx, k, k))
+	}
+
+	assert.Nil(t, m.ExpireField(ctx, "a", 50*time.Millisecond))
+	assert.Nil(t, m.ExpireField(ctx, "b", 50*time.Millisecond))
+
+	// b gets a longer TTL, and c has no TTL
+	assert.Nil(t, m.ExpireField(ctx, "b", time.Hour))
+	assert.True(t, errors.Is(m.ExpireField(ctx, "d", time.Hour), ErrNoKey))
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, err := m.Get(ctx, "a")
+	assert.True(t, errors.Is(err, ErrNoKey))
+
+	for _, k := range []string{"b", "c"} {
+		v, err := m.Get(ctx, k)
+		assert.Nil(t, err)
+		assert.Equal(t, k, v)
+	}
+
+	// a field set again after its TTL is set doesn't expire
+	assert.Nil(t, m.ExpireField(ctx, "c", 50*time.Millisecond))
+	assert.Nil(t, m.Set(ctx, "c", "c"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	n, err := m.Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+}
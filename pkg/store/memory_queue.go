@@ -18,30 +18,126 @@ package store
 
 import (
 	"context"
+	"fmt"
 )
 
+// memoryQueue is an unbounded queue; Pop waits on a channel, which receives a
+// wakeup whenever a value is pushed
 type memoryQueue struct {
 	*memoryKey
-	c chan string
+	items      []string
+	wake       chan struct{}
+	processing map[string][]string
 }
 
-const bufferSize = 64
-
 func newMemoryQueue(key *memoryKey) *memoryQueue {
-	return &memoryQueue{c: make(chan string, bufferSize), memoryKey: key}
+	return &memoryQueue{memoryKey: key, wake: make(chan struct{}, 1), processing: make(map[string][]string)}
+}
+
+func (q *memoryQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// push appends a value to a locked queue
+func (q *memoryQueue) push(val string) {
+	q.items = append(q.items, val)
+	q.modified()
+	q.signal()
 }
 
 func (q *memoryQueue) Push(ctx context.Context, val string) error {
-	q.c <- val
+	q.Lock()
+	defer q.Unlock()
+
+	q.push(val)
 	return nil
 }
 
+// pop removes the first value of a locked queue, and adds it to the
+// processing list of a consumer if there is one; if more values are left, it
+// passes the wakeup to another waiting caller
+func (q *memoryQueue) pop(consumer string, reliable bool) (string, bool) {
+	if len(q.items) == 0 {
+		return "", false
+	}
+
+	val := q.items[0]
+	q.items = q.items[1:]
+	q.modified()
+
+	if reliable {
+		q.processing[consumer] = append(q.processing[consumer], val)
+	}
+
+	if len(q.items) > 0 {
+		q.signal()
+	}
+
+	return val, true
+}
+
+func (q *memoryQueue) wait(ctx context.Context, consumer string, reliable bool) (string, error) {
+	for {
+		q.Lock()
+		val, ok := q.pop(consumer, reliable)
+		q.Unlock()
+
+		if ok {
+			return val, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+
+		case <-q.wake:
+		}
+	}
+}
+
 func (q *memoryQueue) Pop(ctx context.Context) (string, error) {
-	select {
-	case <-ctx.Done():
-		return "", ctx.Err()
+	return q.wait(ctx, "", false)
+}
+
+func (q *memoryQueue) PopReliable(ctx context.Context, consumer string) (string, error) {
+	return q.wait(ctx, consumer, true)
+}
 
-	case s := <-q.c:
-		return s, nil
+func (q *memoryQueue) Ack(ctx context.Context, consumer, val string) error {
+	q.Lock()
+	defer q.Unlock()
+
+	processing := q.processing[consumer]
+	for i, s := range processing {
+		if s == val {
+			q.processing[consumer] = append(processing[:i], processing[i+1:]...)
+			return nil
+		}
 	}
+
+	return fmt.Errorf("value is not being processed: %w", ErrNoKey)
+}
+
+func (q *memoryQueue) Requeue(ctx context.Context, consumer string) (int64, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	processing := q.processing[consumer]
+	delete(q.processing, consumer)
+
+	for _, s := range processing {
+		q.push(s)
+	}
+
+	return int64(len(processing)), nil
+}
+
+func (q *memoryQueue) Len(ctx context.Context) (int64, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	return int64(len(q.items)), nil
 }
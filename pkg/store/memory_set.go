@@ -39,6 +39,7 @@ func (s *memorySet) Add(ctx context.Context, val string) error {
 	}
 
 	s.items[val] = struct{}{}
+	s.modified()
 	return nil
 }
 
@@ -51,6 +52,7 @@ func (s *memorySet) Remove(ctx context.Context, val string) error {
 	}
 
 	delete(s.items, val)
+	s.modified()
 
 	return nil
 }
@@ -78,3 +80,10 @@ func (s *memorySet) Members(ctx context.Context) ([]string, error) {
 
 	return members, nil
 }
+
+func (s *memorySet) Len(ctx context.Context) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return int64(len(s.items)), nil
+}
@@ -22,13 +22,14 @@ import (
 )
 
 type memoryStore struct {
-	lock  sync.Mutex
-	items map[string]interface{}
+	lock     sync.Mutex
+	items    map[string]interface{}
+	channels map[string]*memoryChannel
 }
 
 // NewMemoryStore creates a memory-backed store
 func NewMemoryStore() Store {
-	return &memoryStore{items: make(map[string]interface{})}
+	return &memoryStore{items: make(map[string]interface{}), channels: make(map[string]*memoryChannel)}
 }
 
 func (s *memoryStore) Lock() {
@@ -78,6 +79,19 @@ func (s *memoryStore) Map(key string) Map {
 	return m
 }
 
+func (s *memoryStore) List(key string) List {
+	s.Lock()
+	defer s.Unlock()
+
+	if l, ok := s.items[key]; ok {
+		return l.(*memoryList)
+	}
+
+	l := newMemoryList(&memoryKey{store: s, key: key})
+	s.items[key] = l
+	return l
+}
+
 func (s *memoryStore) Destroy(key string) error {
 	s.Lock()
 	defer s.Unlock()
@@ -90,4 +104,53 @@ func (s *memoryStore) Destroy(key string) error {
 	return nil
 }
 
+// memoryItem is a data structure stored in a memoryStore
+type memoryItem interface {
+	base() *memoryKey
+}
+
+func (s *memoryStore) item(key string) memoryItem {
+	s.Lock()
+	defer s.Unlock()
+
+	if item, ok := s.items[key]; ok {
+		return item.(memoryItem)
+	}
+
+	return nil
+}
+
+// destroyKey removes the data structure of a key, unless it has been replaced
+func (s *memoryStore) destroyKey(k *memoryKey) {
+	s.Lock()
+	defer s.Unlock()
+
+	if item, ok := s.items[k.key]; ok && item.(memoryItem).base() == k {
+		delete(s.items, k.key)
+	}
+}
+
+// destroyItem removes a data structure, unless it has been replaced
+func (s *memoryStore) destroyItem(key string, item memoryItem) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.items[key] == item {
+		delete(s.items, key)
+	}
+}
+
+func (s *memoryStore) Channel(name string) Channel {
+	s.Lock()
+	defer s.Unlock()
+
+	if c, ok := s.channels[name]; ok {
+		return c
+	}
+
+	c := newMemoryChannel()
+	s.channels[name] = c
+	return c
+}
+
 func (s *memoryStore) Close() {}
@@ -0,0 +1,238 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// memoryWatch is the state of a watched key when a transaction starts: its
+// data structure, or nil if it doesn't exist, and the data structure version
+type memoryWatch struct {
+	key     *memoryKey
+	version uint64
+}
+
+// memoryTx queues operations as functions, and the keys they modify
+type memoryTx struct {
+	store   *memoryStore
+	watched map[string]memoryWatch
+	keys    map[string]*memoryKey
+	ops     []func()
+}
+
+func (tx *memoryTx) SetAdd(key, val string) {
+	set := tx.store.Set(key).(*memorySet)
+	tx.keys[key] = set.memoryKey
+	tx.ops = append(tx.ops, func() {
+		set.items[val] = struct{}{}
+	})
+}
+
+func (tx *memoryTx) SetRemove(key, val string) {
+	set := tx.store.Set(key).(*memorySet)
+	tx.keys[key] = set.memoryKey
+	tx.ops = append(tx.ops, func() {
+		delete(set.items, val)
+	})
+}
+
+func (tx *memoryTx) QueuePush(key, val string) {
+	q := tx.store.Queue(key).(*memoryQueue)
+	tx.keys[key] = q.memoryKey
+	tx.ops = append(tx.ops, func() {
+		q.push(val)
+	})
+}
+
+func (tx *memoryTx) MapSet(key, k, v string) {
+	m := tx.store.Map(key).(*memoryMap)
+	tx.keys[key] = m.memoryKey
+	tx.ops = append(tx.ops, func() {
+		m.items[k] = v
+		delete(m.expiry, k)
+	})
+}
+
+func (tx *memoryTx) MapRemove(key, k string) {
+	m := tx.store.Map(key).(*memoryMap)
+	tx.keys[key] = m.memoryKey
+	tx.ops = append(tx.ops, func() {
+		delete(m.items, k)
+		delete(m.expiry, k)
+	})
+}
+
+// MapIncrement treats a value that is not an integer as 0
+func (tx *memoryTx) MapIncrement(key, k string, delta int64) {
+	m := tx.store.Map(key).(*memoryMap)
+	tx.keys[key] = m.memoryKey
+	tx.ops = append(tx.ops, func() {
+		m.purge()
+		n, _ := strconv.ParseInt(m.items[k], 10, 64)
+		m.items[k] = strconv.FormatInt(n+delta, 10)
+	})
+}
+
+func (tx *memoryTx) Expire(key string, ttl time.Duration) {
+	item := tx.store.item(key)
+	if item == nil {
+		return
+	}
+
+	k := item.base()
+	tx.keys[key] = k
+	tx.ops = append(tx.ops, func() {
+		k.expire(ttl)
+	})
+}
+
+func (tx *memoryTx) Destroy(key string) {
+	item := tx.store.item(key)
+	if item == nil {
+		return
+	}
+
+	tx.keys[key] = item.base()
+	tx.ops = append(tx.ops, func() {
+		tx.store.destroyItem(key, item)
+	})
+}
+
+func (s *memoryStore) watch(keys []string) map[string]memoryWatch {
+	watched := make(map[string]memoryWatch, len(keys))
+
+	for _, key := range keys {
+		var w memoryWatch
+		if item := s.item(key); item != nil {
+			w.key = item.base()
+			w.version = w.key.getVersion()
+		}
+
+		watched[key] = w
+	}
+
+	return watched
+}
+
+// valid determines whether or not the modified keys still exist and the
+// watched keys were not modified since the transaction started; all keys must
+// be locked
+func (tx *memoryTx) valid(locked map[string]*memoryKey) bool {
+	for name, key := range locked {
+		if item := tx.store.item(name); item == nil || item.base() != key {
+			return false
+		}
+	}
+
+	for name, w := range tx.watched {
+		key, ok := locked[name]
+		if !ok {
+			// the key was created after it was locked
+			if tx.store.item(name) != nil {
+				return false
+			}
+			continue
+		}
+
+		if w.key == nil {
+			// the key was created by this transaction or by others, but
+			// an empty data structure is like a missing key
+			if key.getVersion() != 0 {
+				return false
+			}
+		} else if key != w.key || key.getVersion() != w.version {
+			return false
+		}
+	}
+
+	return true
+}
+
+// commit applies all operations while all watched and modified keys are
+// locked, in a consistent order, unless the transaction conflicts with others
+func (tx *memoryTx) commit() bool {
+	if len(tx.ops) == 0 {
+		return true
+	}
+
+	locked := make(map[string]*memoryKey, len(tx.keys)+len(tx.watched))
+	for name, key := range tx.keys {
+		locked[name] = key
+	}
+
+	for name := range tx.watched {
+		if _, ok := locked[name]; ok {
+			continue
+		}
+
+		if item := tx.store.item(name); item != nil {
+			locked[name] = item.base()
+		}
+	}
+
+	names := make([]string, 0, len(locked))
+	for name := range locked {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		locked[name].Lock()
+	}
+
+	defer func() {
+		for _, name := range names {
+			locked[name].Unlock()
+		}
+	}()
+
+	if !tx.valid(locked) {
+		return false
+	}
+
+	for _, op := range tx.ops {
+		op()
+	}
+
+	for _, key := range tx.keys {
+		key.modified()
+	}
+
+	return true
+}
+
+// Transaction detects modification of the watched keys by comparing their
+// versions when the transaction starts and when it's committed, and retries if
+// they differ
+func (s *memoryStore) Transaction(ctx context.Context, watch []string, f func(context.Context, Tx) error) error {
+	for i := 0; i < maxTransactionAttempts; i++ {
+		tx := memoryTx{store: s, watched: s.watch(watch), keys: make(map[string]*memoryKey)}
+		if err := f(ctx, &tx); err != nil {
+			return err
+		}
+
+		if tx.commit() {
+			return nil
+		}
+	}
+
+	return ErrTransactionConflict
+}
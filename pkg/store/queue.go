@@ -16,11 +16,32 @@
 
 package store
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // Queue is queue that allows non-blocking push and blocking pop
 type Queue interface {
 	Push(context.Context, string) error
 	Pop(context.Context) (string, error)
+
+	// PopReliable pops a value and moves it to the processing list of a
+	// consumer, where it's kept until acknowledged
+	PopReliable(context.Context, string) (string, error)
+
+	// Ack removes a value from the processing list of a consumer
+	Ack(context.Context, string, string) error
+
+	// Requeue moves all values in the processing list of a consumer back
+	// to the queue, so they're popped again; it returns the number of
+	// requeued values
+	Requeue(context.Context, string) (int64, error)
+
+	Len(context.Context) (int64, error)
+
+	// Expire removes the queue after a TTL, or never if the TTL is 0
+	Expire(context.Context, time.Duration) error
+
 	Destroy(context.Context) error
 }
@@ -0,0 +1,85 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_PopReliable(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		q := s.Queue(testKey(t, "queue"))
+		defer q.Destroy(ctx)
+
+		assert.Nil(t, q.Push(ctx, "a"))
+		assert.Nil(t, q.Push(ctx, "b"))
+
+		first, err := q.PopReliable(ctx, "consumer")
+		assert.Nil(t, err)
+
+		second, err := q.PopReliable(ctx, "consumer")
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []string{"a", "b"}, []string{first, second})
+
+		assert.Nil(t, q.Ack(ctx, "consumer", first))
+		assert.True(t, errors.Is(q.Ack(ctx, "consumer", first), ErrNoKey))
+
+		n, err := q.Requeue(ctx, "consumer")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), n)
+
+		val, err := q.PopReliable(ctx, "other")
+		assert.Nil(t, err)
+		assert.Equal(t, second, val)
+	})
+}
+
+func TestQueue_PopReliableIdle(t *testing.T) {
+	if os.Getenv("REDIS_URL") == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+
+	ctx := context.Background()
+
+	s, err := NewRedisStore(ctx)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s.Close()
+
+	q := s.Queue(testKey(t, "queue"))
+	defer q.Destroy(ctx)
+
+	// the queue stays empty for longer than the read timeout of the
+	// connection
+	go func() {
+		time.Sleep(4 * time.Second)
+		q.Push(ctx, "a")
+	}()
+
+	val, err := q.PopReliable(ctx, "consumer")
+	assert.Nil(t, err)
+	assert.Equal(t, "a", val)
+}
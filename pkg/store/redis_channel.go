@@ -0,0 +1,69 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+)
+
+type redisChannel struct {
+	Name   string
+	Client *redis.Client
+}
+
+func (c *redisChannel) Publish(ctx context.Context, msg string) error {
+	_, err := c.Client.Publish(ctx, c.Name, msg).Result()
+	return err
+}
+
+func (c *redisChannel) Subscribe(ctx context.Context) (<-chan string, error) {
+	pubsub := c.Client.Subscribe(ctx, c.Name)
+
+	// wait for the subscription, so messages published after Subscribe returns
+	// are not missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	subscriber := make(chan string, bufferSize)
+
+	go func() {
+		defer close(subscriber)
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+
+				deliver(subscriber, msg.Payload)
+			}
+		}
+	}()
+
+	return subscriber, nil
+}
@@ -18,6 +18,8 @@ package store
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -31,3 +33,15 @@ func (k *redisKey) Destroy(ctx context.Context) error {
 	_, err := k.Client.Del(ctx, k.Key).Result()
 	return err
 }
+
+func (k *redisKey) Expire(ctx context.Context, ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New("negative TTL")
+	}
+
+	if ttl == 0 {
+		return k.Client.Persist(ctx, k.Key).Err()
+	}
+
+	return k.Client.PExpire(ctx, k.Key, ttl).Err()
+}
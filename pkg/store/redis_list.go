@@ -0,0 +1,46 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+)
+
+type redisList struct {
+	redisKey
+}
+
+func (l *redisList) Push(ctx context.Context, val string, max int64) error {
+	_, err := l.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, l.Key, val)
+		if max > 0 {
+			pipe.LTrim(ctx, l.Key, 0, max-1)
+		}
+		return nil
+	})
+	return err
+}
+
+func (l *redisList) Range(ctx context.Context, start, stop int64) ([]string, error) {
+	return l.Client.LRange(ctx, l.Key, start, stop).Result()
+}
+
+func (l *redisList) Len(ctx context.Context) (int64, error) {
+	return l.Client.LLen(ctx, l.Key).Result()
+}
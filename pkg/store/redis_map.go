@@ -20,6 +20,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -54,6 +56,10 @@ func (m *redisMap) Remove(ctx context.Context, k string) error {
 	return nil
 }
 
+func (m *redisMap) Increment(ctx context.Context, k string, delta int64) (int64, error) {
+	return m.Client.HIncrBy(ctx, m.Key, k, delta).Result()
+}
+
 func (m *redisMap) Scan(ctx context.Context, f func(context.Context, string, string)) error {
 	var cursor uint64
 	var results []string
@@ -66,7 +72,7 @@ func (m *redisMap) Scan(ctx context.Context, f func(context.Context, string, str
 		}
 
 		for i := 0; i < len(results); i += 2 {
-			f(ctx, results[i], results[1])
+			f(ctx, results[i], results[i+1])
 		}
 
 		if cursor == 0 {
@@ -76,3 +82,36 @@ func (m *redisMap) Scan(ctx context.Context, f func(context.Context, string, str
 
 	return nil
 }
+
+func (m *redisMap) Len(ctx context.Context) (int64, error) {
+	return m.Client.HLen(ctx, m.Key).Result()
+}
+
+// ExpireField uses HPEXPIRE, which requires Redis 7.4 or later
+func (m *redisMap) ExpireField(ctx context.Context, k string, ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New("negative TTL")
+	}
+
+	var cmd *redis.Cmd
+	if ttl == 0 {
+		cmd = m.Client.Do(ctx, "HPERSIST", m.Key, "FIELDS", 1, k)
+	} else {
+		cmd = m.Client.Do(ctx, "HPEXPIRE", m.Key, ttl.Milliseconds(), "FIELDS", 1, k)
+	}
+
+	results, err := cmd.Result()
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "ERR unknown command") {
+			return ErrNotSupported
+		}
+		return err
+	}
+
+	// -2 means that the field doesn't exist
+	if codes, ok := results.([]interface{}); ok && len(codes) == 1 && codes[0] == int64(-2) {
+		return fmt.Errorf("%s: %w", k, ErrNoKey)
+	}
+
+	return nil
+}
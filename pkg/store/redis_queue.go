@@ -18,6 +18,9 @@ package store
 
 import (
 	"context"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
 )
 
 type redisQueue struct {
@@ -37,3 +40,50 @@ func (q *redisQueue) Pop(ctx context.Context) (string, error) {
 
 	return result[1], err
 }
+
+func (q *redisQueue) processingList(consumer string) string {
+	return fmt.Sprintf("%s/processing/%s", q.Key, consumer)
+}
+
+// PopReliable uses BLMOVE, or BRPOPLPUSH if the server is older than Redis 6.2;
+// values are popped from the opposite end of Pop
+// PopReliable uses BRPOPLPUSH rather than BLMOVE, which is sent without
+// extending the read timeout of the connection and fails when the queue is idle
+func (q *redisQueue) PopReliable(ctx context.Context, consumer string) (string, error) {
+	return q.Client.BRPopLPush(ctx, q.Key, q.processingList(consumer), 0).Result()
+}
+
+func (q *redisQueue) Ack(ctx context.Context, consumer, val string) error {
+	n, err := q.Client.LRem(ctx, q.processingList(consumer), 1, val).Result()
+	if err != nil {
+		return err
+	}
+
+	if n != 1 {
+		return fmt.Errorf("value is not being processed: %w", ErrNoKey)
+	}
+
+	return nil
+}
+
+// requeueScript moves values from the processing list (KEYS[2]) to the end of
+// the queue (KEYS[1]) PopReliable pops from, oldest last
+var requeueScript = redis.NewScript(`
+local n = 0
+while true do
+	local val = redis.call('LPOP', KEYS[2])
+	if not val then
+		return n
+	end
+	redis.call('RPUSH', KEYS[1], val)
+	n = n + 1
+end
+`)
+
+func (q *redisQueue) Requeue(ctx context.Context, consumer string) (int64, error) {
+	return requeueScript.Run(ctx, q.Client, []string{q.Key, q.processingList(consumer)}).Int64()
+}
+
+func (q *redisQueue) Len(ctx context.Context) (int64, error) {
+	return q.Client.LLen(ctx, q.Key).Result()
+}
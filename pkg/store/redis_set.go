@@ -77,3 +77,7 @@ func (s *redisSet) Scan(ctx context.Context, f func(context.Context, string)) er
 func (s *redisSet) Members(ctx context.Context) ([]string, error) {
 	return s.Client.SMembers(ctx, s.Key).Result()
 }
+
+func (s *redisSet) Len(ctx context.Context) (int64, error) {
+	return s.Client.SCard(ctx, s.Key).Result()
+}
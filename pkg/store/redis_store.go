@@ -29,6 +29,7 @@ var poolSize = 512 * runtime.NumCPU()
 
 type redisStore struct {
 	redisClient *redis.Client
+	streams     *redisStreams
 }
 
 func connectToRedis(ctx context.Context) (*redis.Client, error) {
@@ -64,14 +65,32 @@ func NewRedisStore(ctx context.Context) (Store, error) {
 		return nil, err
 	}
 
-	return &redisStore{redisClient: redisClient}, nil
+	config, err := redisStreamConfigFromEnv()
+	if err != nil {
+		redisClient.Close()
+		return nil, err
+	}
+
+	streams, err := newRedisStreams(config)
+	if err != nil {
+		redisClient.Close()
+		return nil, err
+	}
+
+	return &redisStore{redisClient: redisClient, streams: streams}, nil
 }
 
 func (s *redisStore) Set(key string) Set {
 	return &redisSet{redisKey: redisKey{Key: key, Client: s.redisClient}}
 }
 
+// Queue returns a queue backed by a stream if the key matches one of the
+// prefixes in REDIS_STREAM_PREFIXES, or by a list otherwise
 func (s *redisStore) Queue(key string) Queue {
+	if s.streams.useStream(key) {
+		return &redisStreamQueue{redisKey: redisKey{Key: key, Client: s.redisClient}, streams: s.streams}
+	}
+
 	return &redisQueue{redisKey: redisKey{Key: key, Client: s.redisClient}}
 }
 
@@ -79,6 +98,14 @@ func (s *redisStore) Map(key string) Map {
 	return &redisMap{redisKey: redisKey{Key: key, Client: s.redisClient}}
 }
 
+func (s *redisStore) List(key string) List {
+	return &redisList{redisKey: redisKey{Key: key, Client: s.redisClient}}
+}
+
+func (s *redisStore) Channel(name string) Channel {
+	return &redisChannel{Name: name, Client: s.redisClient}
+}
+
 func (s *redisStore) Close() {
 	s.redisClient.Close()
 }
@@ -0,0 +1,458 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimkr/yodi/pkg/env"
+	"github.com/go-redis/redis/v8"
+)
+
+// redisStreamConfig determines which queues use Redis Streams instead of
+// lists, and how streams are consumed and trimmed
+type redisStreamConfig struct {
+	Prefixes  []string
+	Group     string
+	MaxLen    int64
+	MaxAge    time.Duration
+	ClaimIdle time.Duration
+}
+
+const (
+	defaultStreamGroup     = "yodi"
+	defaultStreamClaimIdle = time.Minute
+
+	// streamValueField is the field that holds the value of a stream entry
+	streamValueField = "v"
+)
+
+// redisStreams holds the state shared by all stream queues of a store: the
+// consumer groups known to exist, and the IDs of entries popped but not
+// acknowledged yet, by stream, consumer and value
+type redisStreams struct {
+	config   redisStreamConfig
+	consumer string
+	groups   sync.Map
+	lock     sync.Mutex
+	pending  map[string]map[string][]string
+}
+
+// redisStreamQueue is a queue backed by a Redis stream, consumed by a consumer
+// group; entries are deleted once acknowledged
+type redisStreamQueue struct {
+	redisKey
+	streams *redisStreams
+}
+
+// redisStreamConfigFromEnv reads the comma-separated key prefixes of queues
+// backed by streams from REDIS_STREAM_PREFIXES, the consumer group from
+// REDIS_STREAM_GROUP, trimming limits from REDIS_STREAM_MAXLEN (entries) and
+// REDIS_STREAM_MAX_AGE (seconds), and the time after which entries popped by
+// other consumers are claimed from REDIS_STREAM_CLAIM_IDLE (seconds)
+func redisStreamConfigFromEnv() (*redisStreamConfig, error) {
+	config := redisStreamConfig{Group: os.Getenv("REDIS_STREAM_GROUP"), ClaimIdle: defaultStreamClaimIdle}
+
+	for _, prefix := range strings.Split(os.Getenv("REDIS_STREAM_PREFIXES"), ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			config.Prefixes = append(config.Prefixes, prefix)
+		}
+	}
+
+	if config.Group == "" {
+		config.Group = defaultStreamGroup
+	}
+
+	if s := os.Getenv("REDIS_STREAM_MAXLEN"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid REDIS_STREAM_MAXLEN: %s", s)
+		}
+		config.MaxLen = n
+	}
+
+	var err error
+	if config.MaxAge, err = env.Seconds("REDIS_STREAM_MAX_AGE", 0); err != nil {
+		return nil, err
+	}
+
+	claimIdle, err := env.Seconds("REDIS_STREAM_CLAIM_IDLE", 0)
+	if err != nil {
+		return nil, err
+	}
+	if claimIdle > 0 {
+		config.ClaimIdle = claimIdle
+	}
+
+	return &config, nil
+}
+
+func newRedisStreams(config *redisStreamConfig) (*redisStreams, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+
+	return &redisStreams{
+		config:   *config,
+		consumer: fmt.Sprintf("%s-%s", hostname, hex.EncodeToString(buf)),
+		pending:  make(map[string]map[string][]string),
+	}, nil
+}
+
+// useStream determines whether or not a queue is backed by a stream
+func (s *redisStreams) useStream(key string) bool {
+	for _, prefix := range s.config.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isUnknownCommand(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "ERR unknown command")
+}
+
+// isNoGroup determines whether or not an error indicates that the consumer
+// group doesn't exist, because the stream was destroyed or expired
+func isNoGroup(err error) bool {
+	return err != nil && (strings.HasPrefix(err.Error(), "NOGROUP") || strings.Contains(err.Error(), "no longer exists"))
+}
+
+// ensureGroup creates the consumer group of the stream, and the stream, if
+// they don't exist; the group starts at the beginning of the stream, so entries
+// pushed before the group is created are not lost
+func (q *redisStreamQueue) ensureGroup(ctx context.Context) error {
+	if _, ok := q.streams.groups.Load(q.Key); ok {
+		return nil
+	}
+
+	err := q.Client.XGroupCreateMkStream(ctx, q.Key, q.streams.config.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	q.streams.groups.Store(q.Key, struct{}{})
+	return nil
+}
+
+func (q *redisStreamQueue) pendingKey(consumer string) string {
+	return q.Key + "\x00" + consumer
+}
+
+func (q *redisStreamQueue) addPending(consumer, id, val string) {
+	q.streams.lock.Lock()
+	defer q.streams.lock.Unlock()
+
+	key := q.pendingKey(consumer)
+	if _, ok := q.streams.pending[key]; !ok {
+		q.streams.pending[key] = make(map[string][]string)
+	}
+
+	q.streams.pending[key][val] = append(q.streams.pending[key][val], id)
+}
+
+func (q *redisStreamQueue) removePending(consumer, val string) (string, bool) {
+	q.streams.lock.Lock()
+	defer q.streams.lock.Unlock()
+
+	key := q.pendingKey(consumer)
+	ids := q.streams.pending[key][val]
+	if len(ids) == 0 {
+		return "", false
+	}
+
+	if len(ids) == 1 {
+		delete(q.streams.pending[key], val)
+	} else {
+		q.streams.pending[key][val] = ids[1:]
+	}
+
+	return ids[0], true
+}
+
+// addCommands returns the commands that add an entry to a stream, then trim
+// the stream approximately, by length and by age
+func (s *redisStreams) addCommands(key, val string) [][]interface{} {
+	xadd := []interface{}{"XADD", key}
+	if s.config.MaxLen > 0 {
+		xadd = append(xadd, "MAXLEN", "~", s.config.MaxLen)
+	}
+	cmds := [][]interface{}{append(xadd, "*", streamValueField, val)}
+
+	if s.config.MaxAge > 0 {
+		// MINID requires Redis 6.2 or later
+		minID := time.Now().Add(-s.config.MaxAge).UnixNano() / int64(time.Millisecond)
+		cmds = append(cmds, []interface{}{"XTRIM", key, "MINID", "~", minID})
+	}
+
+	return cmds
+}
+
+func (s *redisStreams) add(ctx context.Context, pipe redis.Pipeliner, key, val string) {
+	for _, args := range s.addCommands(key, val) {
+		pipe.Do(ctx, args...)
+	}
+}
+
+func (q *redisStreamQueue) Push(ctx context.Context, val string) error {
+	_, err := q.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		q.streams.add(ctx, pipe, q.Key, val)
+		return nil
+	})
+	return err
+}
+
+func entryValue(msg *redis.XMessage) (string, error) {
+	val, ok := msg.Values[streamValueField].(string)
+	if !ok {
+		return "", fmt.Errorf("invalid stream entry: %s", msg.ID)
+	}
+
+	return val, nil
+}
+
+// claim takes over one entry popped by another consumer, which hasn't
+// acknowledged it for a while, using XAUTOCLAIM (Redis 6.2 or later)
+func (q *redisStreamQueue) claim(ctx context.Context, consumer string) (*redis.XMessage, error) {
+	result, err := q.Client.Do(ctx, "XAUTOCLAIM", q.Key, q.streams.config.Group, consumer, q.streams.config.ClaimIdle.Milliseconds(), "0-0", "COUNT", 1).Result()
+	if err != nil {
+		if isUnknownCommand(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return parseClaimed(result), nil
+}
+
+// parseClaimed returns the first entry in a XAUTOCLAIM reply, which consists
+// of the next start ID, the claimed entries and, since Redis 7.0, the IDs of
+// deleted entries
+func parseClaimed(result interface{}) *redis.XMessage {
+	reply, ok := result.([]interface{})
+	if !ok || len(reply) < 2 {
+		return nil
+	}
+
+	entries, ok := reply[1].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, entry := range entries {
+		// entries deleted from the stream are nil in Redis 6.2
+		fields, ok := entry.([]interface{})
+		if !ok || len(fields) != 2 {
+			continue
+		}
+
+		id, _ := fields[0].(string)
+		values, _ := fields[1].([]interface{})
+
+		msg := redis.XMessage{ID: id, Values: make(map[string]interface{})}
+		for i := 0; i+1 < len(values); i += 2 {
+			if k, ok := values[i].(string); ok {
+				msg.Values[k] = values[i+1]
+			}
+		}
+
+		return &msg
+	}
+
+	return nil
+}
+
+func (q *redisStreamQueue) readOnce(ctx context.Context, consumer string) (*redis.XMessage, error) {
+	if err := q.ensureGroup(ctx); err != nil {
+		return nil, err
+	}
+
+	msg, err := q.claim(ctx, consumer)
+	if err != nil || msg != nil {
+		return msg, err
+	}
+
+	streams, err := q.Client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    q.streams.config.Group,
+		Consumer: consumer,
+		Streams:  []string{q.Key, ">"},
+		Count:    1,
+		Block:    0,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(streams) != 1 || len(streams[0].Messages) != 1 {
+		return nil, errors.New("unexpected stream entries")
+	}
+
+	return &streams[0].Messages[0], nil
+}
+
+// read reads one entry; if the consumer group is gone because the stream was
+// destroyed or expired, it creates the group again
+func (q *redisStreamQueue) read(ctx context.Context, consumer string) (*redis.XMessage, error) {
+	msg, err := q.readOnce(ctx, consumer)
+	if isNoGroup(err) {
+		q.streams.groups.Delete(q.Key)
+		return q.readOnce(ctx, consumer)
+	}
+
+	return msg, err
+}
+
+// ack acknowledges an entry and deletes it, so the stream contains only
+// entries that have not been processed yet
+func (q *redisStreamQueue) ack(ctx context.Context, id string) error {
+	_, err := q.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, q.Key, q.streams.config.Group, id)
+		pipe.XDel(ctx, q.Key, id)
+		return nil
+	})
+	return err
+}
+
+// Pop pops an entry and acknowledges it immediately
+func (q *redisStreamQueue) Pop(ctx context.Context) (string, error) {
+	for {
+		msg, err := q.read(ctx, q.streams.consumer)
+		if err != nil {
+			return "", err
+		}
+
+		if err := q.ack(ctx, msg.ID); err != nil {
+			return "", err
+		}
+
+		// an invalid entry is skipped
+		if val, err := entryValue(msg); err == nil {
+			return val, nil
+		}
+	}
+}
+
+// PopReliable pops an entry, which stays in the pending entries list of the
+// consumer until acknowledged; entries popped by other consumers and not
+// acknowledged for a while are claimed first
+func (q *redisStreamQueue) PopReliable(ctx context.Context, consumer string) (string, error) {
+	for {
+		msg, err := q.read(ctx, consumer)
+		if err != nil {
+			return "", err
+		}
+
+		val, err := entryValue(msg)
+		if err == nil {
+			q.addPending(consumer, msg.ID, val)
+			return val, nil
+		}
+
+		// an invalid entry is never going to be processed
+		if err := q.ack(ctx, msg.ID); err != nil {
+			return "", err
+		}
+	}
+}
+
+func (q *redisStreamQueue) Ack(ctx context.Context, consumer, val string) error {
+	id, ok := q.removePending(consumer, val)
+	if !ok {
+		return fmt.Errorf("value is not being processed: %w", ErrNoKey)
+	}
+
+	return q.ack(ctx, id)
+}
+
+// Requeue adds the pending entries of a consumer to the stream again, then
+// acknowledges them
+func (q *redisStreamQueue) Requeue(ctx context.Context, consumer string) (int64, error) {
+	if err := q.ensureGroup(ctx); err != nil {
+		return 0, err
+	}
+
+	var n int64
+
+	for {
+		pending, err := q.Client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   q.Key,
+			Group:    q.streams.config.Group,
+			Start:    "-",
+			End:      "+",
+			Count:    64,
+			Consumer: consumer,
+		}).Result()
+		if isNoGroup(err) {
+			// the stream is gone, with its pending entries
+			q.streams.groups.Delete(q.Key)
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if len(pending) == 0 {
+			break
+		}
+
+		for _, entry := range pending {
+			msgs, err := q.Client.XRangeN(ctx, q.Key, entry.ID, entry.ID, 1).Result()
+			if err != nil {
+				return n, err
+			}
+
+			// the entry may have been trimmed
+			if len(msgs) == 1 {
+				if val, err := entryValue(&msgs[0]); err == nil {
+					if err := q.Push(ctx, val); err != nil {
+						return n, err
+					}
+					n++
+				}
+			}
+
+			if err := q.ack(ctx, entry.ID); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	q.streams.lock.Lock()
+	delete(q.streams.pending, q.pendingKey(consumer))
+	q.streams.lock.Unlock()
+
+	return n, nil
+}
+
+// Len returns the number of entries that have not been acknowledged
+func (q *redisStreamQueue) Len(ctx context.Context) (int64, error) {
+	return q.Client.XLen(ctx, q.Key).Result()
+}
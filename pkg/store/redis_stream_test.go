@@ -0,0 +1,227 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func setenv(t *testing.T, vars map[string]string) func() {
+	for k, v := range vars {
+		assert.Nil(t, os.Setenv(k, v))
+	}
+
+	return func() {
+		for k := range vars {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestRedisStreamConfigFromEnv_Defaults(t *testing.T) {
+	config, err := redisStreamConfigFromEnv()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(config.Prefixes))
+	assert.Equal(t, defaultStreamGroup, config.Group)
+	assert.Equal(t, int64(0), config.MaxLen)
+	assert.Equal(t, time.Duration(0), config.MaxAge)
+	assert.Equal(t, defaultStreamClaimIdle, config.ClaimIdle)
+}
+
+func TestRedisStreamConfigFromEnv(t *testing.T) {
+	defer setenv(t, map[string]string{
+		"REDIS_STREAM_PREFIXES":   " /messages, ,/client/",
+		"REDIS_STREAM_GROUP":      "group",
+		"REDIS_STREAM_MAXLEN":     "1000",
+		"REDIS_STREAM_MAX_AGE":    "60",
+		"REDIS_STREAM_CLAIM_IDLE": "5",
+	})()
+
+	config, err := redisStreamConfigFromEnv()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/messages", "/client/"}, config.Prefixes)
+	assert.Equal(t, "group", config.Group)
+	assert.Equal(t, int64(1000), config.MaxLen)
+	assert.Equal(t, time.Minute, config.MaxAge)
+	assert.Equal(t, 5*time.Second, config.ClaimIdle)
+}
+
+func TestRedisStreamConfigFromEnv_Invalid(t *testing.T) {
+	for _, vars := range []map[string]string{
+		{"REDIS_STREAM_MAXLEN": "-1"},
+		{"REDIS_STREAM_MAXLEN": "x"},
+		{"REDIS_STREAM_MAX_AGE": "-1"},
+		{"REDIS_STREAM_CLAIM_IDLE": "1m"},
+	} {
+		unset := setenv(t, vars)
+		_, err := redisStreamConfigFromEnv()
+		assert.NotNil(t, err)
+		unset()
+	}
+}
+
+func TestRedisStreams_UseStream(t *testing.T) {
+	streams, err := newRedisStreams(&redisStreamConfig{Prefixes: []string{"/messages", "/client/"}})
+	assert.Nil(t, err)
+
+	assert.True(t, streams.useStream("/messages"))
+	assert.True(t, streams.useStream("/client/a/notify"))
+	assert.False(t, streams.useStream("/clients"))
+	assert.False(t, streams.useStream("/users"))
+}
+
+func TestRedisStreams_AddCommands(t *testing.T) {
+	streams, err := newRedisStreams(&redisStreamConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]interface{}{{"XADD", "/messages", "*", streamValueField, "x"}}, streams.addCommands("/messages", "x"))
+
+	// both limits apply
+	streams.config.MaxLen = 100
+	streams.config.MaxAge = time.Minute
+
+	cmds := streams.addCommands("/messages", "x")
+	if assert.Equal(t, 2, len(cmds)) {
+		assert.Equal(t, []interface{}{"XADD", "/messages", "MAXLEN", "~", int64(100), "*", streamValueField, "x"}, cmds[0])
+		assert.Equal(t, []interface{}{"XTRIM", "/messages", "MINID", "~"}, cmds[1][:4])
+
+		minID := cmds[1][4].(int64)
+		assert.InDelta(t, time.Now().Add(-time.Minute).UnixNano()/int64(time.Millisecond), minID, 1000)
+	}
+}
+
+func TestRedisStreamQueue_Pending(t *testing.T) {
+	streams, err := newRedisStreams(&redisStreamConfig{})
+	assert.Nil(t, err)
+
+	q := redisStreamQueue{redisKey: redisKey{Key: "/messages"}, streams: streams}
+	other := redisStreamQueue{redisKey: redisKey{Key: "/other"}, streams: streams}
+
+	// the same value can be popped twice
+	q.addPending("a", "1-0", "x")
+	q.addPending("a", "2-0", "x")
+	q.addPending("b", "3-0", "x")
+
+	_, ok := other.removePending("a", "x")
+	assert.False(t, ok)
+
+	_, ok = q.removePending("a", "y")
+	assert.False(t, ok)
+
+	id, ok := q.removePending("a", "x")
+	assert.True(t, ok)
+	assert.Equal(t, "1-0", id)
+
+	id, ok = q.removePending("a", "x")
+	assert.True(t, ok)
+	assert.Equal(t, "2-0", id)
+
+	_, ok = q.removePending("a", "x")
+	assert.False(t, ok)
+
+	id, ok = q.removePending("b", "x")
+	assert.True(t, ok)
+	assert.Equal(t, "3-0", id)
+}
+
+func TestParseClaimed(t *testing.T) {
+	entry := []interface{}{"2-0", []interface{}{streamValueField, "x"}}
+
+	// Redis 6.2 returns deleted entries as nil
+	msg := parseClaimed([]interface{}{"0-0", []interface{}{nil, entry}})
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, "2-0", msg.ID)
+
+		val, err := entryValue(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, "x", val)
+	}
+
+	// Redis 7.0 returns the IDs of deleted entries separately
+	msg = parseClaimed([]interface{}{"0-0", []interface{}{entry}, []interface{}{"1-0"}})
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, "2-0", msg.ID)
+	}
+
+	assert.Nil(t, parseClaimed([]interface{}{"0-0", []interface{}{}}))
+	assert.Nil(t, parseClaimed([]interface{}{"0-0"}))
+	assert.Nil(t, parseClaimed("OK"))
+
+	msg = parseClaimed([]interface{}{"0-0", []interface{}{[]interface{}{"3-0", []interface{}{"other", "x"}}}})
+	if assert.NotNil(t, msg) {
+		_, err := entryValue(msg)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestRedisStreamQueue(t *testing.T) {
+	if os.Getenv("REDIS_URL") == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+
+	defer setenv(t, map[string]string{"REDIS_STREAM_PREFIXES": "/test/"})()
+
+	ctx := context.Background()
+
+	s, err := NewRedisStore(ctx)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s.Close()
+
+	key := testKey(t, "stream")
+	q := s.Queue(key)
+	defer q.Destroy(ctx)
+	assert.IsType(t, &redisStreamQueue{}, q)
+
+	// an invalid entry is skipped
+	client := s.(*redisStore).redisClient
+	assert.Nil(t, client.XAdd(ctx, &redis.XAddArgs{Stream: key, Values: map[string]interface{}{"other": "x"}}).Err())
+
+	assert.Nil(t, q.Push(ctx, "a"))
+
+	val, err := q.PopReliable(ctx, "consumer")
+	assert.Nil(t, err)
+	assert.Equal(t, "a", val)
+
+	assert.Nil(t, q.Ack(ctx, "consumer", "a"))
+
+	n, err := q.Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	// the consumer group is created again after the stream is destroyed
+	assert.Nil(t, q.Destroy(ctx))
+	assert.Nil(t, q.Push(ctx, "b"))
+
+	val, err = q.PopReliable(ctx, "consumer")
+	assert.Nil(t, err)
+	assert.Equal(t, "b", val)
+
+	n, err = q.Requeue(ctx, "consumer")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+
+	val, err = q.Pop(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "b", val)
+}
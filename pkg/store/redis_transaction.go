@@ -0,0 +1,120 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisTx queues commands, which are sent in a MULTI/EXEC block
+type redisTx struct {
+	store *redisStore
+	cmds  []func(context.Context, redis.Pipeliner)
+}
+
+func (tx *redisTx) SetAdd(key, val string) {
+	tx.cmds = append(tx.cmds, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.SAdd(ctx, key, val)
+	})
+}
+
+func (tx *redisTx) SetRemove(key, val string) {
+	tx.cmds = append(tx.cmds, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.SRem(ctx, key, val)
+	})
+}
+
+func (tx *redisTx) QueuePush(key, val string) {
+	if tx.store.streams.useStream(key) {
+		tx.cmds = append(tx.cmds, func(ctx context.Context, pipe redis.Pipeliner) {
+			tx.store.streams.add(ctx, pipe, key, val)
+		})
+		return
+	}
+
+	tx.cmds = append(tx.cmds, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.LPush(ctx, key, val)
+	})
+}
+
+func (tx *redisTx) MapSet(key, k, v string) {
+	tx.cmds = append(tx.cmds, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.HSet(ctx, key, k, v)
+	})
+}
+
+func (tx *redisTx) MapRemove(key, k string) {
+	tx.cmds = append(tx.cmds, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.HDel(ctx, key, k)
+	})
+}
+
+func (tx *redisTx) MapIncrement(key, k string, delta int64) {
+	tx.cmds = append(tx.cmds, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.HIncrBy(ctx, key, k, delta)
+	})
+}
+
+func (tx *redisTx) Expire(key string, ttl time.Duration) {
+	tx.cmds = append(tx.cmds, func(ctx context.Context, pipe redis.Pipeliner) {
+		if ttl == 0 {
+			pipe.Persist(ctx, key)
+		} else {
+			pipe.PExpire(ctx, key, ttl)
+		}
+	})
+}
+
+func (tx *redisTx) Destroy(key string) {
+	tx.cmds = append(tx.cmds, func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.Del(ctx, key)
+	})
+}
+
+// Transaction uses WATCH to detect modification of the watched keys, and
+// retries if EXEC fails because of it
+func (s *redisStore) Transaction(ctx context.Context, watch []string, f func(context.Context, Tx) error) error {
+	for i := 0; i < maxTransactionAttempts; i++ {
+		err := s.redisClient.Watch(ctx, func(rtx *redis.Tx) error {
+			tx := redisTx{store: s}
+			if err := f(ctx, &tx); err != nil {
+				return err
+			}
+
+			if len(tx.cmds) == 0 {
+				return nil
+			}
+
+			_, err := rtx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, cmd := range tx.cmds {
+					cmd(ctx, pipe)
+				}
+				return nil
+			})
+			return err
+		}, watch...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+
+	return ErrTransactionConflict
+}
@@ -16,7 +16,10 @@
 
 package store
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // Set is a collection of unique values
 type Set interface {
@@ -24,5 +27,10 @@ type Set interface {
 	Remove(context.Context, string) error
 	Scan(context.Context, func(context.Context, string)) error
 	Members(context.Context) ([]string, error)
+	Len(context.Context) (int64, error)
+
+	// Expire removes the set after a TTL, or never if the TTL is 0
+	Expire(context.Context, time.Duration) error
+
 	Destroy(context.Context) error
 }
@@ -17,10 +17,21 @@
 // Package store is an abstraction layer for safe operations on data structures.
 package store
 
+import "context"
+
 // Store manages data structures identified by keys
 type Store interface {
 	Set(string) Set
 	Queue(string) Queue
 	Map(string) Map
+	List(string) List
+	Channel(string) Channel
+
+	// Transaction calls a function that may read keys and queue writes,
+	// then applies the writes atomically; if any of the watched keys is
+	// modified by others before the writes are applied, the function is
+	// called again
+	Transaction(context.Context, []string, func(context.Context, Tx) error) error
+
 	Close()
 }
@@ -0,0 +1,48 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrTransactionConflict is returned when a transaction keeps conflicting with
+// concurrent modifications of its watched keys
+var ErrTransactionConflict = errors.New("transaction conflict")
+
+// Tx queues write operations, which are applied atomically when the
+// transaction is committed; unlike the operations of Set and Map, these
+// operations don't fail if the value exists or doesn't exist already
+type Tx interface {
+	SetAdd(key, val string)
+	SetRemove(key, val string)
+	QueuePush(key, val string)
+	MapSet(key, k, v string)
+	MapRemove(key, k string)
+	MapIncrement(key, k string, delta int64)
+
+	// Expire removes a key after a TTL, or never if the TTL is 0; it does
+	// nothing if the key doesn't exist
+	Expire(key string, ttl time.Duration)
+
+	Destroy(key string)
+}
+
+// maxTransactionAttempts is the number of times a transaction is attempted
+// before giving up
+const maxTransactionAttempts = 16
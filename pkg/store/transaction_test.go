@@ -0,0 +1,246 @@
+// This file is part of yodi.
+//
+// Copyright 2020 Dima Krasner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testStores runs a test against the memory store, and against Redis if
+// REDIS_URL is set
+func testStores(t *testing.T, f func(*testing.T, Store)) {
+	t.Run("memory", func(t *testing.T) {
+		f(t, NewMemoryStore())
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		if os.Getenv("REDIS_URL") == "" {
+			t.Skip("REDIS_URL is not set")
+		}
+
+		s, err := NewRedisStore(context.Background())
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer s.Close()
+
+		f(t, s)
+	})
+}
+
+// testKey returns a key that is not used by other tests or previous runs
+func testKey(t *testing.T, name string) string {
+	return fmt.Sprintf("/test/%s/%d/%s", t.Name(), time.Now().UnixNano(), name)
+}
+
+func TestTransaction_Apply(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		set := testKey(t, "set")
+		m := testKey(t, "map")
+		q := testKey(t, "queue")
+		defer s.Set(set).Destroy(ctx)
+		defer s.Map(m).Destroy(ctx)
+		defer s.Queue(q).Destroy(ctx)
+
+		assert.Nil(t, s.Map(m).Set(ctx, "removed", "x"))
+
+		assert.Nil(t, s.Transaction(ctx, []string{set, m}, func(ctx context.Context, tx Tx) error {
+			tx.SetAdd(set, "a")
+			tx.MapSet(m, "k", "v")
+			tx.MapRemove(m, "removed")
+			tx.MapIncrement(m, "n", 2)
+			tx.MapIncrement(m, "n", 3)
+			tx.QueuePush(q, "msg")
+			return nil
+		}))
+
+		members, err := s.Set(set).Members(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"a"}, members)
+
+		v, err := s.Map(m).Get(ctx, "k")
+		assert.Nil(t, err)
+		assert.Equal(t, "v", v)
+
+		_, err = s.Map(m).Get(ctx, "removed")
+		assert.True(t, errors.Is(err, ErrNoKey))
+
+		v, err = s.Map(m).Get(ctx, "n")
+		assert.Nil(t, err)
+		assert.Equal(t, "5", v)
+
+		v, err = s.Queue(q).Pop(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, "msg", v)
+	})
+}
+
+func TestTransaction_Error(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		set := testKey(t, "set")
+		defer s.Set(set).Destroy(ctx)
+
+		errAbort := errors.New("abort")
+		assert.Equal(t, errAbort, s.Transaction(ctx, []string{set}, func(ctx context.Context, tx Tx) error {
+			tx.SetAdd(set, "a")
+			return errAbort
+		}))
+
+		n, err := s.Set(set).Len(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), n)
+	})
+}
+
+func TestTransaction_Conflict(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		set := testKey(t, "set")
+		m := testKey(t, "map")
+		defer s.Set(set).Destroy(ctx)
+		defer s.Map(m).Destroy(ctx)
+
+		assert.Nil(t, s.Set(set).Add(ctx, "a"))
+
+		attempts := 0
+		assert.Nil(t, s.Transaction(ctx, []string{set}, func(ctx context.Context, tx Tx) error {
+			attempts++
+
+			n, err := s.Set(set).Len(ctx)
+			if err != nil {
+				return err
+			}
+
+			// a write that is not part of a transaction modifies the
+			// watched key after it's read, during the first attempt
+			if attempts == 1 {
+				if err := s.Set(set).Add(ctx, "b"); err != nil {
+					return err
+				}
+			}
+
+			tx.MapSet(m, "members", fmt.Sprintf("%d", n))
+			return nil
+		}))
+		assert.Equal(t, 2, attempts)
+
+		v, err := s.Map(m).Get(ctx, "members")
+		assert.Nil(t, err)
+		assert.Equal(t, "2", v)
+	})
+}
+
+func TestTransaction_ConflictMissingKey(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		m := testKey(t, "map")
+		defer s.Map(m).Destroy(ctx)
+
+		attempts := 0
+		var seen []string
+		assert.Nil(t, s.Transaction(ctx, []string{m}, func(ctx context.Context, tx Tx) error {
+			attempts++
+
+			v, err := s.Map(m).Get(ctx, "k")
+			if err != nil && !errors.Is(err, ErrNoKey) {
+				return err
+			}
+			seen = append(seen, v)
+
+			// the key doesn't exist when watched, but created by others
+			if attempts == 1 {
+				if err := s.Map(m).Set(ctx, "k", "other"); err != nil {
+					return err
+				}
+			}
+
+			tx.MapSet(m, "k", "tx")
+			return nil
+		}))
+		assert.Equal(t, []string{"", "other"}, seen)
+		assert.Equal(t, 2, attempts)
+
+		v, err := s.Map(m).Get(ctx, "k")
+		assert.Nil(t, err)
+		assert.Equal(t, "tx", v)
+	})
+}
+
+func TestTransaction_ConflictGiveUp(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		set := testKey(t, "set")
+		defer s.Set(set).Destroy(ctx)
+
+		attempts := 0
+		assert.Equal(t, ErrTransactionConflict, s.Transaction(ctx, []string{set}, func(ctx context.Context, tx Tx) error {
+			attempts++
+
+			if err := s.Set(set).Add(ctx, fmt.Sprintf("%d", attempts)); err != nil {
+				return err
+			}
+
+			tx.SetAdd(set, "tx")
+			return nil
+		}))
+		assert.Equal(t, maxTransactionAttempts, attempts)
+	})
+}
+
+func TestTransaction_Expire(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewMemoryStore()
+
+	assert.Nil(t, s.Transaction(ctx, nil, func(ctx context.Context, tx Tx) error {
+		tx.MapSet("/a", "k", "v")
+		tx.Expire("/a", 50*time.Millisecond)
+		tx.MapSet("/b", "k", "v")
+		tx.Expire("/b", 50*time.Millisecond)
+		tx.Expire("/missing", 50*time.Millisecond)
+		return nil
+	}))
+
+	assert.Nil(t, s.Transaction(ctx, nil, func(ctx context.Context, tx Tx) error {
+		tx.Expire("/b", 0)
+		return nil
+	}))
+
+	time.Sleep(100 * time.Millisecond)
+
+	n, err := s.Map("/a").Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	n, err = s.Map("/b").Len(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+}